@@ -0,0 +1,73 @@
+package collection
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const temporaryFilePrefix = ".tmp-"
+
+// writeFileAtomically writes data to a temporary file in the same directory,
+// syncs it and renames it over filePath so that readers and crashes only ever
+// observe either the previous or the new content.
+func writeFileAtomically(filePath string, data []byte, permissions os.FileMode) (err error) {
+	directory := filepath.Dir(filePath)
+
+	file, err := ioutil.TempFile(directory, temporaryFilePrefix+filepath.Base(filePath)+"-")
+	if err != nil {
+		return
+	}
+
+	temporaryPath := file.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(temporaryPath)
+		}
+	}()
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Chmod(permissions)
+	}
+
+	closeError := file.Close()
+	if err != nil {
+		return
+	}
+	if closeError != nil {
+		err = closeError
+		return
+	}
+
+	err = os.Rename(temporaryPath, filePath)
+	if err != nil {
+		return
+	}
+
+	err = syncDirectory(directory)
+	return
+}
+
+func syncDirectory(directory string) (err error) {
+	handle, err := os.Open(directory)
+	if err != nil {
+		return
+	}
+
+	err = handle.Sync()
+	closeError := handle.Close()
+	if err == nil {
+		err = closeError
+	}
+
+	return
+}
+
+func isTemporaryFile(name string) bool {
+	return strings.HasPrefix(name, temporaryFilePrefix)
+}
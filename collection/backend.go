@@ -0,0 +1,71 @@
+package collection
+
+import (
+	"sort"
+	"sync"
+)
+
+// Backend opens collections by name, which lets the HTTP service serve
+// collections from different kinds of storage.
+type Backend interface {
+	Open(name string) (Collection, error)
+	Info() (CollectionsInfo, error)
+}
+
+// FilesystemBackend serves the collections stored in Root, opened with
+// OpenCollection.
+type FilesystemBackend struct {
+	Root string
+}
+
+func (backend FilesystemBackend) Open(name string) (Collection, error) {
+	return OpenCollection(backend.Root, name)
+}
+
+func (backend FilesystemBackend) Info() (CollectionsInfo, error) {
+	return FilesystemCollectionsInfo(backend.Root)
+}
+
+// MemoryBackend serves MemoryCollections, which are created the first time
+// they are opened and are lost when the process exits.
+type MemoryBackend struct {
+	mux         sync.Mutex
+	collections map[string]*MemoryCollection
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{collections: map[string]*MemoryCollection{}}
+}
+
+func (backend *MemoryBackend) Open(name string) (Collection, error) {
+	backend.mux.Lock()
+	defer backend.mux.Unlock()
+
+	memoryCollection, exists := backend.collections[name]
+	if !exists {
+		memoryCollection = NewMemoryCollection(name)
+		backend.collections[name] = memoryCollection
+	}
+
+	return memoryCollection, nil
+}
+
+func (backend *MemoryBackend) Info() (collectionsInfo CollectionsInfo, err error) {
+	backend.mux.Lock()
+	defer backend.mux.Unlock()
+
+	collectionsInfo = CollectionsInfo{}
+	for name, memoryCollection := range backend.collections {
+		collectionsInfo = append(collectionsInfo, CollectionInfo{
+			Name:    name,
+			Path:    "/" + name + "/",
+			Entries: memoryCollection.Count(),
+		})
+	}
+
+	sort.Slice(collectionsInfo, func(i int, j int) bool {
+		return collectionsInfo[i].Name < collectionsInfo[j].Name
+	})
+
+	return
+}
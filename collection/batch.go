@@ -0,0 +1,311 @@
+package collection
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const journalFileName = "_journal.json"
+
+type InvalidBatchError struct {
+	Message string
+}
+
+func (err InvalidBatchError) Error() string {
+	return "Invalid batch: " + err.Message
+}
+
+// Batch is a set of puts and deletes that WriteBatch applies all or nothing.
+// Puts behave like Persist and deletes like Delete, including the revision
+// checks of Revisioned entries.
+type Batch struct {
+	Operations []BatchOperation
+}
+
+type BatchOperation struct {
+	Delete bool
+	Entry  Entry
+}
+
+func (batch *Batch) Put(entry Entry) *Batch {
+	batch.Operations = append(batch.Operations, BatchOperation{Entry: entry})
+	return batch
+}
+
+func (batch *Batch) Delete(entry Entry) *Batch {
+	batch.Operations = append(batch.Operations, BatchOperation{Delete: true, Entry: entry})
+	return batch
+}
+
+// journalOperation holds what an entry looked like before and after a batch,
+// a nil Document means that the entry is deleted.
+type journalOperation struct {
+	ID       uuid.UUID       `json:"id"`
+	Document json.RawMessage `json:"document,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"`
+}
+
+type journal struct {
+	Operations []journalOperation `json:"operations"`
+}
+
+func (collection FilesystemCollection) getJournalFilename() string {
+	return filepath.Join(collection.getDirectory(), journalFileName)
+}
+
+// WriteBatch applies every operation of the batch or none of them. The
+// changes are written to a journal before any entry is touched, which means
+// that a batch interrupted by a crash is completed by Recover.
+func (collection FilesystemCollection) WriteBatch(batch Batch) (err error) {
+	unlock, err := collection.createAndLock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	err = collection.recoverJournal()
+	if err != nil {
+		return
+	}
+
+	_, schema, err := readSchemaFile(collection.getDirectory())
+	if err != nil {
+		return
+	}
+
+	operations, revisions, err := prepareBatch(collection.GetName(), batch, collection.loadRaw, schema)
+	if err != nil {
+		return
+	}
+
+	pending := journal{Operations: operations}
+
+	serialized, err := json.Marshal(pending)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomically(collection.getJournalFilename(), serialized, 0600)
+	if err != nil {
+		return
+	}
+
+	err = collection.applyJournal(pending)
+	if err != nil {
+		return
+	}
+
+	finishBatch(batch, operations, revisions)
+	return
+}
+
+// prepareBatch checks the operations of a batch against the stored entries,
+// read with loadRaw, and the schema and returns the documents to store with
+// their revisions. The entries of the batch are left as they are, new IDs and
+// revisions are set by finishBatch once the batch is stored.
+func prepareBatch(collectionName string, batch Batch, loadRaw func(id uuid.UUID) ([]byte, error), schema *compiledSchema) (operations []journalOperation, revisions []uint64, err error) {
+	revisions = make([]uint64, len(batch.Operations))
+	seen := map[uuid.UUID]bool{}
+
+	for i, operation := range batch.Operations {
+		if operation.Entry == nil {
+			err = InvalidBatchError{Message: "operation without entry"}
+			return
+		}
+
+		id := operation.Entry.GetID()
+		if id == uuid.Nil {
+			if operation.Delete {
+				err = EntryDoesNotExistError{}
+				return
+			}
+
+			id = uuid.Must(uuid.NewV4())
+		}
+
+		if seen[id] {
+			err = InvalidBatchError{Message: "entry " + id.String() + " occurs more than once"}
+			return
+		}
+		seen[id] = true
+
+		previous, loadError := loadRaw(id)
+		if _, ok := loadError.(EntryDoesNotExistError); ok && !operation.Delete {
+			loadError = nil
+		}
+		if loadError != nil {
+			err = loadError
+			return
+		}
+
+		oldDocument := parseDocument(previous)
+		err = checkRevision(id, getExpectedRevision(operation.Entry), documentRevision(oldDocument))
+		if err != nil {
+			return
+		}
+
+		journalEntry := journalOperation{ID: id, Previous: previous}
+		if !operation.Delete {
+			originalID := operation.Entry.GetID()
+			operation.Entry.SetID(id)
+			serialized, marshalError := json.Marshal(operation.Entry)
+			operation.Entry.SetID(originalID)
+			if marshalError != nil {
+				err = marshalError
+				return
+			}
+
+			_, journalEntry.Document, revisions[i], err = nextRevision(collectionName, id, serialized, oldDocument, schema)
+			if err != nil {
+				return
+			}
+		}
+
+		operations = append(operations, journalEntry)
+	}
+
+	return
+}
+
+func finishBatch(batch Batch, operations []journalOperation, revisions []uint64) {
+	for i, operation := range batch.Operations {
+		if !operation.Delete {
+			operation.Entry.SetID(operations[i].ID)
+			setRevision(operation.Entry, revisions[i])
+		}
+	}
+}
+
+// applyJournal writes the documents of the journal and removes it. Applying
+// a journal more than once gives the same result, which is what makes it
+// possible to roll an interrupted batch forward. The changes are published
+// before the journal is removed, so a batch that is rolled forward can
+// publish its changes twice.
+func (collection FilesystemCollection) applyJournal(pending journal) (err error) {
+	changes := []Change{}
+	for _, operation := range pending.Operations {
+		changes = append(changes, documentChange(operation.ID, operation.Previous, operation.Document))
+
+		oldDocument := parseDocument(operation.Previous)
+		newDocument := parseDocument(operation.Document)
+
+		// Without a previous document the entry may still be stored but
+		// expired, with its keys in the indexes.
+		if operation.Previous == nil {
+			stored, readError := collection.readRaw(operation.ID)
+			if _, ok := readError.(EntryDoesNotExistError); ok {
+				readError = nil
+			}
+			if readError != nil {
+				err = readError
+				return
+			}
+
+			oldDocument = parseDocument(stored)
+		}
+
+		if operation.Document != nil {
+			err = collection.addToIndexes(operation.ID, newDocument)
+			if err != nil {
+				return
+			}
+
+			err = writeFileAtomically(collection.getFilename(operation.ID), operation.Document, 0600)
+			if err != nil {
+				return
+			}
+		} else {
+			err = os.Remove(collection.getFilename(operation.ID))
+			if err != nil && !os.IsNotExist(err) {
+				return
+			}
+			err = nil
+		}
+
+		err = collection.removeFromIndexes(operation.ID, oldDocument, newDocument)
+		if err != nil {
+			return
+		}
+
+		collection.recordHistory(operation.ID, operation.Previous, operation.Document)
+	}
+
+	collection.publish(changes...)
+
+	err = os.Remove(collection.getJournalFilename())
+	if err != nil {
+		return
+	}
+
+	err = syncDirectory(collection.getDirectory())
+	return
+}
+
+// recoverJournal rolls an interrupted batch forward. The journal is written
+// atomically before any entry is changed, so a batch without a journal never
+// touched the entries and has nothing to roll back.
+func (collection FilesystemCollection) recoverJournal() (err error) {
+	raw, err := ioutil.ReadFile(collection.getJournalFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	pending := journal{}
+	err = json.Unmarshal(raw, &pending)
+	if err != nil {
+		return
+	}
+
+	err = collection.applyJournal(pending)
+	return
+}
+
+// Recover completes a batch that was interrupted, e.g. by a crash, and should
+// be called before the collection is used.
+func (collection FilesystemCollection) Recover() (err error) {
+	unlock, err := collection.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	err = collection.recoverJournal()
+	return
+}
+
+// RecoverFilesystemCollections calls Recover on every FilesystemCollection in
+// root.
+func RecoverFilesystemCollections(root string) (err error) {
+	if root == "" {
+		root = DefaultRoot
+	}
+
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "no such file or directory") {
+			err = nil
+		}
+		return
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || IsLogCollection(root, file.Name()) {
+			continue
+		}
+
+		err = FilesystemCollection{Root: root, Name: file.Name()}.Recover()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
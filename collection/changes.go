@@ -0,0 +1,485 @@
+package collection
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const changesFileSuffix = ".changes"
+
+// ChangePollInterval is how often watchers look for changes made by other
+// processes, changes made within the process are delivered right away.
+var ChangePollInterval = time.Second
+
+// ChangeRetention is the number of changes kept in the change log of a
+// collection, the log is cut down to that many once it holds twice as many.
+var ChangeRetention = 1000
+
+type ChangeType string
+
+const (
+	ChangeInsert ChangeType = "insert"
+	ChangeUpdate ChangeType = "update"
+	ChangeDelete ChangeType = "delete"
+
+	// ChangeError is the last change sent before a feed is closed because it
+	// failed, Error tells why.
+	ChangeError ChangeType = "error"
+)
+
+// Change is an event in the change feed of a collection. Sequence increases
+// with every change and can be passed to WatchSince to resume a feed. Entry
+// holds the entry as the change stored it and is empty for deletes, Previous
+// holds the entry as it was before the change and is empty for inserts.
+type Change struct {
+	Sequence uint64          `json:"sequence,omitempty"`
+	Type     ChangeType      `json:"type"`
+	ID       uuid.UUID       `json:"id"`
+	Entry    json.RawMessage `json:"entry,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// Watcher is implemented by collections that publish a change feed. A change
+// passes the filter if the entry passes it before or after the change.
+type Watcher interface {
+	Watch(ctx context.Context, filter interface{}) (<-chan Change, error)
+	WatchSince(ctx context.Context, filter interface{}, since uint64) (<-chan Change, error)
+}
+
+// ChangesCompactedError is returned by WatchSince when the changes after
+// since are no longer kept, Oldest is the first change that is.
+type ChangesCompactedError struct {
+	Since  uint64
+	Oldest uint64
+}
+
+func (err ChangesCompactedError) Error() string {
+	return "Changes after " + strconv.FormatUint(err.Since, 10) + " are no longer kept, the oldest kept change is " + strconv.FormatUint(err.Oldest, 10)
+}
+
+// changePosition is a place in the change log, the changes after sequence
+// start at offset in the log file described by info.
+type changePosition struct {
+	sequence uint64
+	oldest   uint64
+	offset   int64
+	info     os.FileInfo
+}
+
+// changeFeed is the state the process keeps for the change log of a
+// collection. notify is closed, and replaced, whenever a change is appended.
+type changeFeed struct {
+	mux      sync.Mutex
+	filename string
+	position changePosition
+	notify   chan struct{}
+}
+
+var changeFeeds = map[string]*changeFeed{}
+var changeFeedsMux sync.Mutex
+
+// changesFilename returns the change log of a collection directory, which is
+// kept next to the directory like the lock file.
+func changesFilename(directory string) string {
+	return filepath.Join(filepath.Dir(directory), "."+filepath.Base(directory)+changesFileSuffix)
+}
+
+func feedFor(directory string) *changeFeed {
+	filename := changesFilename(directory)
+	if absolute, err := filepath.Abs(filename); err == nil {
+		filename = absolute
+	}
+
+	changeFeedsMux.Lock()
+	defer changeFeedsMux.Unlock()
+
+	feed, exists := changeFeeds[filename]
+	if !exists {
+		feed = &changeFeed{filename: filename, notify: make(chan struct{})}
+		changeFeeds[filename] = feed
+	}
+
+	return feed
+}
+
+// readChanges reads the complete changes in the log from offset and returns
+// the offset after the last of them. The offset belongs to the log file
+// described by known, reading starts over from the beginning if the log has
+// been compacted into a new file since.
+func readChanges(filename string, offset int64, known os.FileInfo) (changes []Change, next int64, info os.FileInfo, err error) {
+	next = offset
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err = file.Stat()
+	if err != nil {
+		return
+	}
+
+	if known == nil || !os.SameFile(known, info) {
+		next = 0
+	}
+
+	_, err = file.Seek(next, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, readError := reader.ReadBytes('\n')
+		if readError != nil {
+			// A line without newline is a change that is still being, or
+			// never was, completely written.
+			if readError != io.EOF {
+				err = readError
+			}
+			return
+		}
+
+		change := Change{}
+		if json.Unmarshal(line, &change) == nil {
+			changes = append(changes, change)
+		}
+
+		next += int64(len(line))
+	}
+}
+
+// sameLog tells if two reads of the change log were made from the same file,
+// which is replaced when the log is compacted.
+func sameLog(a os.FileInfo, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b)
+}
+
+func formatChanges(changes []Change) (lines []byte, err error) {
+	for _, change := range changes {
+		serialized, marshalError := json.Marshal(change)
+		if marshalError != nil {
+			err = marshalError
+			return
+		}
+
+		lines = append(append(lines, serialized...), '\n')
+	}
+
+	return
+}
+
+// refresh catches up with changes appended to the log, possibly by another
+// process, the caller holds feed.mux.
+func (feed *changeFeed) refresh() (err error) {
+	changes, next, info, err := readChanges(feed.filename, feed.position.offset, feed.position.info)
+	if err != nil {
+		return
+	}
+
+	if !sameLog(feed.position.info, info) {
+		feed.position.oldest = 0
+	}
+
+	for _, change := range changes {
+		if feed.position.oldest == 0 {
+			feed.position.oldest = change.Sequence
+		}
+		if change.Sequence > feed.position.sequence {
+			feed.position.sequence = change.Sequence
+		}
+	}
+
+	feed.position.offset = next
+	feed.position.info = info
+	return
+}
+
+// publish appends the changes to the log with the next sequence numbers. The
+// caller holds the exclusive collection lock, so no other process appends at
+// the same time and anything after the last complete change can be cut off.
+// The entry before and after each change is stored with it, so that watchers
+// can filter on both. The log is not synced, the entries themselves are the
+// durable copy.
+func (feed *changeFeed) publish(changes []Change) (err error) {
+	if len(changes) == 0 {
+		return
+	}
+
+	feed.mux.Lock()
+	defer feed.mux.Unlock()
+
+	err = feed.refresh()
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(feed.filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	offset := feed.position.offset
+	if !sameLog(feed.position.info, info) {
+		offset = 0
+	}
+
+	if info.Size() > offset {
+		err = file.Truncate(offset)
+		if err != nil {
+			return
+		}
+	}
+
+	sequence := feed.position.sequence
+	stored := []Change{}
+	for _, change := range changes {
+		sequence++
+		change.Sequence = sequence
+		stored = append(stored, change)
+	}
+
+	lines, err := formatChanges(stored)
+	if err != nil {
+		return
+	}
+
+	_, err = file.WriteAt(lines, offset)
+	if err != nil {
+		file.Truncate(offset)
+		return
+	}
+
+	if feed.position.oldest == 0 || offset == 0 {
+		feed.position.oldest = stored[0].Sequence
+	}
+	feed.position.offset = offset + int64(len(lines))
+	feed.position.info = info
+	feed.position.sequence = sequence
+
+	close(feed.notify)
+	feed.notify = make(chan struct{})
+
+	if ChangeRetention > 0 && feed.position.sequence-feed.position.oldest >= uint64(2*ChangeRetention) {
+		err = feed.compact()
+	}
+
+	return
+}
+
+// compact replaces the log with one that holds the last ChangeRetention
+// changes, the caller holds feed.mux and the exclusive collection lock.
+func (feed *changeFeed) compact() (err error) {
+	changes, _, _, err := readChanges(feed.filename, 0, nil)
+	if err != nil || len(changes) <= ChangeRetention {
+		return
+	}
+
+	kept := changes[len(changes)-ChangeRetention:]
+	lines, err := formatChanges(kept)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomically(feed.filename, lines, 0600)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(feed.filename)
+	if err != nil {
+		return
+	}
+
+	feed.position = changePosition{
+		sequence: kept[len(kept)-1].Sequence,
+		oldest:   kept[0].Sequence,
+		offset:   int64(len(lines)),
+		info:     info,
+	}
+	return
+}
+
+// current returns the position after the last change and a channel that is
+// closed when the next change is published.
+func (feed *changeFeed) current() (position changePosition, notify chan struct{}, err error) {
+	feed.mux.Lock()
+	defer feed.mux.Unlock()
+
+	err = feed.refresh()
+	return feed.position, feed.notify, err
+}
+
+// watch sends the changes after since, starting to read the log at offset,
+// that pass the filter until ctx is done. When the log cannot be read, or the
+// changes the watcher has not sent yet are compacted away, a ChangeError is
+// sent before the channel is closed.
+func (feed *changeFeed) watch(ctx context.Context, filter preparedFilter, since uint64, offset int64, info os.FileInfo) <-chan Change {
+	changes := make(chan Change)
+
+	go func() {
+		defer close(changes)
+
+		fail := func(err error) {
+			select {
+			case changes <- Change{Type: ChangeError, Error: err.Error()}:
+			case <-ctx.Done():
+			}
+		}
+
+		for {
+			_, notify, err := feed.current()
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			found, next, nextInfo, err := readChanges(feed.filename, offset, info)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			if info != nil && !sameLog(info, nextInfo) && len(found) > 0 && found[0].Sequence > since+1 {
+				fail(ChangesCompactedError{Since: since, Oldest: found[0].Sequence})
+				return
+			}
+			offset, info = next, nextInfo
+
+			for _, change := range found {
+				if change.Sequence <= since {
+					continue
+				}
+				since = change.Sequence
+
+				if !changePassesFilter(change, filter) {
+					continue
+				}
+
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-notify:
+			case <-time.After(ChangePollInterval):
+			}
+		}
+	}()
+
+	return changes
+}
+
+// changePassesFilter lets a change pass if the entry passes the filter before
+// or after the change, so that watchers also learn about entries that stop
+// passing it.
+func changePassesFilter(change Change, filter preparedFilter) bool {
+	if filter.filter == nil {
+		return true
+	}
+
+	for _, raw := range []json.RawMessage{change.Previous, change.Entry} {
+		document := map[string]interface{}{}
+		if len(raw) > 0 && json.Unmarshal(raw, &document) == nil && filter.passes(reflect.ValueOf(document)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func documentChange(id uuid.UUID, previous []byte, document []byte) Change {
+	change := Change{Type: ChangeUpdate, ID: id, Entry: document, Previous: previous}
+	if document == nil {
+		change.Type = ChangeDelete
+	} else if previous == nil {
+		change.Type = ChangeInsert
+	}
+
+	return change
+}
+
+// Watch sends the changes made to the collection from now on that pass the
+// filter, a nil filter lets every change pass. The channel is closed when ctx
+// is done.
+func (collection FilesystemCollection) Watch(ctx context.Context, filter interface{}) (changes <-chan Change, err error) {
+	prepared, err := prepareFilter(filter)
+	if err != nil {
+		return
+	}
+
+	feed := feedFor(collection.getDirectory())
+	position, _, err := feed.current()
+	if err != nil {
+		return
+	}
+
+	changes = feed.watch(ctx, prepared, position.sequence, position.offset, position.info)
+	return
+}
+
+// WatchSince is like Watch but starts with the changes after the sequence
+// number since, which lets a watcher resume where it stopped.
+// ChangesCompactedError is returned if those changes are no longer kept.
+func (collection FilesystemCollection) WatchSince(ctx context.Context, filter interface{}, since uint64) (changes <-chan Change, err error) {
+	prepared, err := prepareFilter(filter)
+	if err != nil {
+		return
+	}
+
+	feed := feedFor(collection.getDirectory())
+	position, _, err := feed.current()
+	if err != nil {
+		return
+	}
+
+	if since >= position.sequence {
+		changes = feed.watch(ctx, prepared, since, position.offset, position.info)
+		return
+	}
+
+	if position.oldest > since+1 {
+		err = ChangesCompactedError{Since: since, Oldest: position.oldest}
+		return
+	}
+
+	changes = feed.watch(ctx, prepared, since, 0, position.info)
+	return
+}
+
+// publish adds the changes of a write to the change feed. It is called once
+// the write is durable, so a failure is logged rather than reported as a
+// failed write.
+func (collection FilesystemCollection) publish(changes ...Change) {
+	err := feedFor(collection.getDirectory()).publish(changes)
+	if err != nil {
+		log.Println("Failed to publish changes to collection", collection.GetName(), ":", err)
+	}
+}
@@ -1,6 +1,8 @@
 package collection
 
 import (
+	"time"
+
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -10,6 +12,12 @@ func (err EntryDoesNotExistError) Error() string {
 	return "Entity does not exist"
 }
 
+type EntryAlreadyExistsError struct{}
+
+func (err EntryAlreadyExistsError) Error() string {
+	return "Entity already exists"
+}
+
 type EntryNotParsableError struct {
 	ID             uuid.UUID
 	CollectionName string
@@ -19,6 +27,24 @@ func (err EntryNotParsableError) Error() string {
 	return "Entry " + err.CollectionName + "/" + err.ID.String() + ".json contains bad data."
 }
 
+// Collection is the storage abstraction implemented by both the local
+// FilesystemCollection and the HTTP backed remote.RemoteCollection.
+type Collection interface {
+	GetName() string
+	Persist(entry Entry) error
+	Insert(entry Entry) error
+	Replace(entry Entry) error
+	Upsert(entry Entry) (created bool, err error)
+	Delete(entry Entry) error
+	WriteBatch(batch Batch) error
+	Patch(id uuid.UUID, patch Patch, entry Entry) error
+	Load(id uuid.UUID, entry Entry) error
+	LoadAll(entries interface{}, limit int) error
+	LoadAllWithOptions(entries interface{}, options QueryOptions) (QueryResult, error)
+	Query(filter interface{}, limit int, entries interface{}) error
+	QueryWithOptions(filter interface{}, options QueryOptions, entries interface{}) (QueryResult, error)
+}
+
 type Entry interface {
 	GetID() uuid.UUID
 	SetID(uuid.UUID)
@@ -51,6 +77,53 @@ func (entry *UntypedEntry) SetID(id uuid.UUID) {
 	(*entry)["ID"] = id.String()
 }
 
+func (entry *UntypedEntry) GetRevision() uint64 {
+	return documentRevision(*entry)
+}
+
+func (entry *UntypedEntry) SetRevision(revision uint64) {
+	(*entry)[RevisionField] = revision
+}
+
+func (entry *UntypedEntry) GetExpiresAt() (expiresAt time.Time) {
+	if value, ok := (*entry)[ExpiresAtField].(string); ok {
+		expiresAt, _ = time.Parse(time.RFC3339Nano, value)
+	}
+
+	return
+}
+
+func (entry *UntypedEntry) SetExpiresAt(expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		delete(*entry, ExpiresAtField)
+		return
+	}
+
+	(*entry)[ExpiresAtField] = expiresAt.Format(time.RFC3339Nano)
+}
+
+// Project removes every field but the given ones, the ID and the revision from
+// the entry.
+func (entry *UntypedEntry) Project(fields []string) {
+	for key := range *entry {
+		if key == "ID" || key == RevisionField {
+			continue
+		}
+
+		keep := false
+		for _, field := range fields {
+			if key == field {
+				keep = true
+				break
+			}
+		}
+
+		if !keep {
+			delete(*entry, key)
+		}
+	}
+}
+
 type CollectionsInfo []CollectionInfo
 
 type CollectionInfo struct {
@@ -1,7 +1,15 @@
 package collection_test
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,8 +32,20 @@ type Book struct {
 	Rating int
 }
 
+func createTemporaryRoot(test *testing.T) string {
+	root, err := ioutil.TempDir("", "collection-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	return root
+}
+
 func TestPersistLoadDelete(test *testing.T) {
-	authors := collection.FilesystemCollection{Name: "authors"}
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	authors := collection.NewFilesystemCollection(root, "authors")
 
 	birthDate, _ := time.Parse(time.RFC3339, "1858-10-20T00:00:00Z")
 	author := Author{
@@ -51,7 +71,10 @@ func TestPersistLoadDelete(test *testing.T) {
 }
 
 func TestShouldFailDeletingMissingEntry(test *testing.T) {
-	authors := collection.FilesystemCollection{Name: "authors"}
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	authors := collection.NewFilesystemCollection(root, "authors")
 
 	author := Author{}
 	author.SetID(uuid.Must(uuid.NewV4()))
@@ -60,8 +83,44 @@ func TestShouldFailDeletingMissingEntry(test *testing.T) {
 	assert.Equal(test, "Entity does not exist", err.Error())
 }
 
+func TestWritesWithoutDataDoNotCreateCollection(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	authors := collection.NewFilesystemCollection(root, "authors")
+
+	author := Author{}
+	author.SetID(uuid.Must(uuid.NewV4()))
+	err := authors.Delete(&author)
+	assert.Error(test, err)
+
+	err = authors.Patch(author.GetID(), collection.MergePatch(`{"Name":"Selma"}`), nil)
+	assert.Error(test, err)
+
+	err = authors.SetSchema(nil)
+	assert.NoError(test, err)
+
+	err = authors.SetHistoryRetention(0)
+	assert.NoError(test, err)
+
+	_, err = authors.RemoveExpired()
+	assert.NoError(test, err)
+
+	_, err = os.Stat(filepath.Join(root, "authors"))
+	assert.True(test, os.IsNotExist(err))
+
+	err = authors.Persist(&author)
+	assert.NoError(test, err)
+
+	_, err = os.Stat(filepath.Join(root, "authors"))
+	assert.NoError(test, err)
+}
+
 func TestShouldFailLoadingMissingEntry(test *testing.T) {
-	authors := collection.FilesystemCollection{Name: "authors"}
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	authors := collection.NewFilesystemCollection(root, "authors")
 	author := Author{}
 	err := authors.Load(uuid.Must(uuid.NewV4()), &author)
 	assert.Error(test, err)
@@ -69,7 +128,10 @@ func TestShouldFailLoadingMissingEntry(test *testing.T) {
 }
 
 func TestLoadAll(test *testing.T) {
-	books := collection.FilesystemCollection{Name: "books"}
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
 
 	nilsHolgersson := Book{
 		Title: "Nils Holgerssons underbara resa genom Sverige",
@@ -106,7 +168,10 @@ func TestLoadAll(test *testing.T) {
 }
 
 func TestQuery(test *testing.T) {
-	books := collection.FilesystemCollection{Name: "books"}
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
 
 	nilsHolgersson := Book{
 		Title:  "Nils Holgerssons underbara resa genom Sverige",
@@ -196,7 +261,10 @@ func TestUntypedEntry(test *testing.T) {
 }
 
 func TestFilesystemCollectionsInfo(test *testing.T) {
-	sections := collection.FilesystemCollection{Name: "sections"}
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	sections := collection.NewFilesystemCollection(root, "sections")
 
 	type Section struct {
 		collection.BaseEntry
@@ -212,7 +280,2497 @@ func TestFilesystemCollectionsInfo(test *testing.T) {
 	err := sections.Persist(&section)
 	assert.NoError(test, err)
 
-	info, err := collection.FilesystemCollectionsInfo()
+	info, err := collection.FilesystemCollectionsInfo(root)
+	assert.NoError(test, err)
+	assert.Equal(test, collection.CollectionsInfo{collection.CollectionInfo{Name: "sections", Path: "/sections/", Entries: 1}}, info)
+}
+
+func TestFilesystemCollectionImplementsCollection(test *testing.T) {
+	var books collection.Collection = collection.FilesystemCollection{Name: "books"}
+	assert.Equal(test, "books", books.GetName())
+}
+
+func TestPersistLeavesNoTemporaryFiles(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	book := Book{Title: "Kejsarn av Portugallien"}
+	err := books.Persist(&book)
+	assert.NoError(test, err)
+
+	book.Rating = 4
+	err = books.Persist(&book)
+	assert.NoError(test, err)
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "books"))
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(files))
+	assert.Equal(test, book.GetID().String()+".json", files[0].Name())
+
+	bookFound := Book{}
+	err = books.Load(book.GetID(), &bookFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 4, bookFound.Rating)
+}
+
+func TestLoadAllIgnoresInterruptedWrites(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	book := Book{Title: "Jerusalem"}
+	err := books.Persist(&book)
+	assert.NoError(test, err)
+
+	interrupted := filepath.Join(root, "books", ".tmp-"+uuid.Must(uuid.NewV4()).String()+".json-123")
+	err = ioutil.WriteFile(interrupted, []byte(`{"Title":"Jeru`), 0600)
+	assert.NoError(test, err)
+
+	booksFound := []Book{}
+	err = books.LoadAll(&booksFound, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+	assert.Equal(test, book.Title, booksFound[0].Title)
+}
+
+func TestIndexedQuery(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	nilsHolgersson := Book{Title: "Nils Holgerssons underbara resa genom Sverige", Rating: 2}
+	gostaBerlingsSaga := Book{Title: "Gösta Berlings saga", Rating: 2}
+	err := books.Persist(&nilsHolgersson)
+	assert.NoError(test, err)
+
+	err = books.CreateIndex("Rating")
+	assert.NoError(test, err)
+	err = books.CreateIndex("Title")
+	assert.NoError(test, err)
+
+	err = books.Persist(&gostaBerlingsSaga)
+	assert.NoError(test, err)
+
+	indexes, err := books.Indexes()
+	assert.NoError(test, err)
+	assert.Equal(test, []string{"Rating", "Title"}, indexes)
+
+	// An unparsable entry is only read by a full scan, so this verifies that
+	// the indexed queries below never look at entries outside of the index.
+	unparsable := filepath.Join(root, "books", uuid.Must(uuid.NewV4()).String()+".json")
+	err = ioutil.WriteFile(unparsable, []byte(`{"Title":`), 0600)
+	assert.NoError(test, err)
+
+	booksFound := []Book{}
+	err = books.Query(Book{Rating: 2}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(booksFound))
+
+	booksFound = []Book{}
+	err = books.Query(map[string]interface{}{"Title": gostaBerlingsSaga.Title, "Rating": 2}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+	assert.Equal(test, gostaBerlingsSaga.GetID(), booksFound[0].GetID())
+
+	gostaBerlingsSaga.Rating = 5
+	err = books.Persist(&gostaBerlingsSaga)
+	assert.NoError(test, err)
+
+	booksFound = []Book{}
+	err = books.Query(Book{Rating: 2}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+	assert.Equal(test, nilsHolgersson.GetID(), booksFound[0].GetID())
+
+	err = books.Delete(&nilsHolgersson)
+	assert.NoError(test, err)
+
+	booksFound = []Book{}
+	err = books.Query(Book{Rating: 2}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 0, len(booksFound))
+
+	booksFound = []Book{}
+	err = books.Query(Book{BaseEntry: gostaBerlingsSaga.BaseEntry}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+
+	err = os.Remove(unparsable)
+	assert.NoError(test, err)
+
+	err = books.RebuildIndexes()
+	assert.NoError(test, err)
+
+	booksFound = []Book{}
+	err = books.Query(Book{Rating: 5}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+
+	err = books.DropIndex("Rating")
+	assert.NoError(test, err)
+	err = books.DropIndex("Rating")
+	assert.Equal(test, collection.IndexDoesNotExistError{Field: "Rating", CollectionName: "books"}, err)
+	err = books.CreateIndex("../Rating")
+	assert.Equal(test, collection.InvalidIndexFieldError{Field: "../Rating"}, err)
+}
+
+func TestOverwritingExpiredEntryUpdatesIndexes(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+	err := books.CreateIndex("Rating")
+	assert.NoError(test, err)
+
+	// Returns an entry that replaces an expired one with another rating.
+	replacingExpired := func() (entry collection.UntypedEntry) {
+		expired := collection.UntypedEntry{"Rating": 2}
+		expired.SetExpiresAt(time.Now().Add(-time.Hour))
+		err := books.Persist(&expired)
+		assert.NoError(test, err)
+
+		entry = collection.UntypedEntry{"Rating": 3}
+		entry.SetID(expired.GetID())
+		return
+	}
+
+	markers := func(id uuid.UUID) (found int) {
+		filepath.Walk(filepath.Join(root, "books", "_indexes"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Name() == id.String() {
+				found++
+			}
+			return nil
+		})
+		return
+	}
+
+	upserted := replacingExpired()
+	created, err := books.Upsert(&upserted)
+	assert.NoError(test, err)
+	assert.True(test, created)
+	assert.Equal(test, 1, markers(upserted.GetID()))
+
+	batched := replacingExpired()
+	batch := collection.Batch{}
+	batch.Put(&batched)
+	err = books.WriteBatch(batch)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, markers(batched.GetID()))
+
+	booksFound := []collection.UntypedEntry{}
+	err = books.Query(map[string]interface{}{"Rating": 3}, 0, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(booksFound))
+}
+
+func TestIndexedQueryMatchesFullScan(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	indexed := collection.NewFilesystemCollection(root, "indexed")
+	scanned := collection.NewFilesystemCollection(root, "scanned")
+	logged, err := collection.OpenLogCollection(root, "logged")
+	assert.NoError(test, err)
+	defer logged.Close()
+
+	for _, indexer := range []collection.Indexer{indexed, logged} {
+		err = indexer.CreateIndex("Code")
+		assert.NoError(test, err)
+		err = indexer.CreateIndex("At")
+		assert.NoError(test, err)
+	}
+
+	for _, data := range []string{
+		`{"Code":"42","At":"2020-01-01T12:00:00+02:00"}`,
+		`{"Code":42,"At":"2020-01-01T10:00:00Z"}`,
+		`{"Code":42.5,"At":"2020-01-01T10:00:00.5Z"}`,
+		`{"Code":"forty-two","At":"yesterday"}`,
+		`{"Code":true}`,
+	} {
+		for _, books := range []collection.Collection{indexed, scanned, logged} {
+			entry := collection.UntypedEntry{}
+			err = json.Unmarshal([]byte(data), &entry)
+			assert.NoError(test, err)
+			err = books.Persist(&entry)
+			assert.NoError(test, err)
+		}
+	}
+
+	for _, filter := range []map[string]interface{}{
+		{"Code": 42},
+		{"Code": "42"},
+		{"Code": "42.0"},
+		{"Code": 42.5},
+		{"Code": "forty-two"},
+		{"Code": true},
+		{"At": "2020-01-01T10:00:00Z"},
+		{"At": "2020-01-01T11:00:00+01:00"},
+		{"At": "yesterday"},
+	} {
+		indexedFound := []collection.UntypedEntry{}
+		err = indexed.Query(filter, 0, &indexedFound)
+		assert.NoError(test, err)
+
+		scannedFound := []collection.UntypedEntry{}
+		err = scanned.Query(filter, 0, &scannedFound)
+		assert.NoError(test, err)
+
+		loggedFound := []collection.UntypedEntry{}
+		err = logged.Query(filter, 0, &loggedFound)
+		assert.NoError(test, err)
+
+		assert.NotEqual(test, 0, len(scannedFound), "%v", filter)
+		assert.Equal(test, len(scannedFound), len(indexedFound), "%v", filter)
+		assert.Equal(test, len(scannedFound), len(loggedFound), "%v", filter)
+	}
+}
+
+func TestQueryWithConditions(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	authors := collection.NewFilesystemCollection(root, "authors")
+
+	selmaBirthDate, _ := time.Parse(time.RFC3339, "1858-10-20T00:00:00Z")
+	astridBirthDate, _ := time.Parse(time.RFC3339, "1907-11-14T00:00:00Z")
+	selma := Author{Name: "Selma Lagerlöf", BirthDate: selmaBirthDate}
+	astrid := Author{Name: "Astrid Lindgren", BirthDate: astridBirthDate}
+
+	err := authors.Persist(&selma)
+	assert.NoError(test, err)
+	err = authors.Persist(&astrid)
+	assert.NoError(test, err)
+
+	before1900, _ := time.Parse(time.RFC3339, "1900-01-01T00:00:00Z")
+
+	testCases := []struct {
+		filter   map[string]interface{}
+		expected []string
+	}{
+		{map[string]interface{}{"BirthDate": collection.Lt(before1900)}, []string{selma.Name}},
+		{map[string]interface{}{"BirthDate": collection.Gte(before1900)}, []string{astrid.Name}},
+		{map[string]interface{}{"BirthDate": collection.Conditions{collection.Gt(selmaBirthDate), collection.Lte(astridBirthDate)}}, []string{astrid.Name}},
+		{map[string]interface{}{"Name": collection.Ne(selma.Name)}, []string{astrid.Name}},
+		{map[string]interface{}{"Name": collection.In(selma.Name, "Tove Jansson")}, []string{selma.Name}},
+		{map[string]interface{}{"Name": collection.Nin(selma.Name, astrid.Name)}, []string{}},
+		{map[string]interface{}{"Name": collection.HasPrefix("Astrid")}, []string{astrid.Name}},
+		{map[string]interface{}{"Name": collection.Contains("Lager")}, []string{selma.Name}},
+		{map[string]interface{}{"Name": collection.Matches("^[AS].*f$")}, []string{selma.Name}},
+		{map[string]interface{}{"Name": collection.Exists(true)}, []string{selma.Name, astrid.Name}},
+		{map[string]interface{}{"Pseudonym": collection.Exists(false)}, []string{selma.Name, astrid.Name}},
+	}
+
+	for _, testCase := range testCases {
+		authorsFound := []collection.UntypedEntry{}
+		err = authors.Query(testCase.filter, 0, &authorsFound)
+		assert.NoError(test, err)
+
+		names := []string{}
+		for _, author := range authorsFound {
+			names = append(names, author["Name"].(string))
+		}
+		assert.ElementsMatch(test, testCase.expected, names, testCase.filter)
+	}
+
+	type AuthorFilter struct {
+		BirthDate collection.Condition
+	}
+
+	authorsFound := []Author{}
+	err = authors.Query(AuthorFilter{BirthDate: collection.Lt(before1900)}, 0, &authorsFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(authorsFound))
+	assert.Equal(test, selma.Name, authorsFound[0].Name)
+
+	authorsFound = []Author{}
+	err = authors.Query(map[string]interface{}{"Name": collection.Matches("(")}, 0, &authorsFound)
+	assert.IsType(test, collection.InvalidPatternError{}, err)
+	assert.Equal(test, "(", err.(collection.InvalidPatternError).Pattern)
+}
+
+func TestSortedQueryAndLoadAll(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	for _, book := range []Book{
+		Book{Title: "Gösta Berlings saga", Rating: 4},
+		Book{Title: "Jerusalem", Rating: 3},
+		Book{Title: "Nils Holgerssons underbara resa genom Sverige", Rating: 5},
+		Book{Title: "En herrgårdssägen", Rating: 3},
+	} {
+		err := books.Persist(&book)
+		assert.NoError(test, err)
+	}
+
+	booksFound := []Book{}
+	_, err := books.LoadAllWithOptions(&booksFound, collection.QueryOptions{
+		Sort: collection.ParseSort("-Rating,Title"),
+	})
+	assert.NoError(test, err)
+
+	titles := []string{}
+	for _, book := range booksFound {
+		titles = append(titles, book.Title)
+	}
+	assert.Equal(test, []string{
+		"Nils Holgerssons underbara resa genom Sverige",
+		"Gösta Berlings saga",
+		"En herrgårdssägen",
+		"Jerusalem",
+	}, titles)
+
+	booksFound = []Book{}
+	_, err = books.QueryWithOptions(map[string]interface{}{"Rating": collection.Lt(5)}, collection.QueryOptions{
+		Limit: 2,
+		Sort:  []collection.SortField{collection.SortField{Field: "Title", Descending: true}},
+	}, &booksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(booksFound))
+	assert.Equal(test, "Jerusalem", booksFound[0].Title)
+	assert.Equal(test, "Gösta Berlings saga", booksFound[1].Title)
+}
+
+func TestParseSort(test *testing.T) {
+	sortFields := collection.ParseSort("-BirthDate, Name,,+Rating")
+	assert.Equal(test, []collection.SortField{
+		collection.SortField{Field: "BirthDate", Descending: true},
+		collection.SortField{Field: "Name"},
+		collection.SortField{Field: "Rating"},
+	}, sortFields)
+	assert.Equal(test, "-BirthDate,Name,Rating", collection.FormatSort(sortFields))
+}
+
+func TestPagination(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	for rating := 1; rating <= 7; rating++ {
+		book := Book{Title: "Volume " + strconv.Itoa(rating), Rating: rating % 3}
+		err := books.Persist(&book)
+		assert.NoError(test, err)
+	}
+
+	for _, sortFields := range [][]collection.SortField{nil, collection.ParseSort("-Rating")} {
+		options := collection.QueryOptions{Limit: 3, Sort: sortFields}
+		seen := map[uuid.UUID]bool{}
+		pages := 0
+
+		for {
+			page := []Book{}
+			result, err := books.LoadAllWithOptions(&page, options)
+			assert.NoError(test, err)
+
+			for _, book := range page {
+				assert.False(test, seen[book.GetID()], "entry returned twice")
+				seen[book.GetID()] = true
+			}
+
+			pages++
+			if result.NextCursor == "" {
+				assert.Equal(test, 1, len(page))
+				break
+			}
+
+			assert.Equal(test, 3, len(page))
+			options.Cursor = result.NextCursor
+		}
+
+		assert.Equal(test, 3, pages)
+		assert.Equal(test, 7, len(seen))
+	}
+
+	all := []Book{}
+	_, err := books.LoadAllWithOptions(&all, collection.QueryOptions{Sort: collection.ParseSort("Title")})
+	assert.NoError(test, err)
+
+	page := []Book{}
+	result, err := books.LoadAllWithOptions(&page, collection.QueryOptions{Offset: 5, Limit: 1, Sort: collection.ParseSort("Title")})
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(page))
+	assert.Equal(test, all[5].Title, page[0].Title)
+
+	page = []Book{}
+	_, err = books.LoadAllWithOptions(&page, collection.QueryOptions{Cursor: result.NextCursor, Sort: collection.ParseSort("Title")})
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(page))
+	assert.Equal(test, all[6].Title, page[0].Title)
+
+	page = []Book{}
+	_, err = books.QueryWithOptions(Book{Rating: 1}, collection.QueryOptions{Cursor: result.NextCursor}, &page)
+	assert.Equal(test, collection.InvalidCursorError{}, err)
+}
+
+type Note struct {
+	Identifier uuid.UUID `json:"id"`
+	Text       string
+}
+
+func (note *Note) GetID() uuid.UUID {
+	return note.Identifier
+}
+
+func (note *Note) SetID(id uuid.UUID) {
+	note.Identifier = id
+}
+
+func TestPaginationWithRenamedID(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	for _, notes := range []collection.Collection{
+		collection.NewFilesystemCollection(root, "notes"),
+		collection.NewMemoryCollection("notes"),
+		backend.Collection("notes"),
+	} {
+		for number := 1; number <= 5; number++ {
+			err = notes.Persist(&Note{Text: "Note " + strconv.Itoa(number%2)})
+			assert.NoError(test, err)
+		}
+
+		for _, sortFields := range [][]collection.SortField{nil, collection.ParseSort("-ID"), collection.ParseSort("Text")} {
+			options := collection.QueryOptions{Limit: 2, Sort: sortFields}
+			seen := map[uuid.UUID]bool{}
+
+			for pages := 0; pages < 5; pages++ {
+				page := []Note{}
+				result, err := notes.LoadAllWithOptions(&page, options)
+				assert.NoError(test, err)
+
+				for _, note := range page {
+					assert.False(test, seen[note.GetID()], "entry returned twice")
+					seen[note.GetID()] = true
+				}
+
+				if result.NextCursor == "" {
+					break
+				}
+				options.Cursor = result.NextCursor
+			}
+
+			assert.Equal(test, 5, len(seen), "%v", sortFields)
+		}
+
+		forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sort":"","values":[{"value":null,"exists":false}]}`))
+		_, err = notes.LoadAllWithOptions(&[]Note{}, collection.QueryOptions{Limit: 2, Cursor: forged})
+		assert.Equal(test, collection.InvalidCursorError{}, err)
+	}
+}
+
+func TestNegativeLimitAndOffset(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	for _, books := range []collection.Collection{collection.NewFilesystemCollection(root, "books"), collection.NewMemoryCollection("books")} {
+		for rating := 1; rating <= 3; rating++ {
+			err := books.Persist(&Book{Title: "Volume " + strconv.Itoa(rating), Rating: rating})
+			assert.NoError(test, err)
+		}
+
+		page := []Book{}
+		_, err := books.LoadAllWithOptions(&page, collection.QueryOptions{Limit: -1})
+		assert.IsType(test, collection.InvalidQueryOptionsError{}, err)
+		assert.Equal(test, 0, len(page))
+
+		_, err = books.QueryWithOptions(Book{Rating: 2}, collection.QueryOptions{Limit: 1, Offset: -1}, &page)
+		assert.IsType(test, collection.InvalidQueryOptionsError{}, err)
+		assert.Equal(test, 0, len(page))
+
+		err = books.LoadAll(&page, -1)
+		assert.IsType(test, collection.InvalidQueryOptionsError{}, err)
+	}
+}
+
+func TestProjection(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	book := Book{Title: "Jerusalem", ISBN: "9789174296174", Rating: 4}
+	err := books.Persist(&book)
+	assert.NoError(test, err)
+
+	booksFound := []collection.UntypedEntry{}
+	_, err = books.LoadAllWithOptions(&booksFound, collection.QueryOptions{
+		Fields: collection.ParseFields("Title, Rating"),
+		Sort:   collection.ParseSort("ISBN"),
+	})
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+	assert.Equal(test, collection.UntypedEntry{
+		"ID":        book.GetID().String(),
+		"Title":     "Jerusalem",
+		"Rating":    float64(4),
+		"_revision": float64(1),
+	}, booksFound[0])
+
+	typedBooksFound := []Book{}
+	_, err = books.QueryWithOptions(Book{Title: "Jerusalem"}, collection.QueryOptions{Fields: []string{"Title"}}, &typedBooksFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(typedBooksFound))
+	assert.Equal(test, book.ISBN, typedBooksFound[0].ISBN)
+}
+
+func TestPatch(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	book := Book{Title: "Jerusalem", ISBN: "9789174296174", Rating: 3}
+	err := books.Persist(&book)
+	assert.NoError(test, err)
+
+	patchedBook := Book{}
+	err = books.Patch(book.GetID(), collection.MergePatch(`{"Rating":4,"ISBN":null,"ID":"ignored"}`), &patchedBook)
+	assert.NoError(test, err)
+	assert.Equal(test, book.GetID(), patchedBook.GetID())
+	assert.Equal(test, "Jerusalem", patchedBook.Title)
+	assert.Equal(test, "", patchedBook.ISBN)
+	assert.Equal(test, 4, patchedBook.Rating)
+
+	untypedBook := collection.UntypedEntry{}
+	err = books.Patch(book.GetID(), collection.JSONPatch(`[
+		{"op":"test","path":"/Rating","value":4},
+		{"op":"add","path":"/Tags","value":["novel"]},
+		{"op":"add","path":"/Tags/0","value":"classic"},
+		{"op":"add","path":"/Tags/-","value":"swedish"},
+		{"op":"copy","from":"/Title","path":"/OriginalTitle"},
+		{"op":"move","from":"/Rating","path":"/Score"},
+		{"op":"replace","path":"/Title","value":"Jerusalem I"},
+		{"op":"remove","path":"/Tags/1"}
+	]`), &untypedBook)
+	assert.NoError(test, err)
+	assert.Equal(test, collection.UntypedEntry{
+		"ID":            book.GetID().String(),
+		"Title":         "Jerusalem I",
+		"OriginalTitle": "Jerusalem",
+		"Author":        uuid.Nil.String(),
+		"Score":         float64(4),
+		"Tags":          []interface{}{"classic", "swedish"},
+		"_revision":     float64(3),
+	}, untypedBook)
+
+	loadedBook := collection.UntypedEntry{}
+	err = books.Load(book.GetID(), &loadedBook)
+	assert.NoError(test, err)
+	assert.Equal(test, untypedBook, loadedBook)
+
+	err = books.Patch(book.GetID(), collection.JSONPatch(`[{"op":"test","path":"/Title","value":"Jerusalem"}]`), nil)
+	assert.Equal(test, collection.PatchTestFailedError{Path: "/Title"}, err)
+
+	err = books.Patch(book.GetID(), collection.JSONPatch(`[{"op":"remove","path":"/Missing"}]`), nil)
+	assert.IsType(test, collection.InvalidPatchError{}, err)
+
+	err = books.Patch(book.GetID(), collection.MergePatch(`[]`), nil)
+	assert.IsType(test, collection.InvalidPatchError{}, err)
+
+	err = books.Patch(uuid.Must(uuid.NewV4()), collection.MergePatch(`{}`), nil)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	err = books.Load(book.GetID(), &loadedBook)
+	assert.NoError(test, err)
+	assert.Equal(test, "Jerusalem I", loadedBook["Title"])
+}
+
+func TestRevisionConflicts(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+	}
+
+	chapters := collection.NewFilesystemCollection(root, "chapters")
+
+	chapter := Chapter{Title: "Ingmarssönerna"}
+	err := chapters.Persist(&chapter)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), chapter.GetRevision())
+
+	firstCopy := Chapter{}
+	err = chapters.Load(chapter.GetID(), &firstCopy)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), firstCopy.GetRevision())
+
+	secondCopy := firstCopy
+
+	firstCopy.Title = "Ingmarssönerna I"
+	err = chapters.Persist(&firstCopy)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), firstCopy.GetRevision())
+
+	secondCopy.Title = "Ingmarssönerna II"
+	err = chapters.Persist(&secondCopy)
+	assert.Equal(test, collection.RevisionConflictError{ID: chapter.GetID(), ExpectedRevision: 1, ActualRevision: 2}, err)
+
+	err = chapters.Patch(chapter.GetID(), collection.MergePatch(`{"Title":"Ingmarssönerna III"}`), &secondCopy)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	err = chapters.Delete(&secondCopy)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	err = chapters.Load(chapter.GetID(), &secondCopy)
+	assert.NoError(test, err)
+	assert.Equal(test, "Ingmarssönerna I", secondCopy.Title)
+
+	err = chapters.Delete(&secondCopy)
+	assert.NoError(test, err)
+
+	revision, err := collection.ParseETag(collection.FormatETag(42))
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(42), revision)
+
+	revision, err = collection.ParseETag(`W/"7"`)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(7), revision)
+}
+
+func TestInsertReplaceUpsert(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+	}
+
+	chapters := collection.NewFilesystemCollection(root, "chapters")
+
+	chapter := Chapter{Title: "Gösta Berling"}
+	err := chapters.Replace(&chapter)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	err = chapters.Insert(&chapter)
+	assert.NoError(test, err)
+	assert.NotEqual(test, uuid.Nil, chapter.GetID())
+	assert.Equal(test, uint64(1), chapter.GetRevision())
+
+	duplicate := Chapter{Title: "Gösta Berlings saga"}
+	duplicate.SetID(chapter.GetID())
+	err = chapters.Insert(&duplicate)
+	assert.Equal(test, collection.EntryAlreadyExistsError{}, err)
+
+	chapter.Title = "Gösta Berlings saga"
+	err = chapters.Replace(&chapter)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), chapter.GetRevision())
+
+	missing := Chapter{Title: "Nils Holgersson"}
+	missing.SetID(uuid.Must(uuid.NewV4()))
+	err = chapters.Replace(&missing)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	created, err := chapters.Upsert(&missing)
+	assert.NoError(test, err)
+	assert.True(test, created)
+
+	missing.Title = "Nils Holgerssons underbara resa"
+	created, err = chapters.Upsert(&missing)
+	assert.NoError(test, err)
+	assert.False(test, created)
+	assert.Equal(test, uint64(2), missing.GetRevision())
+}
+
+type Edition struct {
+	collection.BaseEntry
+	Title      string
+	Published  bool
+	Price      float64
+	Copies     int64
+	Printing   uint
+	Released   time.Time
+	Translator *string
+	Tags       []string
+	Metadata   map[string]string
+}
+
+func persistEditions(test *testing.T, root string) (editions *collection.FilesystemCollection) {
+	editions = collection.NewFilesystemCollection(root, "editions")
+	storeEditions(test, editions)
+	return
+}
+
+func storeEditions(test *testing.T, editions collection.Collection) {
+	translator := "Velma Swanston Howard"
+	entries := []Edition{
+		{
+			Title:      "The Wonderful Adventures of Nils",
+			Published:  true,
+			Price:      12.5,
+			Copies:     5000000000,
+			Printing:   3,
+			Released:   time.Date(1907, 1, 1, 0, 0, 0, 0, time.UTC),
+			Translator: &translator,
+			Tags:       []string{"children", "geography"},
+			Metadata:   map[string]string{"language": "en", "publisher": "Doubleday"},
+		},
+		{
+			Title:     "Nils Holgerssons underbara resa genom Sverige",
+			Published: true,
+			Price:     9.75,
+			Copies:    2,
+			Printing:  1,
+			Released:  time.Date(1906, 1, 1, 0, 0, 0, 0, time.UTC),
+			Tags:      []string{"children"},
+			Metadata:  map[string]string{"language": "sv"},
+		},
+		{
+			Title:    "Nils Holgersson, draft",
+			Printing: 1,
+		},
+	}
+
+	for i := range entries {
+		err := editions.Persist(&entries[i])
+		assert.NoError(test, err)
+	}
+}
+
+func queryEditionTitles(test *testing.T, editions collection.Collection, filter interface{}) (titles []string) {
+	found := []Edition{}
+	_, err := editions.QueryWithOptions(filter, collection.QueryOptions{Sort: []collection.SortField{{Field: "Title"}}}, &found)
+	assert.NoError(test, err)
+
+	titles = []string{}
+	for _, edition := range found {
+		titles = append(titles, edition.Title)
+	}
+
+	return
+}
+
+func TestFilterBool(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+	unpublished := false
+
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige", "The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, Edition{Published: true}))
+	assert.Equal(test, []string{"Nils Holgersson, draft"}, queryEditionTitles(test, editions, map[string]interface{}{"Published": &unpublished}))
+	assert.Equal(test, []string{"Nils Holgersson, draft"}, queryEditionTitles(test, editions, map[string]interface{}{"Published": collection.Eq(false)}))
+}
+
+func TestFilterNumbers(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, Edition{Price: 9.75}))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, Edition{Copies: 5000000000}))
+	assert.Equal(test, []string{"Nils Holgersson, draft", "Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, Edition{Printing: 1}))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Printing": uint8(3)}))
+	assert.Equal(test, []string{}, queryEditionTitles(test, editions, map[string]interface{}{"Price": float32(1.5)}))
+}
+
+func TestFilterTime(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	assert.NoError(test, err)
+
+	released := time.Date(1906, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, Edition{Released: released}))
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, Edition{Released: released.In(stockholm)}))
+	assert.Equal(test, []string{}, queryEditionTitles(test, editions, Edition{Released: released.Add(time.Second)}))
+}
+
+func TestFilterPointers(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+	translator := "Velma Swanston Howard"
+	otherTranslator := "Jessie Bröchner"
+	zero := int64(0)
+
+	assert.Equal(test, 3, len(queryEditionTitles(test, editions, Edition{Translator: nil})))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, Edition{Translator: &translator}))
+	assert.Equal(test, []string{}, queryEditionTitles(test, editions, Edition{Translator: &otherTranslator}))
+	assert.Equal(test, []string{"Nils Holgersson, draft", "Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, map[string]interface{}{"Translator": nil}))
+	assert.Equal(test, []string{"Nils Holgersson, draft"}, queryEditionTitles(test, editions, map[string]interface{}{"Copies": &zero}))
+}
+
+func TestFilterSlices(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige", "The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Tags": "children"}))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, Edition{Tags: []string{"geography", "children"}}))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Tags": collection.Eq("geography")}))
+	assert.Equal(test, []string{"Nils Holgersson, draft"}, queryEditionTitles(test, editions, map[string]interface{}{"Tags": collection.Ne("children")}))
+	assert.Equal(test, []string{}, queryEditionTitles(test, editions, Edition{Tags: []string{"children", "history"}}))
+
+	err := editions.CreateIndex("Tags")
+	assert.NoError(test, err)
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Tags": "geography"}))
+}
+
+func TestFilterMaps(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, Edition{Metadata: map[string]string{"language": "en"}}))
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, map[string]interface{}{"Metadata": map[string]interface{}{"language": "sv"}}))
+	assert.Equal(test, []string{}, queryEditionTitles(test, editions, Edition{Metadata: map[string]string{"language": "sv", "publisher": "Bonniers"}}))
+
+	untypedFound := []collection.UntypedEntry{}
+	err := editions.Query(map[string]interface{}{"Published": true, "Tags": "geography", "Printing": 3}, 0, &untypedFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(untypedFound))
+}
+
+func TestFilterUntypedValues(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	editions := persistEditions(test, root)
+
+	assert.Equal(test, []string{"Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, map[string]interface{}{"Price": collection.UntypedValue("9.75")}))
+	assert.Equal(test, []string{"Nils Holgersson, draft"}, queryEditionTitles(test, editions, map[string]interface{}{"Published": collection.UntypedValue("false")}))
+	assert.Equal(test, []string{"Nils Holgersson, draft", "Nils Holgerssons underbara resa genom Sverige"}, queryEditionTitles(test, editions, map[string]interface{}{"Translator": collection.UntypedValue("null")}))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Translator": collection.Ne(collection.UntypedValue("null"))}))
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Price": collection.Gt(collection.UntypedValue("10"))}))
+	assert.Equal(test, []string{"Nils Holgersson, draft"}, queryEditionTitles(test, editions, map[string]interface{}{"Title": collection.UntypedValue("Nils Holgersson, draft")}))
+
+	err := editions.CreateIndex("Printing")
+	assert.NoError(test, err)
+	assert.Equal(test, []string{"The Wonderful Adventures of Nils"}, queryEditionTitles(test, editions, map[string]interface{}{"Printing": collection.UntypedValue("3")}))
+}
+
+func TestDotPathFilters(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Address struct {
+		Street string
+		City   string
+	}
+
+	type Publisher struct {
+		collection.BaseEntry
+		Name    string
+		Address Address
+		Tags    []string
+	}
+
+	publishers := collection.NewFilesystemCollection(root, "publishers")
+
+	entries := []Publisher{
+		{Name: "Bonniers", Address: Address{Street: "Sveavägen 56", City: "Stockholm"}, Tags: []string{"fiction", "poetry"}},
+		{Name: "Gleerups", Address: Address{Street: "Östra Vallgatan 14", City: "Lund"}, Tags: []string{"textbooks"}},
+	}
+
+	for i := range entries {
+		err := publishers.Persist(&entries[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Publisher{}
+	err := publishers.Query(map[string]interface{}{"Address.City": "Lund"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Gleerups", found[0].Name)
+
+	untypedFound := []collection.UntypedEntry{}
+	err = publishers.Query(map[string]interface{}{"Tags.0": "fiction", "Address.Street": collection.HasPrefix("Svea")}, 0, &untypedFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(untypedFound))
+	assert.Equal(test, "Bonniers", untypedFound[0]["Name"])
+
+	untypedFound = []collection.UntypedEntry{}
+	err = publishers.Query(map[string]interface{}{"Tags.1": collection.Exists(false)}, 0, &untypedFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(untypedFound))
+	assert.Equal(test, "Gleerups", untypedFound[0]["Name"])
+
+	err = publishers.CreateIndex("Address.City")
+	assert.NoError(test, err)
+
+	found = []Publisher{}
+	err = publishers.Query(map[string]interface{}{"Address.City": "Stockholm"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Bonniers", found[0].Name)
+
+	found = []Publisher{}
+	_, err = publishers.LoadAllWithOptions(&found, collection.QueryOptions{Sort: collection.ParseSort("Address.City")})
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+	assert.Equal(test, "Gleerups", found[0].Name)
+
+	assert.Equal(test, map[string]interface{}{"Address.City": "Lund", "Name": "Gleerups"}, collection.FilterFields(Publisher{Name: "Gleerups", Address: Address{City: "Lund"}}))
+}
+
+func TestJSONTagFilters(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Poem struct {
+		collection.BaseEntry
+		Title  string `json:"title"`
+		Year   int    `json:"year,omitempty"`
+		Author string `json:"author_name"`
+		Draft  string `json:"-"`
+	}
+
+	poems := collection.NewFilesystemCollection(root, "poems")
+
+	entries := []Poem{
+		{Title: "Ja visst gör det ont", Year: 1935, Author: "Karin Boye"},
+		{Title: "I rörelse", Year: 1927, Author: "Karin Boye"},
+		{Title: "Landet som icke är", Year: 1925, Author: "Edith Södergran", Draft: "unpublished"},
+	}
+
+	for i := range entries {
+		err := poems.Persist(&entries[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Poem{}
+	err := poems.Query(Poem{Title: "I rörelse"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, 1927, found[0].Year)
+
+	found = []Poem{}
+	err = poems.Query(map[string]interface{}{"author_name": "Karin Boye"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+
+	found = []Poem{}
+	err = poems.Query(map[string]interface{}{"Author": "Karin Boye"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 0, len(found))
+
+	untypedFound := []collection.UntypedEntry{}
+	err = poems.Query(Poem{Author: "Edith Södergran", Draft: "published"}, 0, &untypedFound)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(untypedFound))
+	assert.Equal(test, "Landet som icke är", untypedFound[0]["title"])
+
+	err = poems.CreateIndex("title")
+	assert.NoError(test, err)
+
+	found = []Poem{}
+	err = poems.Query(Poem{Title: "Ja visst gör det ont"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+
+	found = []Poem{}
+	_, err = poems.LoadAllWithOptions(&found, collection.QueryOptions{Sort: collection.ParseSort("-year")})
+	assert.NoError(test, err)
+	assert.Equal(test, 3, len(found))
+	assert.Equal(test, 1935, found[0].Year)
+
+	assert.Equal(test, map[string]interface{}{"author_name": "Karin Boye", "year": 1935}, collection.FilterFields(Poem{Year: 1935, Author: "Karin Boye", Draft: "x"}))
+}
+
+func TestWhere(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Shelf struct {
+		collection.BaseEntry
+		Label string
+		Count int
+		Owner uuid.UUID
+	}
+
+	shelves := collection.NewFilesystemCollection(root, "shelves")
+	owner := uuid.Must(uuid.NewV4())
+
+	entries := []Shelf{
+		{Label: "", Count: 0},
+		{Label: "Poetry", Count: 0, Owner: owner},
+		{Label: "Novels", Count: 12, Owner: owner},
+	}
+
+	for i := range entries {
+		err := shelves.Persist(&entries[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Shelf{}
+	err := shelves.Query(Shelf{Count: 0}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 3, len(found))
+
+	found = []Shelf{}
+	err = shelves.Query(collection.Where("Count").Eq(0), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+
+	found = []Shelf{}
+	err = shelves.Query(collection.Where("Count").Eq(0).And("Label").Eq(""), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, entries[0].ID, found[0].ID)
+
+	found = []Shelf{}
+	err = shelves.Query(collection.Where("Owner").Eq(uuid.Nil), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, entries[0].ID, found[0].ID)
+
+	found = []Shelf{}
+	err = shelves.Query(collection.Where("Count").Gte(0).And("Count").Lt(10).And("Label").Ne(""), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Poetry", found[0].Label)
+
+	found = []Shelf{}
+	err = shelves.Query(collection.Where("Missing").IsNull().And("Label").Exists(true), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 3, len(found))
+
+	err = shelves.CreateIndex("Count")
+	assert.NoError(test, err)
+
+	base := collection.Where("Count").Eq(0)
+	withLabel := base.And("Label").Eq("Poetry")
+	assert.Equal(test, collection.Filter{"Count": collection.Conditions{collection.Eq(0)}}, base)
+
+	found = []Shelf{}
+	err = shelves.Query(withLabel, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Poetry", found[0].Label)
+}
+
+func TestWriteBatch(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+	}
+
+	chapters := collection.NewFilesystemCollection(root, "chapters")
+
+	first := Chapter{Title: "Kejsarn av Portugallien"}
+	second := Chapter{Title: "Jerusalem"}
+	batch := collection.Batch{}
+	batch.Put(&first).Put(&second)
+	err := chapters.WriteBatch(batch)
+	assert.NoError(test, err)
+	assert.NotEqual(test, uuid.Nil, first.GetID())
+	assert.Equal(test, uint64(1), first.GetRevision())
+	assert.Equal(test, uint64(1), second.GetRevision())
+
+	stale := second
+	second.Title = "Jerusalem I"
+	third := Chapter{Title: "Liljecronas hem"}
+	batch = collection.Batch{}
+	batch.Put(&second).Put(&third).Delete(&first)
+	err = chapters.WriteBatch(batch)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), second.GetRevision())
+
+	err = chapters.Load(first.GetID(), &Chapter{})
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	stale.Title = "Jerusalem II"
+	fourth := Chapter{Title: "Körkarlen"}
+	batch = collection.Batch{}
+	batch.Put(&fourth).Put(&stale)
+	err = chapters.WriteBatch(batch)
+	assert.Equal(test, collection.RevisionConflictError{ID: second.GetID(), ExpectedRevision: 1, ActualRevision: 2}, err)
+	assert.Equal(test, uuid.Nil, fourth.GetID())
+
+	batch = collection.Batch{}
+	batch.Put(&third).Delete(&first)
+	err = chapters.WriteBatch(batch)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	batch = collection.Batch{}
+	batch.Put(&third).Delete(&third)
+	err = chapters.WriteBatch(batch)
+	assert.IsType(test, collection.InvalidBatchError{}, err)
+
+	found := []Chapter{}
+	err = chapters.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+
+	loaded := Chapter{}
+	err = chapters.Load(second.GetID(), &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, "Jerusalem I", loaded.Title)
+	assert.Equal(test, uint64(1), third.GetRevision())
+
+	_, err = os.Stat(filepath.Join(root, "chapters", "_journal.json"))
+	assert.True(test, os.IsNotExist(err))
+}
+
+func TestRecoverInterruptedBatch(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Chapter struct {
+		collection.BaseEntry
+		Title string
+	}
+
+	chapters := collection.NewFilesystemCollection(root, "chapters")
+	err := chapters.CreateIndex("Title")
+	assert.NoError(test, err)
+
+	removed := Chapter{Title: "Mårbacka"}
+	err = chapters.Persist(&removed)
+	assert.NoError(test, err)
+
+	added := uuid.Must(uuid.NewV4())
+	journal := `{"operations":[` +
+		`{"id":"` + added.String() + `","document":{"ID":"` + added.String() + `","Title":"Drottningar i Kungahälla","_revision":1}},` +
+		`{"id":"` + removed.GetID().String() + `","previous":{"ID":"` + removed.GetID().String() + `","Title":"Mårbacka","_revision":1}}]}`
+	err = ioutil.WriteFile(filepath.Join(root, "chapters", "_journal.json"), []byte(journal), 0600)
+	assert.NoError(test, err)
+
+	err = collection.RecoverFilesystemCollections(root)
+	assert.NoError(test, err)
+
+	found := []Chapter{}
+	err = chapters.Query(Chapter{Title: "Drottningar i Kungahälla"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, added, found[0].GetID())
+
+	found = []Chapter{}
+	err = chapters.Query(Chapter{Title: "Mårbacka"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 0, len(found))
+
+	_, err = os.Stat(filepath.Join(root, "chapters", "_journal.json"))
+	assert.True(test, os.IsNotExist(err))
+}
+
+func TestLogCollection(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+		Pages int
+	}
+
+	chapters, err := collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+	assert.True(test, collection.IsLogCollection(root, "chapters"))
+
+	opened, err := collection.OpenCollection(root, "chapters")
+	assert.NoError(test, err)
+	assert.Equal(test, chapters, opened)
+
+	first := Chapter{Title: "Mårbacka", Pages: 12}
+	err = chapters.Insert(&first)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), first.GetRevision())
+
+	err = chapters.Insert(&first)
+	assert.Equal(test, collection.EntryAlreadyExistsError{}, err)
+
+	second := Chapter{Title: "Drottningar i Kungahälla", Pages: 30}
+	err = chapters.Persist(&second)
+	assert.NoError(test, err)
+
+	first.Pages = 14
+	err = chapters.Replace(&first)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), first.GetRevision())
+
+	stale := Chapter{Title: "Mårbacka"}
+	stale.SetID(first.GetID())
+	stale.SetRevision(1)
+	err = chapters.Persist(&stale)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	loaded := Chapter{}
+	err = chapters.Load(first.GetID(), &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, 14, loaded.Pages)
+
+	patched := Chapter{}
+	err = chapters.Patch(second.GetID(), collection.MergePatch(`{"Pages":31}`), &patched)
+	assert.NoError(test, err)
+	assert.Equal(test, 31, patched.Pages)
+	assert.Equal(test, uint64(2), patched.GetRevision())
+
+	found := []Chapter{}
+	result, err := chapters.QueryWithOptions(collection.Where("Pages").Gt(20), collection.QueryOptions{}, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Drottningar i Kungahälla", found[0].Title)
+	assert.Equal(test, "", result.NextCursor)
+
+	found = []Chapter{}
+	_, err = chapters.LoadAllWithOptions(&found, collection.QueryOptions{Sort: []collection.SortField{collection.SortField{Field: "Title"}}})
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+	assert.Equal(test, "Drottningar i Kungahälla", found[0].Title)
+	assert.Equal(test, "Mårbacka", found[1].Title)
+
+	batch := collection.Batch{}
+	third := Chapter{Title: "Gösta Berlings saga"}
+	batch.Put(&third).Delete(&patched)
+	err = chapters.WriteBatch(batch)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), third.GetRevision())
+
+	err = chapters.Delete(&first)
+	assert.NoError(test, err)
+
+	err = chapters.Load(first.GetID(), &loaded)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	err = chapters.Close()
+	assert.NoError(test, err)
+
+	chapters, err = collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+	defer chapters.Close()
+
+	found = []Chapter{}
+	err = chapters.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, third.GetID(), found[0].GetID())
+	assert.Equal(test, uint64(1), found[0].GetRevision())
+
+	info, err := collection.FilesystemCollectionsInfo(root)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(info))
+	assert.Equal(test, 1, info[0].Entries)
+}
+
+func TestLogCollectionIndexes(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	chapters, err := collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+
+	first := collection.UntypedEntry{"Title": "Mårbacka", "Part": 1}
+	err = chapters.Persist(&first)
+	assert.NoError(test, err)
+
+	err = chapters.CreateIndex("Part")
+	assert.NoError(test, err)
+
+	second := collection.UntypedEntry{"Title": "Drottningar i Kungahälla", "Part": 2}
+	err = chapters.Persist(&second)
+	assert.NoError(test, err)
+
+	first["Part"] = 2
+	err = chapters.Persist(&first)
+	assert.NoError(test, err)
+
+	found := []collection.UntypedEntry{}
+	err = chapters.Query(map[string]interface{}{"Part": 1}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 0, len(found))
+
+	err = chapters.Query(map[string]interface{}{"Part": 2}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+
+	err = chapters.Delete(&second)
+	assert.NoError(test, err)
+
+	err = chapters.Close()
+	assert.NoError(test, err)
+
+	chapters, err = collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+	defer chapters.Close()
+
+	fields, err := chapters.Indexes()
+	assert.NoError(test, err)
+	assert.Equal(test, []string{"Part"}, fields)
+
+	found = []collection.UntypedEntry{}
+	err = chapters.Query(map[string]interface{}{"Part": 2}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Mårbacka", found[0]["Title"])
+
+	err = chapters.DropIndex("Part")
+	assert.NoError(test, err)
+	err = chapters.DropIndex("Part")
+	assert.Equal(test, collection.IndexDoesNotExistError{Field: "Part", CollectionName: "chapters"}, err)
+
+	fields, err = chapters.Indexes()
+	assert.NoError(test, err)
+	assert.Equal(test, []string{}, fields)
+}
+
+func TestLogCollectionOverFilesystemCollection(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	chapters := collection.NewFilesystemCollection(root, "chapters")
+	err := chapters.Persist(&collection.UntypedEntry{"Title": "Mårbacka"})
+	assert.NoError(test, err)
+
+	_, err = collection.OpenLogCollection(root, "chapters")
+	assert.Equal(test, collection.NotLogCollectionError{CollectionName: "chapters"}, err)
+	assert.False(test, collection.IsLogCollection(root, "chapters"))
+
+	opened, err := collection.OpenCollection(root, "chapters")
+	assert.NoError(test, err)
+	found := []collection.UntypedEntry{}
+	err = opened.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+}
+
+func TestLogCollectionTornWrite(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	chapters, err := collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+
+	entry := collection.UntypedEntry{"Title": "Mårbacka"}
+	err = chapters.Persist(&entry)
+	assert.NoError(test, err)
+
+	err = chapters.Close()
+	assert.NoError(test, err)
+
+	segment := filepath.Join(root, "chapters", "segment-00000001.log")
+	file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(test, err)
+	_, err = file.WriteString(`0badc0de {"op":"put","id":"` + uuid.Must(uuid.NewV4()).String() + `","docu`)
+	assert.NoError(test, err)
+	file.Close()
+
+	chapters, err = collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+	assert.Equal(test, 1, chapters.Count())
+
+	other := collection.UntypedEntry{"Title": "Nils Holgersson"}
+	err = chapters.Persist(&other)
+	assert.NoError(test, err)
+
+	err = chapters.Close()
+	assert.NoError(test, err)
+
+	chapters, err = collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+	defer chapters.Close()
+	assert.Equal(test, 2, chapters.Count())
+}
+
+func TestLogCollectionCompaction(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Counter struct {
+		collection.BaseEntry
+		Value int
+	}
+
+	counters, err := collection.OpenLogCollection(root, "counters")
+	assert.NoError(test, err)
+	counters.MaxSegmentSize = 256
+	counters.CompactionThreshold = 10
+
+	kept := Counter{}
+	removed := Counter{}
+	for i := 0; i < 50; i++ {
+		kept.Value = i
+		err = counters.Persist(&kept)
+		assert.NoError(test, err)
+
+		removed.Value = i
+		err = counters.Persist(&removed)
+		assert.NoError(test, err)
+	}
+
+	err = counters.Delete(&removed)
+	assert.NoError(test, err)
+
+	err = counters.Compact()
+	assert.NoError(test, err)
+
+	segments, err := filepath.Glob(filepath.Join(root, "counters", "segment-*.log"))
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(segments))
+
+	loaded := Counter{}
+	err = counters.Load(kept.GetID(), &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, 49, loaded.Value)
+
+	err = counters.Close()
+	assert.NoError(test, err)
+
+	counters, err = collection.OpenLogCollection(root, "counters")
+	assert.NoError(test, err)
+	defer counters.Close()
+
+	found := []Counter{}
+	err = counters.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, 49, found[0].Value)
+}
+
+func TestMemoryCollection(test *testing.T) {
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+		Pages int
+	}
+
+	chapters := collection.NewMemoryCollection("chapters")
+
+	first := Chapter{Title: "Mårbacka", Pages: 12}
+	err := chapters.Insert(&first)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), first.GetRevision())
+
+	err = chapters.Insert(&first)
+	assert.Equal(test, collection.EntryAlreadyExistsError{}, err)
+
+	missing := Chapter{Title: "Nils Holgersson"}
+	err = chapters.Replace(&missing)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	stale := first
+	first.Pages = 14
+	err = chapters.Persist(&first)
+	assert.NoError(test, err)
+
+	err = chapters.Persist(&stale)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	patched := Chapter{}
+	err = chapters.Patch(first.GetID(), collection.MergePatch(`{"Pages":15}`), &patched)
+	assert.NoError(test, err)
+	assert.Equal(test, 15, patched.Pages)
+	assert.Equal(test, uint64(3), patched.GetRevision())
+
+	second := Chapter{Title: "Drottningar i Kungahälla"}
+	batch := collection.Batch{}
+	batch.Put(&second).Delete(&stale)
+	err = chapters.WriteBatch(batch)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+	assert.Equal(test, 1, chapters.Count())
+
+	batch = collection.Batch{}
+	batch.Put(&second)
+	err = chapters.WriteBatch(batch)
+	assert.NoError(test, err)
+
+	found := []Chapter{}
+	err = chapters.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+
+	err = chapters.CreateIndex("Title")
+	assert.NoError(test, err)
+	fields, err := chapters.Indexes()
+	assert.NoError(test, err)
+	assert.Equal(test, []string{"Title"}, fields)
+
+	err = chapters.Delete(&patched)
+	assert.NoError(test, err)
+
+	err = chapters.Delete(&patched)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	backend := collection.NewMemoryBackend()
+	opened, err := backend.Open("chapters")
+	assert.NoError(test, err)
+	err = opened.Persist(&Chapter{Title: "Mårbacka"})
+	assert.NoError(test, err)
+
+	info, err := backend.Info()
+	assert.NoError(test, err)
+	assert.Equal(test, collection.CollectionsInfo{{Name: "chapters", Path: "/chapters/", Entries: 1}}, info)
+}
+
+func TestMemoryCollectionFiltersLikeFilesystemCollection(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	onDisk := persistEditions(test, root)
+	inMemory := collection.NewMemoryCollection("editions")
+	storeEditions(test, inMemory)
+
+	for _, filter := range comparedEditionFilters() {
+		assert.Equal(test, queryEditionTitles(test, onDisk, filter), queryEditionTitles(test, inMemory, filter))
+	}
+}
+
+// comparedEditionFilters are run against every kind of collection holding
+// the editions from storeEditions, which have to give the same results.
+func comparedEditionFilters() []interface{} {
+	translator := "Velma Swanston Howard"
+	return []interface{}{
+		Edition{Published: true},
+		Edition{Printing: 1},
+		Edition{Translator: &translator},
+		Edition{Tags: []string{"geography", "children"}},
+		Edition{Metadata: map[string]string{"language": "en"}},
+		Edition{Released: time.Date(1906, 1, 1, 0, 0, 0, 0, time.UTC)},
+		map[string]interface{}{"Translator": nil},
+		map[string]interface{}{"Price": collection.Gt(collection.UntypedValue("10"))},
+		map[string]interface{}{"Metadata.language": "sv"},
+		collection.Where("Copies").Eq(0),
+		collection.Where("Title").HasPrefix("Nils").And("Published").Eq(true),
+		map[string]interface{}{"Tags": "children"},
+		map[string]interface{}{"Price": collection.UntypedValue("9.75")},
+		map[string]interface{}{"Published": collection.UntypedValue("false")},
+		map[string]interface{}{"Printing": collection.UntypedValue("3")},
+		map[string]interface{}{"Title": collection.UntypedValue("Nils Holgersson, draft")},
+		Edition{Released: time.Date(1906, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600))},
+		Edition{Copies: 2, Printing: 1},
+	}
+}
+
+func TestSQLiteCollection(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+		Pages int
+	}
+
+	chapters := backend.Collection("chapters")
+
+	first := Chapter{Title: "Mårbacka", Pages: 12}
+	err = chapters.Insert(&first)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), first.GetRevision())
+
+	err = chapters.Insert(&first)
+	assert.Equal(test, collection.EntryAlreadyExistsError{}, err)
+
+	stale := first
+	first.Pages = 14
+	created, err := chapters.Upsert(&first)
+	assert.NoError(test, err)
+	assert.False(test, created)
+	assert.Equal(test, uint64(2), first.GetRevision())
+
+	err = chapters.Persist(&stale)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	patched := Chapter{}
+	err = chapters.Patch(first.GetID(), collection.MergePatch(`{"Pages":15}`), &patched)
+	assert.NoError(test, err)
+	assert.Equal(test, 15, patched.Pages)
+
+	second := Chapter{Title: "Drottningar i Kungahälla"}
+	batch := collection.Batch{}
+	batch.Put(&second).Delete(&stale)
+	err = chapters.WriteBatch(batch)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	found := []Chapter{}
+	err = chapters.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+
+	batch = collection.Batch{}
+	batch.Put(&second).Delete(&patched)
+	err = chapters.WriteBatch(batch)
+	assert.NoError(test, err)
+
+	loaded := Chapter{}
+	err = chapters.Load(second.GetID(), &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, "Drottningar i Kungahälla", loaded.Title)
+
+	err = chapters.Load(first.GetID(), &loaded)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	err = chapters.Delete(&second)
+	assert.NoError(test, err)
+
+	err = chapters.Delete(&second)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	onDisk := persistEditions(test, root)
+	editions := backend.Collection("editions")
+	storeEditions(test, editions)
+
+	for _, filter := range comparedEditionFilters() {
+		assert.Equal(test, queryEditionTitles(test, onDisk, filter), queryEditionTitles(test, editions, filter))
+	}
+
+	info, err := backend.Info()
+	assert.NoError(test, err)
+	assert.Equal(test, collection.CollectionsInfo{{Name: "editions", Path: "/editions/", Entries: 3}}, info)
+}
+
+func TestSQLiteQueryMatchesFilesystem(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	stored := backend.Collection("codes")
+	onDisk := collection.NewFilesystemCollection(root, "codes")
+
+	for _, data := range []string{
+		`{"Code":"42"}`,
+		`{"Code":"42.0"}`,
+		`{"Code":42}`,
+		`{"Code":"forty-two"}`,
+		`{"Code":"0x2.ap4"}`,
+		`{"Code":["41","42"]}`,
+		`{"Code":43}`,
+		`{"Code":42,"_expiresAt":"2000-01-01T00:00:00+02:00"}`,
+	} {
+		for _, codes := range []collection.Collection{stored, onDisk} {
+			entry := collection.UntypedEntry{}
+			err = json.Unmarshal([]byte(data), &entry)
+			assert.NoError(test, err)
+			err = codes.Persist(&entry)
+			assert.NoError(test, err)
+		}
+	}
+
+	codesOf := func(codes collection.Collection, filter interface{}, options collection.QueryOptions) (found []interface{}, result collection.QueryResult) {
+		entries := []collection.UntypedEntry{}
+		result, err := codes.QueryWithOptions(filter, options, &entries)
+		assert.NoError(test, err)
+
+		for _, entry := range entries {
+			found = append(found, entry["Code"])
+		}
+		return
+	}
+
+	for _, testCase := range []struct {
+		filter  interface{}
+		matches int
+	}{
+		{map[string]interface{}{"Code": 42}, 5},
+		{map[string]interface{}{"Code": "42"}, 3},
+		{map[string]interface{}{"Code": collection.UntypedValue("42")}, 3},
+	} {
+		expected, _ := codesOf(onDisk, testCase.filter, collection.QueryOptions{})
+		found, _ := codesOf(stored, testCase.filter, collection.QueryOptions{})
+		assert.Equal(test, testCase.matches, len(expected), "%#v", testCase.filter)
+		assert.ElementsMatch(test, expected, found, "%#v", testCase.filter)
+	}
+
+	// The IDs differ between the collections, so the pages are compared by
+	// their sizes and cursors are followed separately.
+	for _, options := range []collection.QueryOptions{
+		{Limit: 3},
+		{Limit: 3, Offset: 5},
+		{Offset: 2},
+		{Limit: 2, Sort: []collection.SortField{{Field: "ID", Descending: true}}},
+	} {
+		for _, codes := range []collection.Collection{stored, onDisk} {
+			seen := 0
+			page := options
+			for {
+				found, result := codesOf(codes, nil, page)
+				seen += len(found)
+
+				if result.NextCursor == "" {
+					break
+				}
+				page.Cursor = result.NextCursor
+				page.Offset = 0
+			}
+
+			assert.Equal(test, 7-options.Offset, seen, "%v", options)
+		}
+	}
+}
+
+func TestSQLiteConditionsMatchFilesystem(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	stored := backend.Collection("values")
+	onDisk := collection.NewFilesystemCollection(root, "values")
+
+	for _, data := range []string{
+		`{"Code":"42"}`,
+		`{"Code":"42.0"}`,
+		`{"Code":42}`,
+		`{"Code":41.5}`,
+		`{"Code":"forty-two"}`,
+		`{"Code":"NaN"}`,
+		`{"Code":"a<b"}`,
+		`{"Code":["41","42"]}`,
+		`{"Code":[[42]]}`,
+		`{"Code":[{"Code":42}]}`,
+		`{"Code":{"Code":42}}`,
+		`{"Code.Code":43}`,
+		`{"Code":null}`,
+		`{"Code":true}`,
+		`{"Code":false}`,
+		`{"Code":"2020-01-01T10:00:00Z"}`,
+		`{"Code":"2020-01-01T12:00:00+02:00"}`,
+		`{"Name":"Selma"}`,
+	} {
+		for _, values := range []collection.Collection{stored, onDisk} {
+			entry := collection.UntypedEntry{}
+			err = json.Unmarshal([]byte(data), &entry)
+			assert.NoError(test, err)
+			err = values.Persist(&entry)
+			assert.NoError(test, err)
+		}
+	}
+
+	query := func(values collection.Collection, filter interface{}, options collection.QueryOptions) (found []string, result collection.QueryResult) {
+		entries := []collection.UntypedEntry{}
+		result, err := values.QueryWithOptions(filter, options, &entries)
+		assert.NoError(test, err)
+
+		for _, entry := range entries {
+			delete(entry, "ID")
+			data, err := json.Marshal(entry)
+			assert.NoError(test, err)
+			found = append(found, string(data))
+		}
+		return
+	}
+
+	for _, filter := range []interface{}{
+		map[string]interface{}{"Code": 42},
+		map[string]interface{}{"Code": nil},
+		map[string]interface{}{"Code": true},
+		map[string]interface{}{"Code": collection.UntypedValue("false")},
+		map[string]interface{}{"Code": collection.UntypedValue("null")},
+		map[string]interface{}{"Code": []interface{}{"41", "42"}},
+		map[string]interface{}{"Code": []interface{}{}},
+		map[string]interface{}{"Code": map[string]interface{}{"Code": 42}},
+		map[string]interface{}{"Code.Code": 42},
+		map[string]interface{}{"Code.Code": collection.Gt(42)},
+		map[string]interface{}{"Code": collection.Gt(41)},
+		map[string]interface{}{"Code": collection.Gte("42")},
+		map[string]interface{}{"Code": collection.Lt(42.5)},
+		map[string]interface{}{"Code": collection.Lte(collection.UntypedValue("42"))},
+		map[string]interface{}{"Code": collection.Gt("2020-01-01T09:30:00Z")},
+		map[string]interface{}{"Code": collection.Lt("b")},
+		map[string]interface{}{"Code": collection.Gt(false)},
+		map[string]interface{}{"Code": collection.Gte("NaN")},
+		map[string]interface{}{"Code": collection.Ne(42)},
+		map[string]interface{}{"Code": collection.Ne(nil)},
+		map[string]interface{}{"Code": collection.In(41.5, "forty-two", nil)},
+		map[string]interface{}{"Code": collection.Nin(42, true)},
+		map[string]interface{}{"Code": collection.Exists(true)},
+		map[string]interface{}{"Code": collection.Exists(false)},
+		map[string]interface{}{"Code": collection.HasPrefix("4")},
+		map[string]interface{}{"Code": collection.HasPrefix("")},
+		map[string]interface{}{"Code": collection.Contains("<")},
+		map[string]interface{}{"Code": collection.Matches("^4[0-9]$")},
+		map[string]interface{}{"Code": collection.Condition{Operator: collection.OperatorPrefix, Value: 4}},
+		map[string]interface{}{"Code": collection.Condition{Operator: "$unknown", Value: 4}},
+		map[string]interface{}{"Code": collection.Conditions{collection.Gt(40), collection.Lt(42)}},
+		map[string]interface{}{"Code": collection.Exists(false), "Name": collection.Exists(true)},
+		&map[string]interface{}{"Code": 42},
+	} {
+		expected, _ := query(onDisk, filter, collection.QueryOptions{})
+		found, _ := query(stored, filter, collection.QueryOptions{})
+		assert.ElementsMatch(test, expected, found, "%#v", filter)
+
+		// Following the cursors finds every match, also when the filter and
+		// the page size are translated to SQL.
+		for _, limit := range []int{1, 2} {
+			seen := []string{}
+			options := collection.QueryOptions{Limit: limit}
+			for {
+				found, result := query(stored, filter, options)
+				seen = append(seen, found...)
+
+				if result.NextCursor == "" {
+					break
+				}
+				options.Cursor = result.NextCursor
+			}
+
+			assert.ElementsMatch(test, expected, seen, "%#v limit %d", filter, limit)
+		}
+
+		page, _ := query(stored, filter, collection.QueryOptions{Offset: 1})
+		if len(expected) > 0 {
+			assert.Equal(test, len(expected)-1, len(page), "%#v", filter)
+		}
+	}
+}
+
+func TestConcurrentWritesThroughSeparateValues(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Counter struct {
+		collection.RevisionedEntry
+		Value int
+	}
+
+	counter := Counter{}
+	err := collection.NewFilesystemCollection(root, "counters").Persist(&counter)
+	assert.NoError(test, err)
+
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+
+			for increments := 0; increments < 10; {
+				counters := collection.FilesystemCollection{Root: root, Name: "counters"}
+				loaded := Counter{}
+				loadError := counters.Load(counter.GetID(), &loaded)
+				assert.NoError(test, loadError)
+
+				loaded.Value++
+				persistError := counters.Persist(&loaded)
+				if _, conflict := persistError.(collection.RevisionConflictError); conflict {
+					continue
+				}
+				assert.NoError(test, persistError)
+				increments++
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	loaded := Counter{}
+	err = collection.NewFilesystemCollection(root, "counters").Load(counter.GetID(), &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, 100, loaded.Value)
+	assert.Equal(test, uint64(101), loaded.GetRevision())
+}
+
+func receiveChange(test *testing.T, changes <-chan collection.Change) collection.Change {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		test.Fatal("timed out waiting for a change")
+	}
+
+	return collection.Change{}
+}
+
+func TestWatch(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	before := Book{Title: "Gösta Berlings saga", Rating: 5}
+	err := books.Persist(&before)
+	assert.NoError(test, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := books.Watch(ctx, Book{Rating: 5})
+	assert.NoError(test, err)
+
+	book := Book{Title: "Jerusalem", Rating: 5}
+	err = books.Persist(&book)
+	assert.NoError(test, err)
+
+	inserted := receiveChange(test, changes)
+	assert.Equal(test, collection.ChangeInsert, inserted.Type)
+	assert.Equal(test, book.GetID(), inserted.ID)
+	assert.Equal(test, uint64(2), inserted.Sequence)
+
+	other := Book{Title: "Liljecronas hem", Rating: 3}
+	err = books.Persist(&other)
+	assert.NoError(test, err)
+
+	book.Title = "Jerusalem I"
+	err = books.Persist(&book)
+	assert.NoError(test, err)
+
+	updated := receiveChange(test, changes)
+	assert.Equal(test, collection.ChangeUpdate, updated.Type)
+	assert.Equal(test, uint64(4), updated.Sequence)
+
+	loaded := Book{}
+	err = json.Unmarshal(updated.Entry, &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, "Jerusalem I", loaded.Title)
+
+	batch := collection.Batch{}
+	batch.Delete(&book)
+	err = books.WriteBatch(batch)
+	assert.NoError(test, err)
+
+	deleted := receiveChange(test, changes)
+	assert.Equal(test, collection.ChangeDelete, deleted.Type)
+	assert.Equal(test, book.GetID(), deleted.ID)
+	assert.Equal(test, uint64(5), deleted.Sequence)
+	assert.Equal(test, 0, len(deleted.Entry))
+
+	cancel()
+	for range changes {
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	resumed, err := collection.FilesystemCollection{Root: root, Name: "books"}.WatchSince(ctx, nil, 2)
+	assert.NoError(test, err)
+
+	assert.Equal(test, other.GetID(), receiveChange(test, resumed).ID)
+	assert.Equal(test, uint64(4), receiveChange(test, resumed).Sequence)
+	assert.Equal(test, uint64(5), receiveChange(test, resumed).Sequence)
+
+	err = books.Delete(&other)
+	assert.NoError(test, err)
+
+	removed := receiveChange(test, resumed)
+	assert.Equal(test, collection.ChangeDelete, removed.Type)
+	assert.Equal(test, other.GetID(), removed.ID)
+	assert.Equal(test, uint64(6), removed.Sequence)
+
+	filtered, err := books.Watch(ctx, Book{Rating: 5})
+	assert.NoError(test, err)
+
+	before.Rating = 4
+	err = books.Persist(&before)
+	assert.NoError(test, err)
+
+	moved := receiveChange(test, filtered)
+	assert.Equal(test, collection.ChangeUpdate, moved.Type)
+	assert.Equal(test, uint64(7), moved.Sequence)
+	previous := Book{}
+	err = json.Unmarshal(moved.Previous, &previous)
+	assert.NoError(test, err)
+	assert.Equal(test, 5, previous.Rating)
+
+	unrelated := Book{Title: "Kejsarn av Portugallien", Rating: 2}
+	err = books.Persist(&unrelated)
+	assert.NoError(test, err)
+	err = books.Delete(&unrelated)
+	assert.NoError(test, err)
+
+	after := Book{Title: "Körkarlen", Rating: 5}
+	err = books.Persist(&after)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(10), receiveChange(test, filtered).Sequence)
+}
+
+func TestChangeRetention(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	retention := collection.ChangeRetention
+	collection.ChangeRetention = 2
+	defer func() {
+		collection.ChangeRetention = retention
+	}()
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	for rating := 1; rating <= 5; rating++ {
+		err := books.Persist(&Book{Title: "Volume " + strconv.Itoa(rating), Rating: rating})
+		assert.NoError(test, err)
+	}
+
+	log, err := ioutil.ReadFile(filepath.Join(root, ".books.changes"))
+	assert.NoError(test, err)
+	assert.Equal(test, 2, strings.Count(string(log), "\n"))
+	assert.NotContains(test, string(log), "Volume 3")
+	assert.Contains(test, string(log), "Volume 5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = books.WatchSince(ctx, nil, 1)
+	assert.Equal(test, collection.ChangesCompactedError{Since: 1, Oldest: 4}, err)
+
+	resumed, err := books.WatchSince(ctx, nil, 3)
+	assert.NoError(test, err)
+
+	change := receiveChange(test, resumed)
+	assert.Equal(test, uint64(4), change.Sequence)
+	loaded := Book{}
+	err = json.Unmarshal(change.Entry, &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, "Volume 4", loaded.Title)
+	assert.Equal(test, uint64(5), receiveChange(test, resumed).Sequence)
+
+	changes, err := collection.NewFilesystemCollection(root, "books").Watch(ctx, nil)
+	assert.NoError(test, err)
+
+	book := Book{Title: "Volume 6"}
+	err = books.Persist(&book)
+	assert.NoError(test, err)
+
+	assert.Equal(test, uint64(6), receiveChange(test, changes).Sequence)
+	assert.Equal(test, uint64(6), receiveChange(test, resumed).Sequence)
+}
+
+func TestExpiry(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	logCollection, err := collection.OpenLogCollection(root, "logged")
+	assert.NoError(test, err)
+	defer logCollection.Close()
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	type Session struct {
+		collection.BaseEntry
+		collection.Expiry
+		Data string
+	}
+
+	for _, sessions := range []collection.Collection{
+		collection.NewFilesystemCollection(root, "sessions"),
+		collection.NewMemoryCollection("sessions"),
+		logCollection,
+		backend.Collection("sessions"),
+	} {
+		expired := Session{Data: "expired"}
+		expired.SetExpiresAt(time.Now().Add(-time.Minute))
+		err = sessions.Persist(&expired)
+		assert.NoError(test, err)
+
+		active := Session{Data: "active"}
+		active.ExpireAfter(time.Hour)
+		err = sessions.Persist(&active)
+		assert.NoError(test, err)
+
+		permanent := Session{Data: "permanent"}
+		err = sessions.Persist(&permanent)
+		assert.NoError(test, err)
+
+		err = sessions.Load(expired.GetID(), &Session{})
+		assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+		loaded := Session{}
+		err = sessions.Load(active.GetID(), &loaded)
+		assert.NoError(test, err)
+		assert.True(test, active.GetExpiresAt().Equal(loaded.GetExpiresAt()))
+
+		all := []Session{}
+		err = sessions.LoadAll(&all, 0)
+		assert.NoError(test, err)
+		assert.Equal(test, 2, len(all))
+
+		found := []Session{}
+		err = sessions.Query(Session{Data: "expired"}, 0, &found)
+		assert.NoError(test, err)
+		assert.Equal(test, 0, len(found))
+
+		replacement := Session{Data: "replacement"}
+		replacement.SetID(expired.GetID())
+		replacement.SetExpiresAt(time.Now().Add(-time.Second))
+		err = sessions.Insert(&replacement)
+		assert.NoError(test, err)
+
+		removed, err := sessions.(collection.Expirer).RemoveExpired()
+		assert.NoError(test, err)
+		assert.Equal(test, 1, removed)
+
+		removed, err = sessions.(collection.Expirer).RemoveExpired()
+		assert.NoError(test, err)
+		assert.Equal(test, 0, removed)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "sessions"))
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(files))
+}
+
+func TestRemoveExpiredDeletesLikeDelete(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	type Session struct {
+		collection.RevisionedEntry
+		collection.Expiry
+		Data string
+	}
+
+	filesystemSessions := collection.NewFilesystemCollection(root, "sessions")
+	err = filesystemSessions.CreateIndex("Data")
+	assert.NoError(test, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := filesystemSessions.Watch(ctx, nil)
+	assert.NoError(test, err)
+
+	for _, sessions := range []collection.Collection{
+		filesystemSessions,
+		collection.NewMemoryCollection("sessions"),
+		backend.Collection("sessions"),
+	} {
+		err = sessions.(collection.HistoryKeeper).SetHistoryRetention(collection.UnlimitedHistory)
+		assert.NoError(test, err)
+
+		session := Session{Data: "expiring"}
+		session.ExpireAfter(50 * time.Millisecond)
+		err = sessions.Persist(&session)
+		assert.NoError(test, err)
+
+		time.Sleep(100 * time.Millisecond)
+
+		removed, err := sessions.(collection.Expirer).RemoveExpired()
+		assert.NoError(test, err)
+		assert.Equal(test, 1, removed)
+
+		records, err := sessions.(collection.Historian).History(session.GetID())
+		assert.NoError(test, err)
+		assert.Equal(test, 2, len(records))
+		assert.True(test, records[len(records)-1].Deleted)
+	}
+
+	assert.Equal(test, collection.ChangeInsert, receiveChange(test, changes).Type)
+	removed := receiveChange(test, changes)
+	assert.Equal(test, collection.ChangeDelete, removed.Type)
+
+	indexed, err := ioutil.ReadDir(filepath.Join(root, "sessions", "_indexes", "Data"))
+	assert.NoError(test, err)
+	assert.Equal(test, 0, len(indexed))
+}
+
+func TestSchema(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	logCollection, err := collection.OpenLogCollection(root, "logged")
+	assert.NoError(test, err)
+	defer logCollection.Close()
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	schema := []byte(`{
+		"type": "object",
+		"properties": {
+			"Title": {"type": "string", "minLength": 1},
+			"Rating": {"type": "integer", "minimum": 1, "maximum": 5}
+		},
+		"required": ["Title"],
+		"additionalProperties": false
+	}`)
+
+	type Review struct {
+		collection.RevisionedEntry
+		Title  string
+		Rating int `json:",omitempty"`
+	}
+
+	for _, reviews := range []collection.Collection{
+		collection.NewFilesystemCollection(root, "reviews"),
+		collection.NewMemoryCollection("reviews"),
+		logCollection,
+		backend.Collection("reviews"),
+	} {
+		validator := reviews.(collection.SchemaValidator)
+
+		stored, err := validator.Schema()
+		assert.NoError(test, err)
+		assert.Nil(test, stored)
+
+		err = validator.SetSchema([]byte(`{"type": "text"}`))
+		assert.IsType(test, collection.InvalidSchemaError{}, err)
+
+		err = validator.SetSchema(schema)
+		assert.NoError(test, err)
+
+		stored, err = validator.Schema()
+		assert.NoError(test, err)
+		assert.Equal(test, string(schema), string(stored))
+
+		review := Review{Title: "Nils Holgersson", Rating: 5}
+		err = reviews.Persist(&review)
+		assert.NoError(test, err)
+
+		invalid := Review{Rating: 7}
+		err = reviews.Persist(&invalid)
+		validationError, ok := err.(collection.ValidationError)
+		assert.True(test, ok)
+		assert.Equal(test, reviews.GetName(), validationError.CollectionName)
+		assert.Equal(test, []collection.Violation{
+			{Path: "/Rating", Message: "must be at most 5"},
+			{Path: "/Title", Message: "must be at least 1 characters long"},
+		}, validationError.Violations)
+
+		err = reviews.Patch(review.GetID(), collection.MergePatch(`{"Author": "Selma Lagerlöf"}`), nil)
+		assert.Equal(test, collection.ValidationError{
+			ID:             review.GetID(),
+			CollectionName: reviews.GetName(),
+			Violations:     []collection.Violation{{Path: "/Author", Message: "is not allowed"}},
+		}, err)
+
+		batch := collection.Batch{}
+		batch.Put(&Review{Title: "Jerusalem"})
+		batch.Put(&Review{Title: "Kejsarn av Portugallien", Rating: 3})
+		batch.Put(&Review{Title: "Körkarlen", Rating: -1})
+		err = reviews.WriteBatch(batch)
+		assert.IsType(test, collection.ValidationError{}, err)
+
+		all := []Review{}
+		err = reviews.LoadAll(&all, 0)
+		assert.NoError(test, err)
+		assert.Equal(test, 1, len(all))
+		assert.Equal(test, uint64(1), all[0].GetRevision())
+
+		err = validator.SetSchema(nil)
+		assert.NoError(test, err)
+
+		err = reviews.Persist(&invalid)
+		assert.NoError(test, err)
+	}
+}
+
+func TestSchemaKeywords(test *testing.T) {
+	cases := []struct {
+		schema     string
+		document   string
+		violations []string
+	}{
+		{`{"properties": {"Tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}}}`, `{"Tags": ["a", 1, "c"]}`, []string{"/Tags must have at most 2 items", "/Tags/1 must be of type string"}},
+		{`{"properties": {"Kind": {"enum": ["novel", "poem"]}}}`, `{"Kind": "essay"}`, []string{"/Kind must be one of the values in enum"}},
+		{`{"properties": {"Kind": {"const": "novel"}}}`, `{"Kind": "novel"}`, nil},
+		{`{"properties": {"ISBN": {"pattern": "^[0-9-]+$"}}}`, `{"ISBN": "91-x"}`, []string{"/ISBN must match the pattern \"^[0-9-]+$\""}},
+		{`{"properties": {"Price": {"type": "number", "exclusiveMinimum": 0}}}`, `{"Price": 0}`, []string{"/Price must be greater than 0"}},
+		{`{"properties": {"Year": {"type": ["integer", "null"]}}}`, `{"Year": null}`, nil},
+		{`{"properties": {"Year": {"type": "integer"}}}`, `{"Year": 1891.5}`, []string{"/Year must be of type integer"}},
+		{`{"properties": {"Author": {"type": "object", "required": ["Name"], "additionalProperties": {"type": "string"}}}}`, `{"Author": {"Country": 46}}`, []string{"/Author/Name is required", "/Author/Country must be of type string"}},
+		{`{"anyOf": [{"required": ["ISBN"]}, {"required": ["ISSN"]}]}`, `{"Title": "Nils"}`, []string{"must match at least one schema in anyOf"}},
+		{`{"oneOf": [{"required": ["ISBN"]}, {"required": ["Title"]}]}`, `{"Title": "Nils", "ISBN": "91"}`, []string{"must match exactly one schema in oneOf"}},
+		{`{"allOf": [{"minProperties": 1}, {"maxProperties": 1}]}`, `{"Title": "Nils", "ISBN": "91"}`, []string{"must have at most 1 properties"}},
+		{`{"not": {"required": ["Draft"]}}`, `{"Draft": true}`, []string{"must not match the schema in not"}},
+		{`{"properties": {"Draft": false}}`, `{"Draft": true}`, []string{"/Draft is not allowed"}},
+		{`{"properties": {"a/b~c": {"type": "string"}}}`, `{"a/b~c": 1}`, []string{"/a~1b~0c must be of type string"}},
+	}
+
+	for _, testCase := range cases {
+		documents := collection.NewMemoryCollection("documents")
+		err := documents.SetSchema([]byte(testCase.schema))
+		assert.NoError(test, err, testCase.schema)
+
+		entry := collection.UntypedEntry{}
+		err = json.Unmarshal([]byte(testCase.document), &entry)
+		assert.NoError(test, err)
+
+		err = documents.Persist(&entry)
+		if testCase.violations == nil {
+			assert.NoError(test, err, testCase.schema)
+			continue
+		}
+
+		violations := []string{}
+		if validationError, ok := err.(collection.ValidationError); ok {
+			for _, violation := range validationError.Violations {
+				violations = append(violations, strings.TrimSpace(violation.Path+" "+violation.Message))
+			}
+		}
+		assert.Equal(test, testCase.violations, violations, testCase.schema)
+	}
+
+	documents := collection.NewMemoryCollection("documents")
+	for _, schema := range []string{
+		`{"$ref": "#/definitions/book"}`,
+		`{"properties": {"Published": {"type": "string", "format": "date"}}}`,
+		`{"items": {"uniqueItems": true}}`,
+	} {
+		err := documents.SetSchema([]byte(schema))
+		if assert.IsType(test, collection.InvalidSchemaError{}, err, schema) {
+			assert.Contains(test, err.Error(), "the supported keywords are type, enum", schema)
+		}
+	}
+
+	err := documents.SetSchema([]byte(`{"$schema": "http://json-schema.org/draft-07/schema#", "title": "Book", "properties": {"Title": {"description": "The title", "type": "string"}}}`))
+	assert.NoError(test, err)
+}
+
+func TestHistory(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	backend, err := collection.OpenSQLiteBackend(filepath.Join(root, "collections.db"))
+	assert.NoError(test, err)
+	defer backend.Close()
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+	}
+
+	for _, chapters := range []collection.Collection{
+		collection.NewFilesystemCollection(root, "chapters"),
+		collection.NewMemoryCollection("chapters"),
+		backend.Collection("chapters"),
+	} {
+		historian := chapters.(collection.Historian)
+		keeper := chapters.(collection.HistoryKeeper)
+
+		chapter := Chapter{Title: "Pojken"}
+		err = chapters.Persist(&chapter)
+		assert.NoError(test, err)
+
+		records, err := historian.History(chapter.GetID())
+		assert.NoError(test, err)
+		assert.Equal(test, 1, len(records))
+		assert.Nil(test, records[0].WrittenAt)
+
+		err = keeper.SetHistoryRetention(2)
+		assert.NoError(test, err)
+
+		retention, err := keeper.HistoryRetention()
+		assert.NoError(test, err)
+		assert.Equal(test, 2, retention)
+
+		chapter.Title = "Tomtebobarnen"
+		err = chapters.Persist(&chapter)
+		assert.NoError(test, err)
+
+		between := time.Now()
+
+		batch := collection.Batch{}
+		chapter.Title = "Akka från Kebnekajse"
+		batch.Put(&chapter)
+		err = chapters.WriteBatch(batch)
+		assert.NoError(test, err)
+
+		asOf := Chapter{}
+		err = historian.LoadAsOf(chapter.GetID(), between, &asOf)
+		assert.NoError(test, err)
+		assert.Equal(test, "Tomtebobarnen", asOf.Title)
+		assert.Equal(test, uint64(2), asOf.GetRevision())
+
+		err = historian.LoadAsOf(chapter.GetID(), between.Add(-time.Hour), &asOf)
+		assert.NoError(test, err)
+		assert.Equal(test, "Pojken", asOf.Title)
+
+		first := Chapter{}
+		err = historian.LoadRevision(chapter.GetID(), 1, &first)
+		assert.NoError(test, err)
+		assert.Equal(test, "Pojken", first.Title)
+
+		err = historian.LoadRevision(chapter.GetID(), 9, &Chapter{})
+		assert.Equal(test, collection.RevisionDoesNotExistError{ID: chapter.GetID(), Revision: 9}, err)
+
+		reverted := Chapter{}
+		reverted.SetRevision(2)
+		err = historian.Revert(chapter.GetID(), 1, &reverted)
+		assert.IsType(test, collection.RevisionConflictError{}, err)
+
+		reverted.SetRevision(3)
+		err = historian.Revert(chapter.GetID(), 1, &reverted)
+		assert.NoError(test, err)
+		assert.Equal(test, "Pojken", reverted.Title)
+		assert.Equal(test, uint64(4), reverted.GetRevision())
+
+		records, err = historian.History(chapter.GetID())
+		assert.NoError(test, err)
+		revisions := []uint64{}
+		for _, record := range records {
+			revisions = append(revisions, record.Revision)
+			assert.NotNil(test, record.WrittenAt)
+		}
+		assert.Equal(test, []uint64{2, 3, 4}, revisions)
+
+		err = chapters.Delete(&reverted)
+		assert.NoError(test, err)
+
+		err = historian.LoadAsOf(chapter.GetID(), time.Now(), &Chapter{})
+		assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+		err = historian.Revert(chapter.GetID(), 3, nil)
+		assert.NoError(test, err)
+
+		restored := Chapter{}
+		err = chapters.Load(chapter.GetID(), &restored)
+		assert.NoError(test, err)
+		assert.Equal(test, "Akka från Kebnekajse", restored.Title)
+
+		err = keeper.SetHistoryRetention(0)
+		assert.NoError(test, err)
+
+		records, err = historian.History(chapter.GetID())
+		assert.NoError(test, err)
+		assert.Equal(test, 1, len(records))
+
+		_, err = historian.History(uuid.Must(uuid.NewV4()))
+		assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+	}
+}
+
+func TestHistoryFailureKeepsWrite(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	type Chapter struct {
+		collection.RevisionedEntry
+		Title string
+	}
+
+	chapters := collection.NewFilesystemCollection(root, "chapters")
+	err := chapters.SetHistoryRetention(2)
+	assert.NoError(test, err)
+
+	err = ioutil.WriteFile(filepath.Join(root, "chapters", "_history"), []byte{}, 0600)
+	assert.NoError(test, err)
+
+	chapter := Chapter{Title: "Pojken"}
+	err = chapters.Persist(&chapter)
+	assert.NoError(test, err)
+
+	chapter.Title = "Tomtebobarnen"
+	err = chapters.Persist(&chapter)
+	assert.NoError(test, err)
+
+	loaded := Chapter{}
+	err = chapters.Load(chapter.GetID(), &loaded)
+	assert.NoError(test, err)
+	assert.Equal(test, "Tomtebobarnen", loaded.Title)
+	assert.Equal(test, uint64(2), loaded.GetRevision())
+
+	err = chapters.Delete(&loaded)
 	assert.NoError(test, err)
-	assert.Contains(test, info, collection.CollectionInfo{Name: "sections", Path: "/sections/", Entries: 1})
 }
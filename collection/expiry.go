@@ -0,0 +1,78 @@
+package collection
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ExpiresAtField is the key that holds the time a stored entry expires.
+const ExpiresAtField = "_expiresAt"
+
+// Expiring entries are treated as deleted once their expiry time has passed,
+// they are left out of Load, LoadAll and Query and removed by RemoveExpired.
+// A zero time means that the entry never expires.
+type Expiring interface {
+	GetExpiresAt() time.Time
+	SetExpiresAt(time.Time)
+}
+
+// Expiry makes an entry Expiring when embedded next to BaseEntry or
+// RevisionedEntry.
+type Expiry struct {
+	ExpiresAt *time.Time `json:"_expiresAt,omitempty"`
+}
+
+func (expiry *Expiry) GetExpiresAt() time.Time {
+	if expiry.ExpiresAt == nil {
+		return time.Time{}
+	}
+
+	return *expiry.ExpiresAt
+}
+
+func (expiry *Expiry) SetExpiresAt(expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		expiry.ExpiresAt = nil
+		return
+	}
+
+	expiry.ExpiresAt = &expiresAt
+}
+
+// ExpireAfter sets the expiry time to ttl from now.
+func (expiry *Expiry) ExpireAfter(ttl time.Duration) {
+	expiry.SetExpiresAt(time.Now().Add(ttl))
+}
+
+// Expirer is implemented by collections that can remove their expired
+// entries.
+type Expirer interface {
+	RemoveExpired() (removed int, err error)
+}
+
+func documentExpiresAt(raw []byte) (expiresAt time.Time) {
+	document := struct {
+		ExpiresAt *time.Time `json:"_expiresAt"`
+	}{}
+
+	if json.Unmarshal(raw, &document) == nil && document.ExpiresAt != nil {
+		expiresAt = *document.ExpiresAt
+	}
+
+	return
+}
+
+func documentExpired(raw []byte, now time.Time) bool {
+	expiresAt := documentExpiresAt(raw)
+	return !expiresAt.IsZero() && !expiresAt.After(now)
+}
+
+// unlessExpired wraps the result of reading a stored entry and makes expired
+// entries look like they do not exist.
+func unlessExpired(raw []byte, err error) ([]byte, error) {
+	if err == nil && documentExpired(raw, time.Now()) {
+		return nil, EntryDoesNotExistError{}
+	}
+
+	return raw, err
+}
@@ -4,74 +4,287 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
-	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
+var _ Collection = FilesystemCollection{}
+var _ SchemaValidator = FilesystemCollection{}
+var _ Historian = FilesystemCollection{}
+var _ HistoryKeeper = FilesystemCollection{}
+
+const DefaultRoot = "collections"
+
+func NewFilesystemCollection(root string, name string) *FilesystemCollection {
+	return &FilesystemCollection{Root: root, Name: name}
+}
+
 type FilesystemCollection struct {
+	// Root is the data directory that holds one sub directory per collection,
+	// DefaultRoot is used when it is empty.
+	Root string
 	Name string
-	mux  sync.Mutex
+}
+
+// lock locks the collection for writing, see lockDirectory.
+func (collection FilesystemCollection) lock() (unlock func(), err error) {
+	return lockDirectory(collection.getDirectory(), true)
+}
+
+// rlock locks the collection for reading, see lockDirectory.
+func (collection FilesystemCollection) rlock() (unlock func(), err error) {
+	return lockDirectory(collection.getDirectory(), false)
+}
+
+// createAndLock creates the collection directory before locking it, for
+// writes that store data in the collection. Other writes use lock so that
+// e.g. deleting from a missing collection does not create it.
+func (collection FilesystemCollection) createAndLock() (unlock func(), err error) {
+	err = collection.createCollectionDirectory()
+	if err != nil {
+		return
+	}
+
+	return collection.lock()
 }
 
 func (collection FilesystemCollection) createCollectionDirectory() error {
-	return os.MkdirAll("collections/"+collection.GetName(), 0700)
+	return os.MkdirAll(collection.getDirectory(), 0700)
+}
+
+func (collection FilesystemCollection) getRoot() string {
+	if collection.Root == "" {
+		return DefaultRoot
+	}
+
+	return collection.Root
 }
 
 func (collection FilesystemCollection) GetName() string {
 	return collection.Name
 }
 
+type writeMode int
+
+const (
+	writeUpsert writeMode = iota
+	writeInsert
+	writeReplace
+)
+
+// Persist stores the entry whether it exists or not, see Upsert.
 func (collection FilesystemCollection) Persist(entry Entry) (err error) {
-	collection.mux.Lock()
-	defer collection.mux.Unlock()
+	_, err = collection.write(entry, writeUpsert)
+	return
+}
+
+// Insert stores a new entry and fails with EntryAlreadyExistsError if an
+// entry with the same ID exists.
+func (collection FilesystemCollection) Insert(entry Entry) (err error) {
+	_, err = collection.write(entry, writeInsert)
+	return
+}
+
+// Replace overwrites an existing entry and fails with EntryDoesNotExistError
+// if there is no entry with the ID.
+func (collection FilesystemCollection) Replace(entry Entry) (err error) {
+	_, err = collection.write(entry, writeReplace)
+	return
+}
+
+// Upsert stores the entry and reports whether it was created.
+func (collection FilesystemCollection) Upsert(entry Entry) (created bool, err error) {
+	return collection.write(entry, writeUpsert)
+}
+
+func (collection FilesystemCollection) write(entry Entry, mode writeMode) (created bool, err error) {
+	unlock, err := collection.createAndLock()
+	if err != nil {
+		return
+	}
+	defer unlock()
 
 	if entry.GetID() == uuid.Nil {
+		if mode == writeReplace {
+			err = EntryDoesNotExistError{}
+			return
+		}
+
 		entry.SetID(uuid.Must(uuid.NewV4()))
 	}
 
-	err = collection.createCollectionDirectory()
+	_, err = collection.loadRaw(entry.GetID())
+	exists := err == nil
+	if _, ok := err.(EntryDoesNotExistError); ok {
+		err = nil
+	}
 	if err != nil {
 		return
 	}
 
-	filePath := "collections/" + collection.GetName() + "/" + entry.GetID().String() + ".json"
+	if exists && mode == writeInsert {
+		err = EntryAlreadyExistsError{}
+		return
+	} else if !exists && mode == writeReplace {
+		err = EntryDoesNotExistError{}
+		return
+	}
 
 	serialized, err := json.Marshal(entry)
 	if err != nil {
 		return
 	}
 
-	err = ioutil.WriteFile(filePath, serialized, 0600)
+	revision, err := collection.writeRaw(entry.GetID(), serialized, getExpectedRevision(entry))
+	if err != nil {
+		return
+	}
+
+	setRevision(entry, revision)
+	created = !exists
+	return
+}
+
+// writeRaw stores the serialized entry with the next revision and keeps the
+// indexes up to date, the caller is expected to hold the collection lock.
+func (collection FilesystemCollection) writeRaw(id uuid.UUID, serialized []byte, expectedRevision uint64) (revision uint64, err error) {
+	err = collection.createCollectionDirectory()
+	if err != nil {
+		return
+	}
+
+	storedRaw, err := collection.readRaw(id)
+	if _, ok := err.(EntryDoesNotExistError); ok {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	// An expired entry is overwritten as if it did not exist, but its keys
+	// are still in the indexes and have to be removed.
+	oldRaw := storedRaw
+	if documentExpired(storedRaw, time.Now()) {
+		oldRaw = nil
+	}
+
+	oldDocument := parseDocument(oldRaw)
+	err = checkRevision(id, expectedRevision, documentRevision(oldDocument))
+	if err != nil {
+		return
+	}
+
+	_, schema, err := readSchemaFile(collection.getDirectory())
+	if err != nil {
+		return
+	}
+
+	document, serialized, revision, err := nextRevision(collection.GetName(), id, serialized, oldDocument, schema)
+	if err != nil {
+		return
+	}
+
+	err = collection.addToIndexes(id, document)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomically(collection.getFilename(id), serialized, 0600)
+	if err != nil {
+		return
+	}
+
+	err = collection.removeFromIndexes(id, parseDocument(storedRaw), document)
+	if err != nil {
+		return
+	}
+
+	collection.recordHistory(id, oldRaw, serialized)
+	collection.publish(documentChange(id, oldRaw, serialized))
+	return
+}
+
+// nextRevision returns the document to store in place of oldDocument, after
+// validating it against the schema of the collection.
+func nextRevision(collectionName string, id uuid.UUID, serialized []byte, oldDocument map[string]interface{}, schema *compiledSchema) (document map[string]interface{}, stored []byte, revision uint64, err error) {
+	document = parseDocument(serialized)
+	if document == nil {
+		err = EntryNotParsableError{ID: id, CollectionName: collectionName}
+		return
+	}
+
+	err = validateDocument(schema, collectionName, id, document)
+	if err != nil {
+		return
+	}
+
+	revision = documentRevision(oldDocument) + 1
+	document[RevisionField] = revision
+	stored, err = json.Marshal(document)
 	return
 }
 
 func (collection FilesystemCollection) Delete(entry Entry) (err error) {
-	collection.mux.Lock()
-	defer collection.mux.Unlock()
+	unlock, err := collection.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
 
-	filePath := "collections/" + collection.GetName() + "/" + entry.GetID().String() + ".json"
+	oldRaw, err := collection.loadRaw(entry.GetID())
+	if err != nil {
+		return
+	}
 
-	err = os.Remove(filePath)
-	if err != nil && strings.HasSuffix(err.Error(), "no such file or directory") {
-		err = EntryDoesNotExistError{}
+	err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(parseDocument(oldRaw)))
+	if err != nil {
+		return
 	}
 
+	err = collection.remove(entry.GetID(), oldRaw)
+	return
+}
+
+// remove deletes the stored entry and updates the indexes, history and change
+// feed, the caller is expected to hold the collection lock.
+func (collection FilesystemCollection) remove(id uuid.UUID, oldRaw []byte) (err error) {
+	err = os.Remove(collection.getFilename(id))
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "no such file or directory") {
+			err = EntryDoesNotExistError{}
+		}
+		return
+	}
+
+	err = syncDirectory(collection.getDirectory())
+	if err != nil {
+		return
+	}
+
+	err = collection.removeFromIndexes(id, parseDocument(oldRaw), nil)
+	if err != nil {
+		return
+	}
+
+	collection.recordHistory(id, oldRaw, nil)
+	collection.publish(documentChange(id, oldRaw, nil))
 	return
 }
 
 func (collection FilesystemCollection) getDirectory() string {
-	return "collections/" + collection.GetName()
+	return filepath.Join(collection.getRoot(), collection.GetName())
 }
 
 func (collection FilesystemCollection) getFilename(id uuid.UUID) string {
-	return collection.getDirectory() + "/" + id.String() + ".json"
+	return filepath.Join(collection.getDirectory(), id.String()+".json")
 }
 
 func (collection FilesystemCollection) getIds() (ids []uuid.UUID, err error) {
-	// TODO: Implement indexes instead and let there automatically be a ID index
 	files, err := ioutil.ReadDir(collection.getDirectory())
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "no such file or directory") {
@@ -81,7 +294,15 @@ func (collection FilesystemCollection) getIds() (ids []uuid.UUID, err error) {
 
 	if err == nil {
 		for _, file := range files {
-			id := uuid.Must(uuid.FromString(strings.TrimSuffix(file.Name(), ".json")))
+			if file.IsDir() || isTemporaryFile(file.Name()) || !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+
+			id, parseError := uuid.FromString(strings.TrimSuffix(file.Name(), ".json"))
+			if parseError != nil {
+				continue
+			}
+
 			ids = append(ids, id)
 		}
 	}
@@ -89,7 +310,12 @@ func (collection FilesystemCollection) getIds() (ids []uuid.UUID, err error) {
 	return
 }
 
+// loadRaw reads a stored entry, expired entries do not exist.
 func (collection FilesystemCollection) loadRaw(id uuid.UUID) (raw []byte, err error) {
+	return unlessExpired(collection.readRaw(id))
+}
+
+func (collection FilesystemCollection) readRaw(id uuid.UUID) (raw []byte, err error) {
 	raw, err = ioutil.ReadFile(collection.getFilename(id))
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "no such file or directory") {
@@ -99,150 +325,128 @@ func (collection FilesystemCollection) loadRaw(id uuid.UUID) (raw []byte, err er
 	return
 }
 
-func (collection FilesystemCollection) checkIfElementPasses(filterField reflect.Value, entryField reflect.Value) bool {
-	passes := true
-	filterFieldType := filterField.Type()
-
-	if filterFieldType == reflect.TypeOf(uuid.Nil) {
-		entryUUID := entryField.Interface().(uuid.UUID)
-		filterUUID := filterField.Interface().(uuid.UUID)
-
-		if filterUUID != uuid.Nil && filterUUID != entryUUID {
-			passes = false
-		}
-	} else if filterField.Kind() == reflect.Struct {
-		if !collection.passesFilter(filterField, entryField) {
-			passes = false
-		}
-	} else if filterField.Kind() == reflect.String {
-		filterString := filterField.String()
-		entryString := entryField.String()
+func (collection FilesystemCollection) Load(id uuid.UUID, entry Entry) (err error) {
+	unlock, err := collection.rlock()
+	if err != nil {
+		return
+	}
+	defer unlock()
 
-		if filterString != "" && filterString != entryString {
-			passes = false
-		}
-	} else if filterField.Kind() == reflect.Int {
-		filterInt := filterField.Int()
-		entryInt := entryField.Int()
+	raw, err := collection.loadRaw(id)
+	if err != nil {
+		return
+	}
 
-		if filterInt != 0 && filterInt != entryInt {
-			passes = false
-		}
+	err = json.Unmarshal(raw, entry)
+	if err != nil {
+		return
 	}
 
-	return passes
+	return
 }
 
-func (collection FilesystemCollection) passesFilter(filter reflect.Value, entry reflect.Value) bool {
-	passes := true
+func (collection FilesystemCollection) LoadAll(entries interface{}, limit int) (err error) {
+	_, err = collection.LoadAllWithOptions(entries, QueryOptions{Limit: limit})
+	return
+}
 
-	if filter.Kind() == reflect.Struct {
-		for i := 0; i < filter.NumField(); i++ {
-			filterField := filter.Field(i)
-			filterFieldName := filter.Type().Field(i).Name
-			passes = collection.checkIfElementPasses(filterField, entry.FieldByName(filterFieldName))
-			if passes == false {
-				break
-			}
-		}
-	} else if filter.Kind() == reflect.Map {
-		for _, key := range filter.MapKeys() {
-			filterField := filter.MapIndex(key).Elem()
-			filterFieldName := key.String()
-
-			var entryElement reflect.Value
-			if entry.Kind() == reflect.Struct {
-				entryElement = entry.FieldByName(filterFieldName)
-			} else if entry.Kind() == reflect.Map {
-				entryElement = entry.MapIndex(key).Elem()
-			} else {
-				passes = false
-				break
-			}
+func (collection FilesystemCollection) LoadAllWithOptions(entries interface{}, options QueryOptions) (result QueryResult, err error) {
+	unlock, err := collection.rlock()
+	if err != nil {
+		return
+	}
+	defer unlock()
 
-			passes = collection.checkIfElementPasses(filterField, entryElement)
-			if passes == false {
-				break
-			}
-		}
-	} else {
-		passes = false
+	ids, err := collection.getIds()
+	if err != nil {
+		return
 	}
 
-	return passes
+	result, err = loadMatching(collection.GetName(), ids, collection.loadRaw, nil, options, entries)
+	return
 }
 
-func (collection FilesystemCollection) Load(id uuid.UUID, entry Entry) (err error) {
-	collection.mux.Lock()
-	defer collection.mux.Unlock()
+func (collection FilesystemCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
+	_, err = collection.QueryWithOptions(filter, QueryOptions{Limit: limit}, entries)
+	return
+}
 
-	raw, err := collection.loadRaw(id)
+func (collection FilesystemCollection) QueryWithOptions(filter interface{}, options QueryOptions, entries interface{}) (result QueryResult, err error) {
+	unlock, err := collection.rlock()
 	if err != nil {
 		return
 	}
+	defer unlock()
 
-	err = json.Unmarshal(raw, entry)
+	ids, err := collection.getCandidateIds(filter)
 	if err != nil {
 		return
 	}
 
+	result, err = loadMatching(collection.GetName(), ids, collection.loadRaw, filter, options, entries)
 	return
 }
 
-func (collection FilesystemCollection) LoadAll(entries interface{}, limit int) (err error) {
-	collection.mux.Lock()
-	defer collection.mux.Unlock()
-
-	ids, err := collection.getIds()
+// loadMatching reads the entries with the given ids using loadRaw and appends
+// the ones that pass the filter to entries, a nil filter lets every entry
+// pass. The ids are expected to be sorted, which is the order entries are
+// returned in unless options.Sort is set.
+func loadMatching(collectionName string, ids []uuid.UUID, loadRaw func(id uuid.UUID) ([]byte, error), filter interface{}, options QueryOptions, entries interface{}) (result QueryResult, err error) {
+	err = options.Validate()
 	if err != nil {
 		return
 	}
 
-	slice := reflect.ValueOf(entries).Elem()
-	elementType := slice.Type().Elem()
+	prepared, err := prepareFilter(filter)
+	if err != nil {
+		return
+	}
 
-	added := 0
-	for _, id := range ids {
-		if limit != 0 && added >= limit {
+	var cursor *cursorPosition
+	if options.Cursor != "" {
+		position, cursorError := decodeCursor(options.Cursor, options.Sort)
+		if cursorError != nil {
+			err = cursorError
 			return
 		}
+		cursor = &position
+	}
 
-		raw, loadError := collection.loadRaw(id)
-		if loadError != nil {
-			err = loadError
+	// Without sort fields the ids are already in page order, which means that
+	// loading can start after the cursor and stop once the page is full.
+	presorted := len(options.Sort) == 0
+	if presorted && cursor != nil {
+		lastID, cursorError := cursorID(*cursor)
+		if cursorError != nil {
+			err = cursorError
 			return
 		}
 
-		entry := reflect.New(elementType)
-		unmarshalError := json.Unmarshal(raw, entry.Interface())
-		if unmarshalError != nil {
-			return EntryNotParsableError{
-				ID:             id,
-				CollectionName: collection.GetName(),
-			}
-		}
-		slice.Set(reflect.Append(slice, entry.Elem()))
-		added++
+		start := sort.Search(len(ids), func(i int) bool {
+			return ids[i].String() > lastID.String()
+		})
+		ids = ids[start:]
+		cursor = nil
 	}
 
-	return
-}
-
-func (collection FilesystemCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
-	collection.mux.Lock()
-	defer collection.mux.Unlock()
-
-	ids, err := collection.getIds()
-	if err != nil {
-		return
+	wanted := 0
+	if presorted && options.Limit != 0 {
+		wanted = options.Offset + options.Limit + 1
 	}
 
 	slice := reflect.ValueOf(entries).Elem()
 	elementType := slice.Type().Elem()
 
-	appended := 0
+	matching := []reflect.Value{}
 	for _, id := range ids {
-		raw, loadError := collection.loadRaw(id)
+		if wanted != 0 && len(matching) >= wanted {
+			break
+		}
+
+		raw, loadError := loadRaw(id)
+		if _, ok := loadError.(EntryDoesNotExistError); ok {
+			continue
+		}
 		if loadError != nil {
 			err = loadError
 			return
@@ -251,31 +455,41 @@ func (collection FilesystemCollection) Query(filter interface{}, limit int, entr
 		entry := reflect.New(elementType)
 		unmarshalError := json.Unmarshal(raw, entry.Interface())
 		if unmarshalError != nil {
-			return EntryNotParsableError{
+			err = EntryNotParsableError{
 				ID:             id,
-				CollectionName: collection.GetName(),
+				CollectionName: collectionName,
 			}
+			return
 		}
 
 		entryValue := entry.Elem()
 
-		if collection.passesFilter(reflect.ValueOf(filter), entryValue) {
-			slice.Set(reflect.Append(slice, entryValue))
-			appended++
-
-			if limit != 0 && appended >= limit {
-				break
-			}
+		if prepared.passes(entryValue) {
+			matching = append(matching, entryValue)
 		}
 	}
 
+	if !presorted {
+		sortEntries(matching, withIDTiebreaker(options.Sort))
+	}
+
+	page, result := paginate(matching, options, cursor)
+	for _, entryValue := range page {
+		project(entryValue, options.Fields)
+		slice.Set(reflect.Append(slice, entryValue))
+	}
+
 	return
 }
 
-func FilesystemCollectionsInfo() (collectionsInfo CollectionsInfo, err error) {
+func FilesystemCollectionsInfo(root string) (collectionsInfo CollectionsInfo, err error) {
 	collectionsInfo = CollectionsInfo{}
 
-	files, err := ioutil.ReadDir("collections/")
+	if root == "" {
+		root = DefaultRoot
+	}
+
+	files, err := ioutil.ReadDir(root)
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "no such file or directory") {
 			err = nil
@@ -285,17 +499,30 @@ func FilesystemCollectionsInfo() (collectionsInfo CollectionsInfo, err error) {
 	if err == nil {
 		for _, file := range files {
 			if file.IsDir() {
-				fileCollection := FilesystemCollection{Name: file.Name()}
-				ids, idsError := fileCollection.getIds()
-				if idsError != nil {
-					err = idsError
-					return
+				entries := 0
+				if IsLogCollection(root, file.Name()) {
+					logCollection, openError := OpenLogCollection(root, file.Name())
+					if openError != nil {
+						err = openError
+						return
+					}
+
+					entries = logCollection.Count()
+				} else {
+					fileCollection := FilesystemCollection{Root: root, Name: file.Name()}
+					ids, idsError := fileCollection.getIds()
+					if idsError != nil {
+						err = idsError
+						return
+					}
+
+					entries = len(ids)
 				}
 
 				collectionsInfo = append(collectionsInfo, CollectionInfo{
 					Name:    file.Name(),
 					Path:    "/" + file.Name() + "/",
-					Entries: len(ids),
+					Entries: entries,
 				})
 			}
 		}
@@ -303,3 +530,42 @@ func FilesystemCollectionsInfo() (collectionsInfo CollectionsInfo, err error) {
 
 	return
 }
+
+// RemoveExpired deletes the entries whose expiry time has passed.
+func (collection FilesystemCollection) RemoveExpired() (removed int, err error) {
+	unlock, err := collection.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	ids, err := collection.getIds()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		raw, readError := collection.readRaw(id)
+		if _, ok := readError.(EntryDoesNotExistError); ok {
+			continue
+		}
+		if readError != nil {
+			err = readError
+			return
+		}
+
+		if !documentExpired(raw, now) {
+			continue
+		}
+
+		err = collection.remove(id, raw)
+		if err != nil {
+			return
+		}
+
+		removed++
+	}
+
+	return
+}
@@ -0,0 +1,747 @@
+package collection
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Operator string
+
+const (
+	OperatorEqual              Operator = "$eq"
+	OperatorNotEqual           Operator = "$ne"
+	OperatorGreaterThan        Operator = "$gt"
+	OperatorGreaterThanOrEqual Operator = "$gte"
+	OperatorLessThan           Operator = "$lt"
+	OperatorLessThanOrEqual    Operator = "$lte"
+	OperatorIn                 Operator = "$in"
+	OperatorNotIn              Operator = "$nin"
+	OperatorExists             Operator = "$exists"
+	OperatorPrefix             Operator = "$prefix"
+	OperatorContains           Operator = "$contains"
+	OperatorRegex              Operator = "$regex"
+)
+
+var Operators = []Operator{
+	OperatorEqual,
+	OperatorNotEqual,
+	OperatorGreaterThan,
+	OperatorGreaterThanOrEqual,
+	OperatorLessThan,
+	OperatorLessThanOrEqual,
+	OperatorIn,
+	OperatorNotIn,
+	OperatorExists,
+	OperatorPrefix,
+	OperatorContains,
+	OperatorRegex,
+}
+
+func ParseOperator(name string) (operator Operator, err error) {
+	for _, operator = range Operators {
+		if string(operator) == name {
+			return
+		}
+	}
+
+	err = UnknownOperatorError{Operator: name}
+	return
+}
+
+type UnknownOperatorError struct {
+	Operator string
+}
+
+func (err UnknownOperatorError) Error() string {
+	return "Unknown filter operator " + err.Operator
+}
+
+// Condition can be used as a filter value, in a map filter or as the type of
+// a struct filter field, to compare an entry field with something else than
+// plain equality.
+type Condition struct {
+	Operator Operator
+	Value    interface{}
+}
+
+// Conditions requires all of its conditions to pass, e.g. to express a range.
+type Conditions []Condition
+
+func Eq(value interface{}) Condition {
+	return Condition{Operator: OperatorEqual, Value: value}
+}
+
+func Ne(value interface{}) Condition {
+	return Condition{Operator: OperatorNotEqual, Value: value}
+}
+
+func Gt(value interface{}) Condition {
+	return Condition{Operator: OperatorGreaterThan, Value: value}
+}
+
+func Gte(value interface{}) Condition {
+	return Condition{Operator: OperatorGreaterThanOrEqual, Value: value}
+}
+
+func Lt(value interface{}) Condition {
+	return Condition{Operator: OperatorLessThan, Value: value}
+}
+
+func Lte(value interface{}) Condition {
+	return Condition{Operator: OperatorLessThanOrEqual, Value: value}
+}
+
+func In(values ...interface{}) Condition {
+	return Condition{Operator: OperatorIn, Value: values}
+}
+
+func Nin(values ...interface{}) Condition {
+	return Condition{Operator: OperatorNotIn, Value: values}
+}
+
+func Exists(exists bool) Condition {
+	return Condition{Operator: OperatorExists, Value: exists}
+}
+
+func HasPrefix(prefix string) Condition {
+	return Condition{Operator: OperatorPrefix, Value: prefix}
+}
+
+func Contains(substring string) Condition {
+	return Condition{Operator: OperatorContains, Value: substring}
+}
+
+func Matches(pattern string) Condition {
+	return Condition{Operator: OperatorRegex, Value: pattern}
+}
+
+// UntypedValue is a filter value without a JSON type, e.g. read from a query
+// string. It is converted to the type of the entry field it is compared to so
+// that "42" matches the number 42, "true" the boolean true and "null" a null
+// or missing field.
+type UntypedValue string
+
+const nullValue = UntypedValue("null")
+
+func (value UntypedValue) coerce(entryValue interface{}) interface{} {
+	switch entryValue.(type) {
+	case float64:
+		if number, err := strconv.ParseFloat(string(value), 64); err == nil {
+			return number
+		}
+	case bool:
+		if boolean, err := strconv.ParseBool(string(value)); err == nil {
+			return boolean
+		}
+	}
+
+	return string(value)
+}
+
+func coerceValue(filterValue interface{}, entryValue interface{}) interface{} {
+	if untyped, ok := filterValue.(UntypedValue); ok {
+		return untyped.coerce(entryValue)
+	}
+
+	return filterValue
+}
+
+func isNullValue(value interface{}) bool {
+	return value == nil || value == nullValue
+}
+
+var conditionType = reflect.TypeOf(Condition{})
+var conditionsType = reflect.TypeOf(Conditions{})
+
+// normalizeValue converts a Go value to the representation it would have
+// after being stored as JSON and read back into an interface{}.
+func normalizeValue(value interface{}) (normalized interface{}, ok bool) {
+	switch value.(type) {
+	case nil, string, float64, bool, UntypedValue:
+		return value, true
+	}
+
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(serialized, &normalized)
+	return normalized, err == nil
+}
+
+func normalizeField(field reflect.Value) (normalized interface{}, exists bool) {
+	if !field.IsValid() {
+		return
+	}
+
+	if (field.Kind() == reflect.Interface || field.Kind() == reflect.Ptr) && field.IsNil() {
+		return
+	}
+
+	return normalizeValue(field.Interface())
+}
+
+// compareValues orders two normalized values. Strings are compared as times
+// when both are RFC 3339 timestamps and as numbers when compared to a number.
+func compareValues(a interface{}, b interface{}) (result int, ok bool) {
+	switch aTyped := a.(type) {
+	case float64:
+		switch bTyped := b.(type) {
+		case float64:
+			return compareFloats(aTyped, bTyped), true
+		case string:
+			if bFloat, err := strconv.ParseFloat(bTyped, 64); err == nil {
+				return compareFloats(aTyped, bFloat), true
+			}
+		}
+	case string:
+		switch bTyped := b.(type) {
+		case string:
+			aTime, aError := time.Parse(time.RFC3339Nano, aTyped)
+			bTime, bError := time.Parse(time.RFC3339Nano, bTyped)
+			if aError == nil && bError == nil {
+				if aTime.Before(bTime) {
+					return -1, true
+				} else if aTime.After(bTime) {
+					return 1, true
+				}
+				return 0, true
+			}
+
+			return strings.Compare(aTyped, bTyped), true
+		case float64:
+			if aFloat, err := strconv.ParseFloat(aTyped, 64); err == nil {
+				return compareFloats(aFloat, bTyped), true
+			}
+		}
+	case bool:
+		if bTyped, isBool := b.(bool); isBool {
+			if aTyped == bTyped {
+				return 0, true
+			} else if bTyped {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	return
+}
+
+func compareFloats(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+func valuesEqual(a interface{}, b interface{}) bool {
+	if result, ok := compareValues(a, b); ok {
+		return result == 0
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// matchesValue reports whether a normalized entry value matches a normalized
+// filter value. An entry array matches a scalar it contains and an array
+// holding all of the filter elements, an entry object matches an object with
+// a subset of its fields.
+func matchesValue(entryValue interface{}, filterValue interface{}) bool {
+	switch filterTyped := filterValue.(type) {
+	case []interface{}:
+		entryArray, isArray := entryValue.([]interface{})
+		if !isArray {
+			return false
+		}
+
+		for _, filterElement := range filterTyped {
+			found := false
+			for _, entryElement := range entryArray {
+				if matchesValue(entryElement, filterElement) {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return false
+			}
+		}
+
+		return true
+	case map[string]interface{}:
+		entryObject, isObject := entryValue.(map[string]interface{})
+		if !isObject {
+			return false
+		}
+
+		for key, filterElement := range filterTyped {
+			entryElement, exists := entryObject[key]
+			if !exists || !matchesValue(entryElement, filterElement) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if entryArray, isArray := entryValue.([]interface{}); isArray {
+		for _, entryElement := range entryArray {
+			if matchesValue(entryElement, filterValue) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return valuesEqual(entryValue, coerceValue(filterValue, entryValue))
+}
+
+func conditionValues(value interface{}) (values []interface{}) {
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return []interface{}{value}
+	}
+
+	for i := 0; i < reflected.Len(); i++ {
+		values = append(values, reflected.Index(i).Interface())
+	}
+
+	return
+}
+
+func (condition Condition) passes(entryField reflect.Value, patterns map[string]*regexp.Regexp) bool {
+	entryValue, exists := normalizeField(entryField)
+
+	switch condition.Operator {
+	case "":
+		return true
+	case OperatorExists:
+		expected, _ := condition.Value.(bool)
+		return exists == expected
+	case OperatorNotEqual:
+		return !Eq(condition.Value).passes(entryField, patterns)
+	case OperatorNotIn:
+		return !In(conditionValues(condition.Value)...).passes(entryField, patterns)
+	}
+
+	if !exists {
+		switch condition.Operator {
+		case OperatorEqual:
+			return isNullValue(condition.Value)
+		case OperatorIn:
+			for _, value := range conditionValues(condition.Value) {
+				if isNullValue(value) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	switch condition.Operator {
+	case OperatorEqual:
+		filterValue, ok := normalizeValue(condition.Value)
+		return ok && matchesValue(entryValue, filterValue)
+	case OperatorIn:
+		for _, value := range conditionValues(condition.Value) {
+			filterValue, ok := normalizeValue(value)
+			if ok && matchesValue(entryValue, filterValue) {
+				return true
+			}
+		}
+		return false
+	case OperatorGreaterThan, OperatorGreaterThanOrEqual, OperatorLessThan, OperatorLessThanOrEqual:
+		filterValue, ok := normalizeValue(condition.Value)
+		if !ok {
+			return false
+		}
+
+		result, comparable := compareValues(entryValue, coerceValue(filterValue, entryValue))
+		if !comparable {
+			return false
+		}
+
+		switch condition.Operator {
+		case OperatorGreaterThan:
+			return result > 0
+		case OperatorGreaterThanOrEqual:
+			return result >= 0
+		case OperatorLessThan:
+			return result < 0
+		}
+		return result <= 0
+	case OperatorPrefix, OperatorContains, OperatorRegex:
+		entryString, isString := entryValue.(string)
+		filterString, filterIsString := condition.Value.(string)
+		if !isString || !filterIsString {
+			return false
+		}
+
+		switch condition.Operator {
+		case OperatorPrefix:
+			return strings.HasPrefix(entryString, filterString)
+		case OperatorContains:
+			return strings.Contains(entryString, filterString)
+		}
+
+		pattern := patterns[filterString]
+		return pattern != nil && pattern.MatchString(entryString)
+	}
+
+	return false
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// isNestedFilter reports whether a filter value is matched field by field
+// rather than as a single JSON value, which is the case for structs and maps
+// that are not serialized as something else, e.g. time.Time.
+func isNestedFilter(filterType reflect.Type) bool {
+	if filterType.Implements(jsonMarshalerType) || filterType.Implements(textMarshalerType) {
+		return false
+	}
+
+	if filterType.Kind() == reflect.Struct {
+		return true
+	}
+
+	return filterType.Kind() == reflect.Map && filterType.Key().Kind() == reflect.String
+}
+
+func isZeroValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return value.IsNil() || (value.Kind() != reflect.Ptr && value.Kind() != reflect.Interface && value.Len() == 0)
+	}
+
+	return reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface())
+}
+
+// checkIfElementPasses matches an entry field against a filter field. Zero
+// filter values do not restrict the entries, unless they are pointed to, so
+// that e.g. a *bool filter field can require an entry field to be false. A nil
+// value in a map filter requires the entry field to be null or missing.
+func checkIfElementPasses(filterField reflect.Value, entryField reflect.Value, patterns map[string]*regexp.Regexp) bool {
+	if !filterField.IsValid() {
+		_, exists := normalizeField(entryField)
+		return !exists
+	}
+
+	switch filterField.Type() {
+	case conditionType:
+		return filterField.Interface().(Condition).passes(entryField, patterns)
+	case conditionsType:
+		for _, condition := range filterField.Interface().(Conditions) {
+			if !condition.passes(entryField, patterns) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if isZeroValue(filterField) {
+		return true
+	}
+
+	if filterField.Kind() == reflect.Ptr || filterField.Kind() == reflect.Interface {
+		filterField = filterField.Elem()
+	}
+
+	return checkIfValuePasses(filterField, entryField, patterns)
+}
+
+func checkIfValuePasses(filterField reflect.Value, entryField reflect.Value, patterns map[string]*regexp.Regexp) bool {
+	if filterField.Type() == conditionType || filterField.Type() == conditionsType {
+		return checkIfElementPasses(filterField, entryField, patterns)
+	}
+
+	if isNestedFilter(filterField.Type()) {
+		return passesFilter(filterField, entryField, patterns)
+	}
+
+	filterValue, ok := normalizeValue(filterField.Interface())
+	if !ok {
+		return false
+	}
+
+	entryValue, exists := normalizeField(entryField)
+	if !exists {
+		return isNullValue(filterValue)
+	}
+
+	return matchesValue(entryValue, filterValue)
+}
+
+type namedField struct {
+	name  string
+	value reflect.Value
+}
+
+// jsonFields returns the fields of a struct under the names they are stored
+// as, i.e. following json struct tags, with the fields of embedded structs
+// promoted like encoding/json does. Unexported fields and fields tagged with
+// json:"-" are left out.
+func jsonFields(value reflect.Value) (fields []namedField) {
+	embedded := []reflect.Value{}
+
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		field := value.Field(i)
+
+		tag := structField.Tag.Get("json")
+		if structField.PkgPath != "" || tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if name == "" && structField.Anonymous {
+			if field.Kind() == reflect.Ptr && !field.IsNil() {
+				field = field.Elem()
+			}
+
+			if field.Kind() == reflect.Struct && isNestedFilter(field.Type()) {
+				embedded = append(embedded, field)
+				continue
+			}
+		}
+
+		if name == "" {
+			name = structField.Name
+		}
+
+		fields = append(fields, namedField{name: name, value: field})
+	}
+
+	for _, field := range embedded {
+		fields = append(fields, jsonFields(field)...)
+	}
+
+	return
+}
+
+// lookupField returns the named field of a struct or map entry, or the
+// element of an array entry at a numeric name, or an invalid value if the
+// entry does not have it.
+func lookupField(entry reflect.Value, name string) (field reflect.Value) {
+	for entry.Kind() == reflect.Ptr || entry.Kind() == reflect.Interface {
+		if entry.IsNil() {
+			return
+		}
+		entry = entry.Elem()
+	}
+
+	if entry.Kind() == reflect.Struct {
+		for _, candidate := range jsonFields(entry) {
+			if candidate.name == name {
+				field = candidate.value
+				break
+			}
+		}
+	} else if entry.Kind() == reflect.Map && entry.Type().Key().Kind() == reflect.String {
+		field = entry.MapIndex(reflect.ValueOf(name).Convert(entry.Type().Key()))
+	} else if entry.Kind() == reflect.Slice || entry.Kind() == reflect.Array {
+		index, err := strconv.Atoi(name)
+		if err == nil && index >= 0 && index < entry.Len() {
+			field = entry.Index(index)
+		}
+	}
+
+	if field.IsValid() && field.Kind() == reflect.Interface {
+		field = field.Elem()
+	}
+
+	return
+}
+
+// lookupPath returns the field at a dotted path such as Address.City or
+// Tags.0, where numeric parts index arrays. A field named by the whole path,
+// dots included, takes precedence.
+func lookupPath(entry reflect.Value, path string) (field reflect.Value) {
+	field = lookupField(entry, path)
+	if field.IsValid() {
+		return
+	}
+
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+
+		parent := lookupField(entry, path[:i])
+		if !parent.IsValid() {
+			continue
+		}
+
+		field = lookupPath(parent, path[i+1:])
+		if field.IsValid() {
+			return
+		}
+	}
+
+	return
+}
+
+func passesFilter(filter reflect.Value, entry reflect.Value, patterns map[string]*regexp.Regexp) bool {
+	for entry.Kind() == reflect.Ptr || entry.Kind() == reflect.Interface {
+		if entry.IsNil() {
+			break
+		}
+		entry = entry.Elem()
+	}
+
+	if entry.Kind() != reflect.Struct && entry.Kind() != reflect.Map {
+		entry = reflect.Value{}
+	}
+
+	if filter.Kind() == reflect.Struct {
+		for _, filterField := range jsonFields(filter) {
+			if !checkIfElementPasses(filterField.value, lookupField(entry, filterField.name), patterns) {
+				return false
+			}
+		}
+
+		return true
+	} else if filter.Kind() == reflect.Map {
+		for _, key := range filter.MapKeys() {
+			filterField := filter.MapIndex(key)
+			if filterField.Kind() == reflect.Interface {
+				filterField = filterField.Elem()
+			}
+
+			if !checkIfElementPasses(filterField, lookupPath(entry, key.String()), patterns) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+type InvalidPatternError struct {
+	Pattern string
+	Message string
+}
+
+func (err InvalidPatternError) Error() string {
+	return "Invalid regular expression \"" + err.Pattern + "\": " + err.Message
+}
+
+// preparedFilter is a filter with its regular expressions compiled, so that
+// a query compiles them once instead of once per entry.
+type preparedFilter struct {
+	filter   interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+func prepareFilter(filter interface{}) (prepared preparedFilter, err error) {
+	prepared = preparedFilter{filter: filter, patterns: map[string]*regexp.Regexp{}}
+
+	for _, value := range FilterFields(filter) {
+		conditions := Conditions{}
+		switch typed := value.(type) {
+		case Condition:
+			conditions = Conditions{typed}
+		case *Condition:
+			conditions = Conditions{*typed}
+		case Conditions:
+			conditions = typed
+		case *Conditions:
+			conditions = *typed
+		}
+
+		for _, condition := range conditions {
+			pattern, isString := condition.Value.(string)
+			if condition.Operator != OperatorRegex || !isString || prepared.patterns[pattern] != nil {
+				continue
+			}
+
+			compiled, compileError := regexp.Compile(pattern)
+			if compileError != nil {
+				err = InvalidPatternError{Pattern: pattern, Message: compileError.Error()}
+				return
+			}
+			prepared.patterns[pattern] = compiled
+		}
+	}
+
+	return
+}
+
+// passes reports whether the entry passes the filter, a nil filter lets every
+// entry pass.
+func (prepared preparedFilter) passes(entry reflect.Value) bool {
+	return prepared.filter == nil || passesFilter(reflect.ValueOf(prepared.filter), entry, prepared.patterns)
+}
+
+// FilterFields returns the fields of a struct or map filter that restrict the
+// entries by their JSON names, leaving out zero values and flattening
+// embedded structs. Nested struct and map filters are flattened into dotted
+// paths. It is used to send filters to other stores, e.g. as query parameters.
+func FilterFields(filter interface{}) (fields map[string]interface{}) {
+	fields = map[string]interface{}{}
+	collectFilterFields(reflect.ValueOf(filter), "", fields)
+	return
+}
+
+func collectFilterFields(filter reflect.Value, prefix string, fields map[string]interface{}) {
+	if filter.Kind() == reflect.Struct {
+		for _, filterField := range jsonFields(filter) {
+			collectFilterField(filterField.value, prefix+filterField.name, fields)
+		}
+	} else if filter.Kind() == reflect.Map {
+		for _, key := range filter.MapKeys() {
+			filterField := filter.MapIndex(key)
+			if filterField.Kind() == reflect.Interface {
+				filterField = filterField.Elem()
+			}
+
+			collectFilterField(filterField, prefix+key.String(), fields)
+		}
+	}
+}
+
+// collectFilterField leaves out zero values like checkIfElementPasses, a nil
+// map value is kept since it requires the field to be null or missing.
+func collectFilterField(filterField reflect.Value, path string, fields map[string]interface{}) {
+	if !filterField.IsValid() {
+		fields[path] = nil
+		return
+	}
+
+	if isZeroValue(filterField) {
+		return
+	}
+
+	if filterField.Kind() == reflect.Interface {
+		filterField = filterField.Elem()
+	}
+
+	nested := filterField
+	if nested.Kind() == reflect.Ptr {
+		nested = nested.Elem()
+	}
+
+	if nested.Type() != conditionType && isNestedFilter(nested.Type()) {
+		collectFilterFields(nested, path+".", fields)
+		return
+	}
+
+	fields[path] = filterField.Interface()
+}
@@ -0,0 +1,353 @@
+package collection
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const historyDirectoryName = "_history"
+const historyFileSuffix = ".history.json"
+
+// UnlimitedHistory keeps every revision of the entries, see
+// HistoryKeeper.SetHistoryRetention.
+const UnlimitedHistory = -1
+
+type RevisionDoesNotExistError struct {
+	ID       uuid.UUID
+	Revision uint64
+}
+
+func (err RevisionDoesNotExistError) Error() string {
+	return "Revision " + strconv.FormatUint(err.Revision, 10) + " of entry " + err.ID.String() + " does not exist"
+}
+
+// HistoryRecord is a revision of an entry. WrittenAt is nil for a revision
+// that was written before the collection kept history, Deleted records mark
+// that the entry was deleted and hold the deleted entry.
+type HistoryRecord struct {
+	Revision  uint64          `json:"revision"`
+	WrittenAt *time.Time      `json:"writtenAt,omitempty"`
+	Deleted   bool            `json:"deleted,omitempty"`
+	Entry     json.RawMessage `json:"entry"`
+}
+
+// Historian is implemented by collections that can read the previous
+// revisions of their entries. Revert stores an old revision as a new one, like
+// Patch it checks the revision of entry, if any, and loads the result into it
+// unless entry is nil.
+type Historian interface {
+	History(id uuid.UUID) ([]HistoryRecord, error)
+	LoadRevision(id uuid.UUID, revision uint64, entry Entry) error
+	LoadAsOf(id uuid.UUID, at time.Time, entry Entry) error
+	Revert(id uuid.UUID, revision uint64, entry Entry) error
+}
+
+// HistoryKeeper is implemented by collections where keeping history can be
+// turned on. The retention is the number of previous revisions kept for each
+// entry, 0 turns history off and removes it and a negative number keeps every
+// revision. A lower retention takes effect for an entry the next time it is
+// written.
+type HistoryKeeper interface {
+	SetHistoryRetention(revisions int) error
+	HistoryRetention() (int, error)
+}
+
+// appendHistory adds the write that replaced previous with document, nil when
+// the entry was deleted, to the records and drops the records that are no
+// longer retained.
+func appendHistory(records []HistoryRecord, previous []byte, document []byte, retention int, now time.Time) []HistoryRecord {
+	if len(records) == 0 && previous != nil {
+		records = append(records, HistoryRecord{Revision: documentRevision(parseDocument(previous)), Entry: previous})
+	}
+
+	record := HistoryRecord{WrittenAt: &now, Entry: document}
+	if document == nil {
+		record.Revision = documentRevision(parseDocument(previous))
+		record.Deleted = true
+		record.Entry = previous
+	} else {
+		record.Revision = documentRevision(parseDocument(document))
+	}
+
+	// A batch that is rolled forward is written again, but it is still the
+	// same revision.
+	if last := len(records) - 1; last >= 0 && records[last].Revision == record.Revision && records[last].Deleted == record.Deleted {
+		records = records[:last]
+	}
+	records = append(records, record)
+
+	if retention >= 0 && len(records) > retention+1 {
+		records = records[len(records)-retention-1:]
+	}
+
+	return records
+}
+
+// historyOrCurrent returns the records, or the current entry if it was never
+// written while history was kept.
+func historyOrCurrent(records []HistoryRecord, current []byte, err error) ([]HistoryRecord, error) {
+	if len(records) > 0 {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []HistoryRecord{{Revision: documentRevision(parseDocument(current)), Entry: current}}, nil
+}
+
+// findRevision returns the latest record of the revision, revisions start
+// over from 1 when an entry is deleted and created again.
+func findRevision(records []HistoryRecord, id uuid.UUID, revision uint64) (raw []byte, err error) {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Revision == revision && !records[i].Deleted {
+			return records[i].Entry, nil
+		}
+	}
+
+	err = RevisionDoesNotExistError{ID: id, Revision: revision}
+	return
+}
+
+// findAsOf returns the revision that was stored at the time.
+func findAsOf(records []HistoryRecord, at time.Time) (raw []byte, err error) {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].WrittenAt != nil && records[i].WrittenAt.After(at) {
+			continue
+		}
+
+		if records[i].Deleted {
+			break
+		}
+
+		return records[i].Entry, nil
+	}
+
+	err = EntryDoesNotExistError{}
+	return
+}
+
+// revert stores the revision of the entry, found in history, as a new revision
+// in the collection.
+func revert(collection Collection, history func(id uuid.UUID) ([]HistoryRecord, error), id uuid.UUID, revision uint64, entry Entry) (err error) {
+	records, err := history(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findRevision(records, id, revision)
+	if err != nil {
+		return
+	}
+
+	restored := UntypedEntry{}
+	err = json.Unmarshal(raw, &restored)
+	if err != nil {
+		return
+	}
+
+	delete(restored, RevisionField)
+	restored.SetID(id)
+	if entry != nil {
+		restored.SetRevision(getExpectedRevision(entry))
+		if restored.GetRevision() == 0 {
+			delete(restored, RevisionField)
+		}
+	}
+
+	_, err = collection.Upsert(&restored)
+	if err != nil || entry == nil {
+		return
+	}
+
+	serialized, err := json.Marshal(restored)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(serialized, entry)
+	return
+}
+
+// historyFilename returns the history settings of a collection directory,
+// which are kept next to the directory like the lock file.
+func historyFilename(directory string) string {
+	return filepath.Join(filepath.Dir(directory), "."+filepath.Base(directory)+historyFileSuffix)
+}
+
+type historySettings struct {
+	Revisions int `json:"revisions"`
+}
+
+func (collection FilesystemCollection) getHistoryDirectory() string {
+	return filepath.Join(collection.getDirectory(), historyDirectoryName)
+}
+
+func (collection FilesystemCollection) getHistoryFilename(id uuid.UUID) string {
+	return filepath.Join(collection.getHistoryDirectory(), id.String()+".json")
+}
+
+func (collection FilesystemCollection) readHistoryRetention() (revisions int, err error) {
+	raw, err := ioutil.ReadFile(historyFilename(collection.getDirectory()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	settings := historySettings{}
+	err = json.Unmarshal(raw, &settings)
+	revisions = settings.Revisions
+	return
+}
+
+func (collection FilesystemCollection) readHistory(id uuid.UUID) (records []HistoryRecord, err error) {
+	raw, err := ioutil.ReadFile(collection.getHistoryFilename(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = json.Unmarshal(raw, &records)
+	return
+}
+
+// recordHistory adds a write to the history of the entry if the collection
+// keeps history, the caller is expected to hold the collection lock. It is
+// called once the write is durable, so a failure is logged rather than
+// reported as a failed write.
+func (collection FilesystemCollection) recordHistory(id uuid.UUID, previous []byte, document []byte) {
+	err := collection.writeHistory(id, previous, document)
+	if err != nil {
+		log.Println("Failed to record history of entry", id, "in collection", collection.GetName(), ":", err)
+	}
+}
+
+func (collection FilesystemCollection) writeHistory(id uuid.UUID, previous []byte, document []byte) (err error) {
+	retention, err := collection.readHistoryRetention()
+	if err != nil || retention == 0 {
+		return
+	}
+
+	records, err := collection.readHistory(id)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(collection.getHistoryDirectory(), 0700)
+	if err != nil {
+		return
+	}
+
+	serialized, err := json.Marshal(appendHistory(records, previous, document, retention, time.Now()))
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomically(collection.getHistoryFilename(id), serialized, 0600)
+	return
+}
+
+func (collection FilesystemCollection) SetHistoryRetention(revisions int) (err error) {
+	lock := collection.createAndLock
+	if revisions == 0 {
+		lock = collection.lock
+	}
+
+	unlock, err := lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	if revisions == 0 {
+		err = os.Remove(historyFilename(collection.getDirectory()))
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+
+		err = os.RemoveAll(collection.getHistoryDirectory())
+		return
+	}
+
+	serialized, err := json.Marshal(historySettings{Revisions: revisions})
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomically(historyFilename(collection.getDirectory()), serialized, 0600)
+	return
+}
+
+func (collection FilesystemCollection) HistoryRetention() (revisions int, err error) {
+	unlock, err := collection.rlock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	return collection.readHistoryRetention()
+}
+
+// History returns the stored revisions of the entry, oldest first.
+func (collection FilesystemCollection) History(id uuid.UUID) (records []HistoryRecord, err error) {
+	unlock, err := collection.rlock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	records, err = collection.readHistory(id)
+	if err != nil {
+		return
+	}
+
+	current, err := collection.loadRaw(id)
+	return historyOrCurrent(records, current, err)
+}
+
+func (collection FilesystemCollection) LoadRevision(id uuid.UUID, revision uint64, entry Entry) (err error) {
+	records, err := collection.History(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findRevision(records, id, revision)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+// LoadAsOf loads the revision of the entry that was stored at the time.
+func (collection FilesystemCollection) LoadAsOf(id uuid.UUID, at time.Time, entry Entry) (err error) {
+	records, err := collection.History(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findAsOf(records, at)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+func (collection FilesystemCollection) Revert(id uuid.UUID, revision uint64, entry Entry) error {
+	return revert(collection, collection.History, id, revision, entry)
+}
@@ -0,0 +1,626 @@
+package collection
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const indexDirectoryName = "_indexes"
+
+type InvalidIndexFieldError struct {
+	Field string
+}
+
+func (err InvalidIndexFieldError) Error() string {
+	return "Field \"" + err.Field + "\" cannot be indexed"
+}
+
+type IndexDoesNotExistError struct {
+	Field          string
+	CollectionName string
+}
+
+func (err IndexDoesNotExistError) Error() string {
+	return "Index " + err.CollectionName + "/" + err.Field + " does not exist"
+}
+
+// Indexer is implemented by collections that support secondary indexes.
+type Indexer interface {
+	CreateIndex(field string) error
+	DropIndex(field string) error
+	Indexes() ([]string, error)
+}
+
+func validateIndexField(field string) error {
+	if field == "" || strings.HasPrefix(field, ".") || strings.ContainsAny(field, "/\\") {
+		return InvalidIndexFieldError{Field: field}
+	}
+
+	return nil
+}
+
+const nanIndexKey = "n:NaN"
+
+// indexKey returns the key a value is stored under in an index. Values that
+// compareValues finds equal get the same key, so numbers and strings holding
+// numbers are keyed by the number and strings holding RFC 3339 times by the
+// time in UTC. Only scalar values can be indexed.
+func indexKey(value interface{}) (key string, ok bool) {
+	normalized, ok := normalizeValue(value)
+	if !ok {
+		return
+	}
+
+	switch typed := normalized.(type) {
+	case bool:
+		key = "b:" + strconv.FormatBool(typed)
+	case float64:
+		key = numberIndexKey(typed)
+	case string:
+		if at, err := time.Parse(time.RFC3339Nano, typed); err == nil {
+			key = "t:" + at.UTC().Format(time.RFC3339Nano)
+		} else if number, err := strconv.ParseFloat(typed, 64); err == nil {
+			key = numberIndexKey(number)
+		} else {
+			key = "s:" + typed
+		}
+	default:
+		ok = false
+	}
+
+	return
+}
+
+func numberIndexKey(number float64) string {
+	if math.IsNaN(number) {
+		return nanIndexKey
+	}
+
+	return "n:" + strconv.FormatFloat(number, 'g', -1, 64)
+}
+
+// documentIndexKeys returns the keys a document is stored under in the index
+// of a field, which is one key per element for arrays so that filters
+// matching entries containing a value can use the index.
+func documentIndexKeys(document map[string]interface{}, field string) (keys []string) {
+	value, exists := normalizeField(lookupPath(reflect.ValueOf(document), field))
+	if !exists {
+		return
+	}
+
+	values := []interface{}{value}
+	if array, isArray := value.([]interface{}); isArray {
+		values = array
+	}
+
+	for _, element := range values {
+		if key, ok := indexKey(element); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return
+}
+
+func parseDocument(raw []byte) (document map[string]interface{}) {
+	if raw == nil {
+		return
+	}
+
+	json.Unmarshal(raw, &document)
+	return
+}
+
+func (collection FilesystemCollection) getIndexDirectory() string {
+	return filepath.Join(collection.getDirectory(), indexDirectoryName)
+}
+
+// getIndexFieldDirectory returns the directory of the index of a field. It
+// holds a directory for every indexed value, named after a hash of the index
+// key, with an empty file for each entry that holds the value. That way an
+// entry is added to and removed from an index without rewriting it.
+func (collection FilesystemCollection) getIndexFieldDirectory(field string) string {
+	return filepath.Join(collection.getIndexDirectory(), field)
+}
+
+func indexKeyDirectory(fieldDirectory string, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(fieldDirectory, hex.EncodeToString(hash[:]))
+}
+
+func (collection FilesystemCollection) getIndexedFields() (fields []string, err error) {
+	files, err := ioutil.ReadDir(collection.getIndexDirectory())
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "no such file or directory") {
+			err = nil
+		}
+		return
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || isTemporaryFile(file.Name()) {
+			continue
+		}
+
+		fields = append(fields, file.Name())
+	}
+
+	return
+}
+
+// lookupIndex returns the ids stored under the key in the index of a field.
+func (collection FilesystemCollection) lookupIndex(field string, key string) (ids []string, err error) {
+	files, err := ioutil.ReadDir(indexKeyDirectory(collection.getIndexFieldDirectory(field), key))
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "no such file or directory") {
+			err = nil
+		}
+		return
+	}
+
+	for _, file := range files {
+		ids = append(ids, file.Name())
+	}
+
+	return
+}
+
+// addToIndex stores the id under the key, sync makes sure that the new index
+// entry is on disk before the entry is written.
+func addToIndex(fieldDirectory string, key string, id uuid.UUID, sync bool) (err error) {
+	keyDirectory := indexKeyDirectory(fieldDirectory, key)
+	_, statError := os.Stat(keyDirectory)
+	created := os.IsNotExist(statError)
+
+	err = os.MkdirAll(keyDirectory, 0700)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(keyDirectory, id.String()), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	err = file.Close()
+	if err != nil || !sync {
+		return
+	}
+
+	err = syncDirectory(keyDirectory)
+	if err == nil && created {
+		err = syncDirectory(fieldDirectory)
+	}
+
+	return
+}
+
+// removeFromIndex removes the id from the key and the key once no entry holds
+// it anymore.
+func removeFromIndex(fieldDirectory string, key string, id uuid.UUID) (err error) {
+	keyDirectory := indexKeyDirectory(fieldDirectory, key)
+	err = os.Remove(filepath.Join(keyDirectory, id.String()))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	// Fails, and leaves the key, as long as other entries hold the value.
+	os.Remove(keyDirectory)
+	return
+}
+
+// buildIndex indexes the field of every stored entry into a new directory and
+// returns it, the caller moves it into place.
+func (collection FilesystemCollection) buildIndex(field string) (directory string, err error) {
+	err = os.MkdirAll(collection.getIndexDirectory(), 0700)
+	if err != nil {
+		return
+	}
+
+	directory, err = ioutil.TempDir(collection.getIndexDirectory(), temporaryFilePrefix+field+"-")
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(directory)
+		}
+	}()
+
+	ids, err := collection.getIds()
+	if err != nil {
+		return
+	}
+
+	keyDirectories := map[string]bool{}
+	for _, id := range ids {
+		raw, loadError := collection.loadRaw(id)
+		if _, ok := loadError.(EntryDoesNotExistError); ok {
+			continue
+		}
+		if loadError != nil {
+			err = loadError
+			return
+		}
+
+		document := map[string]interface{}{}
+		if json.Unmarshal(raw, &document) != nil {
+			err = EntryNotParsableError{ID: id, CollectionName: collection.GetName()}
+			return
+		}
+
+		for _, key := range documentIndexKeys(document, field) {
+			err = addToIndex(directory, key, id, false)
+			if err != nil {
+				return
+			}
+			keyDirectories[indexKeyDirectory(directory, key)] = true
+		}
+	}
+
+	for keyDirectory := range keyDirectories {
+		err = syncDirectory(keyDirectory)
+		if err != nil {
+			return
+		}
+	}
+
+	err = syncDirectory(directory)
+	return
+}
+
+// replaceIndex moves a built index into place of the index of the field.
+func (collection FilesystemCollection) replaceIndex(field string, built string) (err error) {
+	fieldDirectory := collection.getIndexFieldDirectory(field)
+
+	previous := built + "-previous"
+	err = os.Rename(fieldDirectory, previous)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	err = os.Rename(built, fieldDirectory)
+	if err != nil {
+		return
+	}
+
+	err = syncDirectory(collection.getIndexDirectory())
+	if err != nil {
+		return
+	}
+
+	err = os.RemoveAll(previous)
+	return
+}
+
+// addToIndexes registers the id under the values of the new document. It is
+// called before the entry is written and removeFromIndexes after, so that an
+// interrupted write only leaves superfluous index entries behind. Those are
+// harmless since Query always applies the full filter to the loaded entries.
+func (collection FilesystemCollection) addToIndexes(id uuid.UUID, document map[string]interface{}) (err error) {
+	fields, err := collection.getIndexedFields()
+	if err != nil {
+		return
+	}
+
+	for _, field := range fields {
+		for _, key := range documentIndexKeys(document, field) {
+			err = addToIndex(collection.getIndexFieldDirectory(field), key, id, true)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (collection FilesystemCollection) removeFromIndexes(id uuid.UUID, oldDocument map[string]interface{}, newDocument map[string]interface{}) (err error) {
+	fields, err := collection.getIndexedFields()
+	if err != nil {
+		return
+	}
+
+	for _, field := range fields {
+		newKeys := map[string]bool{}
+		for _, key := range documentIndexKeys(newDocument, field) {
+			newKeys[key] = true
+		}
+
+		for _, key := range documentIndexKeys(oldDocument, field) {
+			if newKeys[key] {
+				continue
+			}
+
+			err = removeFromIndex(collection.getIndexFieldDirectory(field), key, id)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// equalityConstraint returns the value a filter field requires an entry to be
+// equal to, or to contain, or false if the filter field does not restrict the
+// entries that way.
+func equalityConstraint(filterField reflect.Value) (value interface{}, ok bool) {
+	if !filterField.IsValid() {
+		return
+	}
+
+	if filterField.Type() == conditionType {
+		condition := filterField.Interface().(Condition)
+		return condition.Value, condition.Operator == OperatorEqual
+	}
+
+	if filterField.Type() == conditionsType {
+		for _, condition := range filterField.Interface().(Conditions) {
+			if condition.Operator == OperatorEqual {
+				return condition.Value, true
+			}
+		}
+		return
+	}
+
+	if isZeroValue(filterField) {
+		return
+	}
+
+	if filterField.Kind() == reflect.Ptr || filterField.Kind() == reflect.Interface {
+		filterField = filterField.Elem()
+	}
+
+	if isNestedFilter(filterField.Type()) || filterField.Type() == conditionType {
+		return
+	}
+
+	return filterField.Interface(), true
+}
+
+func collectEqualityConstraints(filter reflect.Value, constraints map[string]interface{}) {
+	if filter.Kind() == reflect.Struct {
+		for _, filterField := range jsonFields(filter) {
+			if value, ok := equalityConstraint(filterField.value); ok {
+				constraints[filterField.name] = value
+			}
+		}
+	} else if filter.Kind() == reflect.Map {
+		for _, key := range filter.MapKeys() {
+			filterField := filter.MapIndex(key)
+			if filterField.Kind() == reflect.Interface {
+				filterField = filterField.Elem()
+			}
+
+			if value, ok := equalityConstraint(filterField); ok {
+				constraints[key.String()] = value
+			}
+		}
+	}
+}
+
+// constraintIndexKeys returns the index keys of every value an UntypedValue
+// can be coerced to, or the single key of any other value. Entries holding
+// NaN are equal to every number, so they are looked up with any number.
+func constraintIndexKeys(value interface{}) (keys []string, ok bool) {
+	values := []interface{}{value}
+	if untyped, isUntyped := value.(UntypedValue); isUntyped {
+		if isNullValue(untyped) {
+			return
+		}
+
+		values = []interface{}{untyped.coerce(float64(0)), untyped.coerce(false), string(untyped)}
+	}
+
+	number := false
+	for _, coerced := range values {
+		key, coercedOk := indexKey(coerced)
+		if !coercedOk {
+			continue
+		}
+
+		if key == nanIndexKey {
+			return nil, false
+		}
+
+		number = number || strings.HasPrefix(key, "n:")
+		keys = append(keys, key)
+	}
+
+	if number {
+		keys = append(keys, nanIndexKey)
+	}
+
+	return keys, len(keys) > 0
+}
+
+// idConstraint returns the ID that the constraints of a filter require.
+func idConstraint(constraints map[string]interface{}) (id uuid.UUID, ok bool) {
+	switch typed := constraints["ID"].(type) {
+	case uuid.UUID:
+		return typed, true
+	case string:
+		id, err := uuid.FromString(typed)
+		return id, err == nil
+	case UntypedValue:
+		id, err := uuid.FromString(string(typed))
+		return id, err == nil
+	}
+
+	return
+}
+
+// getCandidateIds narrows down the entries that can possibly pass the filter
+// by using the ID and any declared indexes, falling back to all entries.
+func (collection FilesystemCollection) getCandidateIds(filter interface{}) (ids []uuid.UUID, err error) {
+	constraints := map[string]interface{}{}
+	collectEqualityConstraints(reflect.ValueOf(filter), constraints)
+
+	if id, ok := idConstraint(constraints); ok {
+		ids = []uuid.UUID{id}
+		return
+	}
+
+	fields, err := collection.getIndexedFields()
+	if err != nil {
+		return
+	}
+
+	return indexCandidates(constraints, fields, collection.lookupIndex, collection.getIds)
+}
+
+// indexCandidates narrows down the entries that can possibly pass the
+// equality constraints of a filter with the indexes on fields, falling back
+// to all entries.
+func indexCandidates(constraints map[string]interface{}, fields []string, lookupIndex func(field string, key string) ([]string, error), getIds func() ([]uuid.UUID, error)) (ids []uuid.UUID, err error) {
+	var candidates map[string]bool
+	for _, field := range fields {
+		value, constrained := constraints[field]
+		if !constrained {
+			continue
+		}
+
+		keys, ok := constraintIndexKeys(value)
+		if !ok {
+			continue
+		}
+
+		matches := map[string]bool{}
+		for _, key := range keys {
+			keyIds, lookupError := lookupIndex(field, key)
+			if lookupError != nil {
+				err = lookupError
+				return
+			}
+
+			for _, id := range keyIds {
+				if candidates == nil || candidates[id] {
+					matches[id] = true
+				}
+			}
+		}
+		candidates = matches
+	}
+
+	if candidates == nil {
+		return getIds()
+	}
+
+	idStrings := []string{}
+	for id := range candidates {
+		idStrings = append(idStrings, id)
+	}
+	sort.Strings(idStrings)
+
+	for _, id := range idStrings {
+		if parsed, parseError := uuid.FromString(id); parseError == nil {
+			ids = append(ids, parsed)
+		}
+	}
+
+	return
+}
+
+// CreateIndex declares an index on a field, or a dotted path into nested
+// objects, and builds it from the entries already in the collection.
+func (collection FilesystemCollection) CreateIndex(field string) (err error) {
+	err = validateIndexField(field)
+	if err != nil {
+		return
+	}
+
+	unlock, err := collection.createAndLock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	built, err := collection.buildIndex(field)
+	if err != nil {
+		return
+	}
+
+	err = collection.replaceIndex(field, built)
+	return
+}
+
+func (collection FilesystemCollection) DropIndex(field string) (err error) {
+	err = validateIndexField(field)
+	if err != nil {
+		return
+	}
+
+	unlock, err := collection.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	fieldDirectory := collection.getIndexFieldDirectory(field)
+	if _, statError := os.Stat(fieldDirectory); os.IsNotExist(statError) {
+		err = IndexDoesNotExistError{Field: field, CollectionName: collection.GetName()}
+		return
+	}
+
+	err = os.RemoveAll(fieldDirectory)
+	return
+}
+
+func (collection FilesystemCollection) Indexes() (fields []string, err error) {
+	unlock, err := collection.rlock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	fields, err = collection.getIndexedFields()
+	if fields == nil {
+		fields = []string{}
+	}
+
+	return
+}
+
+// RebuildIndexes recreates every declared index from the stored entries, e.g.
+// after entry files have been modified outside of the collection.
+func (collection FilesystemCollection) RebuildIndexes() (err error) {
+	unlock, err := collection.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	fields, err := collection.getIndexedFields()
+	if err != nil {
+		return
+	}
+
+	for _, field := range fields {
+		built, buildError := collection.buildIndex(field)
+		if buildError != nil {
+			err = buildError
+			return
+		}
+
+		err = collection.replaceIndex(field, built)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
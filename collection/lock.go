@@ -0,0 +1,118 @@
+package collection
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const lockFileSuffix = ".lock"
+
+// LockTimeout is how long a collection waits for another process to release
+// its lock before CollectionLockedError is returned.
+var LockTimeout = 30 * time.Second
+
+const lockRetryInterval = 10 * time.Millisecond
+
+type CollectionLockedError struct {
+	Directory string
+}
+
+func (err CollectionLockedError) Error() string {
+	return "Collection " + err.Directory + " is locked by another process"
+}
+
+var directoryMutexes = map[string]*sync.RWMutex{}
+var directoryMutexesMux sync.Mutex
+
+// directoryMutex returns the mutex shared by every collection value in the
+// process that uses the directory.
+func directoryMutex(directory string) *sync.RWMutex {
+	if absolute, err := filepath.Abs(directory); err == nil {
+		directory = absolute
+	}
+
+	directoryMutexesMux.Lock()
+	defer directoryMutexesMux.Unlock()
+
+	mux, exists := directoryMutexes[directory]
+	if !exists {
+		mux = &sync.RWMutex{}
+		directoryMutexes[directory] = mux
+	}
+
+	return mux
+}
+
+// lockFilename returns the file that is locked for a collection directory,
+// which is kept next to the directory so that it does not show up among the
+// entries.
+func lockFilename(directory string) string {
+	return filepath.Join(filepath.Dir(directory), "."+filepath.Base(directory)+lockFileSuffix)
+}
+
+// lockDirectory locks a collection directory within the process and, with an
+// advisory file lock, against other processes. Exclusive locks are taken for
+// writes and create the lock file, shared locks let reads run in parallel and
+// never create anything, so that collections on read-only paths can be read.
+// Neither creates the directory, writes that store data create it first, see
+// createAndLock.
+func lockDirectory(directory string, exclusive bool) (unlock func(), err error) {
+	mux := directoryMutex(directory)
+	release := mux.RUnlock
+	if exclusive {
+		mux.Lock()
+		release = mux.Unlock
+	} else {
+		mux.RLock()
+	}
+
+	var file *os.File
+	if exclusive {
+		file, err = os.OpenFile(lockFilename(directory), os.O_RDWR|os.O_CREATE, 0600)
+	} else {
+		file, err = os.Open(lockFilename(directory))
+	}
+	if os.IsNotExist(err) {
+		// Nothing has been written to the collection, or for an exclusive
+		// lock even to its root, yet.
+		return release, nil
+	}
+	if err != nil {
+		release()
+		return
+	}
+
+	err = waitForLock(file, directory, exclusive)
+	if err != nil {
+		file.Close()
+		release()
+		return
+	}
+
+	unlock = func() {
+		unlockFile(file)
+		file.Close()
+		release()
+	}
+	return
+}
+
+// waitForLock retries the file lock until LockTimeout has passed.
+func waitForLock(file *os.File, directory string, exclusive bool) (err error) {
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err = lockFile(file, exclusive)
+		if _, locked := err.(CollectionLockedError); !locked {
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			err = CollectionLockedError{Directory: directory}
+			return
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package collection
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on the file without waiting,
+// CollectionLockedError is returned if another process holds it.
+func lockFile(file *os.File, exclusive bool) (err error) {
+	how := syscall.LOCK_SH | syscall.LOCK_NB
+	if exclusive {
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+
+	err = syscall.Flock(int(file.Fd()), how)
+	if err == syscall.EWOULDBLOCK {
+		err = CollectionLockedError{Directory: filepath.Dir(file.Name())}
+	}
+
+	return
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,91 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package collection_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mojlighetsministeriet/storage/collection"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogCollectionLockedByAnotherProcess(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	lockFile, err := os.OpenFile(filepath.Join(root, ".chapters.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	assert.NoError(test, err)
+	defer lockFile.Close()
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	assert.NoError(test, err)
+
+	_, err = collection.OpenLogCollection(root, "chapters")
+	assert.IsType(test, collection.CollectionLockedError{}, err)
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+	assert.NoError(test, err)
+
+	chapters, err := collection.OpenLogCollection(root, "chapters")
+	assert.NoError(test, err)
+	chapters.Close()
+}
+
+func TestFilesystemCollectionLockedByAnotherProcess(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	lockTimeout := collection.LockTimeout
+	collection.LockTimeout = 50 * time.Millisecond
+	defer func() { collection.LockTimeout = lockTimeout }()
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	book := Book{Title: "Doktor Glas"}
+	err := books.Persist(&book)
+	assert.NoError(test, err)
+
+	lockFile, err := os.OpenFile(filepath.Join(root, ".books.lock"), os.O_RDWR, 0600)
+	assert.NoError(test, err)
+	defer lockFile.Close()
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	assert.NoError(test, err)
+
+	err = books.Persist(&book)
+	assert.Equal(test, collection.CollectionLockedError{Directory: filepath.Join(root, "books")}, err)
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+	assert.NoError(test, err)
+
+	err = books.Persist(&book)
+	assert.NoError(test, err)
+}
+
+func TestFilesystemCollectionReadsWithoutLockFile(test *testing.T) {
+	root := createTemporaryRoot(test)
+	defer os.RemoveAll(root)
+
+	// Written without the collection, like a copy on a read-only path.
+	err := os.Mkdir(filepath.Join(root, "books"), 0700)
+	assert.NoError(test, err)
+	id := "7f9d1a2e-3b4c-4d5e-8f60-718293a4b5c6"
+	err = ioutil.WriteFile(filepath.Join(root, "books", id+".json"), []byte(`{"ID":"`+id+`","Title":"Doktor Glas"}`), 0600)
+	assert.NoError(test, err)
+
+	books := collection.NewFilesystemCollection(root, "books")
+
+	booksFound := []Book{}
+	err = books.LoadAll(&booksFound, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(booksFound))
+
+	_, err = os.Stat(filepath.Join(root, ".books.lock"))
+	assert.True(test, os.IsNotExist(err))
+}
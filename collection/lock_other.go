@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package collection
+
+import "os"
+
+// lockFile does nothing on platforms without flock, collections are then only
+// locked within the process.
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,1254 @@
+package collection
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var _ Collection = &LogCollection{}
+var _ Indexer = &LogCollection{}
+var _ Expirer = &LogCollection{}
+var _ SchemaValidator = &LogCollection{}
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+
+	logIndexesFilename = "indexes.json"
+
+	DefaultMaxSegmentSize      int64 = 4 << 20
+	DefaultCompactionThreshold       = 1000
+)
+
+const (
+	logPut    = "put"
+	logDelete = "delete"
+	logBatch  = "batch"
+)
+
+type CorruptSegmentError struct {
+	Segment string
+	Offset  int64
+}
+
+func (err CorruptSegmentError) Error() string {
+	return "Log segment " + err.Segment + " is corrupt at offset " + strconv.FormatInt(err.Offset, 10)
+}
+
+// NotLogCollectionError is returned when a log collection is opened in a
+// directory that holds the entry files of a FilesystemCollection.
+type NotLogCollectionError struct {
+	CollectionName string
+}
+
+func (err NotLogCollectionError) Error() string {
+	return "Collection " + err.CollectionName + " holds entry files and can not be opened as a log collection"
+}
+
+// logRecord is one line of a segment file. A batch record holds the put and
+// delete records of a batch so that it is applied all or nothing.
+type logRecord struct {
+	Op       string          `json:"op"`
+	ID       uuid.UUID       `json:"id"`
+	Document json.RawMessage `json:"document,omitempty"`
+	Records  []logRecord     `json:"records,omitempty"`
+}
+
+type logLocation struct {
+	segment int
+	offset  int64
+	length  int64
+}
+
+var logCollections = map[string]*LogCollection{}
+var logCollectionsMux sync.Mutex
+
+// LogCollection is an alternative to FilesystemCollection that appends every
+// write to a segment file instead of writing one file per entry. The location
+// of the latest version of each entry is kept in memory, so loading an entry
+// is a single read. Segments that only hold overwritten or deleted entries are
+// compacted in the background.
+type LogCollection struct {
+	// MaxSegmentSize is the size in bytes after which a new segment is started.
+	MaxSegmentSize int64
+	// CompactionThreshold is the number of overwritten or deleted entries that
+	// starts a background compaction, 0 disables compaction.
+	CompactionThreshold int
+
+	root        string
+	name        string
+	mux         sync.RWMutex
+	index       map[uuid.UUID]logLocation
+	indexes     map[string]logIndex
+	segments    map[int]*os.File
+	active      int
+	activeSize  int64
+	stale       int
+	compacting  bool
+	compactions sync.WaitGroup
+	lock        *os.File
+	schema      *compiledSchema
+}
+
+// OpenLogCollection opens, or creates, the log collection with the given name
+// in root. Collections are shared within the process, opening the same
+// collection twice returns the same LogCollection.
+func OpenLogCollection(root string, name string) (collection *LogCollection, err error) {
+	if root == "" {
+		root = DefaultRoot
+	}
+
+	key, err := filepath.Abs(filepath.Join(root, name))
+	if err != nil {
+		return
+	}
+
+	logCollectionsMux.Lock()
+	defer logCollectionsMux.Unlock()
+
+	if existing, ok := logCollections[key]; ok {
+		return existing, nil
+	}
+
+	collection = &LogCollection{
+		MaxSegmentSize:      DefaultMaxSegmentSize,
+		CompactionThreshold: DefaultCompactionThreshold,
+		root:                root,
+		name:                name,
+		index:               map[uuid.UUID]logLocation{},
+		indexes:             map[string]logIndex{},
+		segments:            map[int]*os.File{},
+	}
+
+	err = collection.open()
+	if err != nil {
+		collection.closeFiles()
+		collection = nil
+		return
+	}
+
+	logCollections[key] = collection
+	return
+}
+
+// IsLogCollection reports whether the named collection in root has been
+// created by OpenLogCollection.
+func IsLogCollection(root string, name string) bool {
+	if root == "" {
+		root = DefaultRoot
+	}
+
+	numbers, _ := segmentNumbers(filepath.Join(root, name))
+	return len(numbers) > 0
+}
+
+// OpenCollection opens the named collection in root with the storage engine
+// it was created with, a LogCollection or a FilesystemCollection.
+func OpenCollection(root string, name string) (Collection, error) {
+	if IsLogCollection(root, name) {
+		return OpenLogCollection(root, name)
+	}
+
+	return NewFilesystemCollection(root, name), nil
+}
+
+func segmentNumbers(directory string) (numbers []int, err error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		number, parseError := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+		if parseError == nil {
+			numbers = append(numbers, number)
+		}
+	}
+
+	sort.Ints(numbers)
+	return
+}
+
+func formatLogLine(serialized []byte) []byte {
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(serialized), serialized))
+}
+
+// parseLogLine returns false for lines that were not completely written.
+func parseLogLine(line []byte) (record logRecord, ok bool) {
+	if len(line) < 10 || line[8] != ' ' || line[len(line)-1] != '\n' {
+		return
+	}
+
+	checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	serialized := line[9 : len(line)-1]
+	if err != nil || uint32(checksum) != crc32.ChecksumIEEE(serialized) {
+		return
+	}
+
+	ok = json.Unmarshal(serialized, &record) == nil
+	return
+}
+
+// readSegment calls handle for every record of a segment and returns the size
+// of the complete records. An incomplete record is only accepted at the end.
+func readSegment(file *os.File, handle func(record logRecord, location logLocation)) (size int64, complete bool, err error) {
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, readError := reader.ReadBytes('\n')
+		if len(line) == 0 && readError == io.EOF {
+			complete = true
+			return
+		}
+
+		record, ok := parseLogLine(line)
+		if !ok {
+			if readError == nil {
+				_, err = reader.Peek(1)
+				if err != io.EOF {
+					err = CorruptSegmentError{Segment: file.Name(), Offset: size}
+					return
+				}
+				err = nil
+			}
+
+			return
+		}
+
+		handle(record, logLocation{offset: size, length: int64(len(line))})
+		size += int64(len(line))
+	}
+}
+
+func (collection *LogCollection) GetName() string {
+	return collection.name
+}
+
+func (collection *LogCollection) getDirectory() string {
+	return filepath.Join(collection.root, collection.name)
+}
+
+func (collection *LogCollection) getSegmentFilename(number int) string {
+	return filepath.Join(collection.getDirectory(), fmt.Sprintf("%s%08d%s", segmentPrefix, number, segmentSuffix))
+}
+
+// open replays the segments to build the index. A record that was cut off at
+// the end of the last segment, by a crash during a write, is rolled back. A
+// directory holding the entries of a FilesystemCollection is not opened, since
+// the log would hide them.
+func (collection *LogCollection) open() (err error) {
+	directory := collection.getDirectory()
+	ids, err := NewFilesystemCollection(collection.root, collection.name).getIds()
+	if err != nil {
+		return
+	}
+
+	if len(ids) > 0 {
+		err = NotLogCollectionError{CollectionName: collection.name}
+		return
+	}
+
+	err = os.MkdirAll(directory, 0700)
+	if err != nil {
+		return
+	}
+
+	// The index is kept in memory, so only one process at a time can have
+	// the collection open.
+	collection.lock, err = os.OpenFile(lockFilename(directory), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	err = lockFile(collection.lock, true)
+	if err != nil {
+		collection.lock.Close()
+		collection.lock = nil
+		return
+	}
+
+	_, collection.schema, err = readSchemaFile(directory)
+	if err != nil {
+		return
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if isTemporaryFile(file.Name()) {
+			os.Remove(filepath.Join(directory, file.Name()))
+		}
+	}
+
+	numbers, err := segmentNumbers(directory)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			err = collection.buildIndexes()
+		}
+	}()
+
+	if len(numbers) == 0 {
+		return collection.startSegment()
+	}
+
+	for i, number := range numbers {
+		file, openError := os.OpenFile(collection.getSegmentFilename(number), os.O_RDWR, 0600)
+		if openError != nil {
+			err = openError
+			return
+		}
+		collection.segments[number] = file
+
+		size, complete, readError := readSegment(file, func(record logRecord, location logLocation) {
+			location.segment = number
+			collection.applyRecord(record, location)
+		})
+		if readError != nil {
+			err = readError
+			return
+		}
+
+		last := i == len(numbers)-1
+		if !complete && !last {
+			err = CorruptSegmentError{Segment: file.Name(), Offset: size}
+			return
+		}
+
+		if !complete {
+			err = file.Truncate(size)
+			if err != nil {
+				return
+			}
+
+			err = file.Sync()
+			if err != nil {
+				return
+			}
+		}
+
+		collection.active = number
+		collection.activeSize = size
+	}
+
+	return
+}
+
+func (collection *LogCollection) applyRecord(record logRecord, location logLocation) {
+	switch record.Op {
+	case logPut:
+		if _, exists := collection.index[record.ID]; exists {
+			collection.stale++
+		}
+		collection.index[record.ID] = location
+	case logDelete:
+		if _, exists := collection.index[record.ID]; exists {
+			collection.stale++
+			delete(collection.index, record.ID)
+		}
+	case logBatch:
+		for _, child := range record.Records {
+			collection.applyRecord(child, location)
+		}
+	}
+}
+
+func (collection *LogCollection) startSegment() (err error) {
+	number := collection.active + 1
+	file, err := os.OpenFile(collection.getSegmentFilename(number), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+
+	err = syncDirectory(collection.getDirectory())
+	if err != nil {
+		file.Close()
+		return
+	}
+
+	collection.segments[number] = file
+	collection.active = number
+	collection.activeSize = 0
+	return
+}
+
+// appendRecord writes the record to the active segment and syncs it before
+// updating the index, a failed write is cut off again.
+func (collection *LogCollection) appendRecord(record logRecord) (err error) {
+	changes, err := collection.indexChanges(record)
+	if err != nil {
+		return
+	}
+
+	if collection.activeSize > 0 && collection.activeSize >= collection.MaxSegmentSize {
+		err = collection.startSegment()
+		if err != nil {
+			return
+		}
+	}
+
+	serialized, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	line := formatLogLine(serialized)
+	file := collection.segments[collection.active]
+
+	_, err = file.WriteAt(line, collection.activeSize)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Truncate(collection.activeSize)
+		return
+	}
+
+	collection.applyRecord(record, logLocation{segment: collection.active, offset: collection.activeSize, length: int64(len(line))})
+	collection.applyIndexChanges(changes)
+	collection.activeSize += int64(len(line))
+	collection.scheduleCompaction()
+	return
+}
+
+// loadRaw reads a stored entry, expired entries do not exist.
+func (collection *LogCollection) loadRaw(id uuid.UUID) (raw []byte, err error) {
+	return unlessExpired(collection.readRaw(id))
+}
+
+func (collection *LogCollection) readRaw(id uuid.UUID) (raw []byte, err error) {
+	location, exists := collection.index[id]
+	if !exists {
+		err = EntryDoesNotExistError{}
+		return
+	}
+
+	file := collection.segments[location.segment]
+	line := make([]byte, location.length)
+	_, err = file.ReadAt(line, location.offset)
+	if err != nil {
+		return
+	}
+
+	record, ok := parseLogLine(line)
+	if !ok {
+		err = CorruptSegmentError{Segment: file.Name(), Offset: location.offset}
+		return
+	}
+
+	records := append([]logRecord{record}, record.Records...)
+	for _, candidate := range records {
+		if candidate.Op == logPut && candidate.ID == id {
+			raw = candidate.Document
+			return
+		}
+	}
+
+	err = CorruptSegmentError{Segment: file.Name(), Offset: location.offset}
+	return
+}
+
+func (collection *LogCollection) getIds() (ids []uuid.UUID) {
+	for id := range collection.index {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i int, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+
+	return
+}
+
+// Persist stores the entry whether it exists or not, see Upsert.
+func (collection *LogCollection) Persist(entry Entry) (err error) {
+	_, err = collection.write(entry, writeUpsert)
+	return
+}
+
+func (collection *LogCollection) Insert(entry Entry) (err error) {
+	_, err = collection.write(entry, writeInsert)
+	return
+}
+
+func (collection *LogCollection) Replace(entry Entry) (err error) {
+	_, err = collection.write(entry, writeReplace)
+	return
+}
+
+func (collection *LogCollection) Upsert(entry Entry) (created bool, err error) {
+	return collection.write(entry, writeUpsert)
+}
+
+func (collection *LogCollection) write(entry Entry, mode writeMode) (created bool, err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	if entry.GetID() == uuid.Nil {
+		if mode == writeReplace {
+			err = EntryDoesNotExistError{}
+			return
+		}
+
+		entry.SetID(uuid.Must(uuid.NewV4()))
+	}
+
+	oldRaw, err := collection.loadRaw(entry.GetID())
+	exists := err == nil
+	if _, ok := err.(EntryDoesNotExistError); ok {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	if exists && mode == writeInsert {
+		err = EntryAlreadyExistsError{}
+		return
+	} else if !exists && mode == writeReplace {
+		err = EntryDoesNotExistError{}
+		return
+	}
+
+	oldDocument := parseDocument(oldRaw)
+	err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(oldDocument))
+	if err != nil {
+		return
+	}
+
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	_, stored, revision, err := nextRevision(collection.GetName(), entry.GetID(), serialized, oldDocument, collection.schema)
+	if err != nil {
+		return
+	}
+
+	err = collection.appendRecord(logRecord{Op: logPut, ID: entry.GetID(), Document: stored})
+	if err != nil {
+		return
+	}
+
+	setRevision(entry, revision)
+	created = !exists
+	return
+}
+
+func (collection *LogCollection) Delete(entry Entry) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	oldRaw, err := collection.loadRaw(entry.GetID())
+	if err != nil {
+		return
+	}
+
+	err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(parseDocument(oldRaw)))
+	if err != nil {
+		return
+	}
+
+	err = collection.appendRecord(logRecord{Op: logDelete, ID: entry.GetID()})
+	return
+}
+
+// WriteBatch applies every operation of the batch or none of them, since the
+// batch is appended as a single record.
+func (collection *LogCollection) WriteBatch(batch Batch) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	operations, revisions, err := prepareBatch(collection.GetName(), batch, collection.loadRaw, collection.schema)
+	if err != nil {
+		return
+	}
+
+	record := logRecord{Op: logBatch}
+	for _, operation := range operations {
+		if operation.Document != nil {
+			record.Records = append(record.Records, logRecord{Op: logPut, ID: operation.ID, Document: operation.Document})
+		} else {
+			record.Records = append(record.Records, logRecord{Op: logDelete, ID: operation.ID})
+		}
+	}
+
+	err = collection.appendRecord(record)
+	if err != nil {
+		return
+	}
+
+	finishBatch(batch, operations, revisions)
+	return
+}
+
+func (collection *LogCollection) Patch(id uuid.UUID, patch Patch, entry Entry) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	raw, err := collection.loadRaw(id)
+	if err != nil {
+		return
+	}
+
+	expectedRevision := uint64(0)
+	if entry != nil {
+		expectedRevision = getExpectedRevision(entry)
+	}
+
+	oldDocument := parseDocument(raw)
+	err = checkRevision(id, expectedRevision, documentRevision(oldDocument))
+	if err != nil {
+		return
+	}
+
+	patched, err := applyPatch(raw, id, patch)
+	if err != nil {
+		return
+	}
+
+	_, stored, _, err := nextRevision(collection.GetName(), id, patched, oldDocument, collection.schema)
+	if err != nil {
+		return
+	}
+
+	err = collection.appendRecord(logRecord{Op: logPut, ID: id, Document: stored})
+	if err != nil || entry == nil {
+		return
+	}
+
+	err = json.Unmarshal(stored, entry)
+	return
+}
+
+func (collection *LogCollection) Load(id uuid.UUID, entry Entry) (err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	raw, err := collection.loadRaw(id)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+func (collection *LogCollection) LoadAll(entries interface{}, limit int) (err error) {
+	_, err = collection.LoadAllWithOptions(entries, QueryOptions{Limit: limit})
+	return
+}
+
+func (collection *LogCollection) LoadAllWithOptions(entries interface{}, options QueryOptions) (result QueryResult, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	result, err = loadMatching(collection.GetName(), collection.getIds(), collection.loadRaw, nil, options, entries)
+	return
+}
+
+func (collection *LogCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
+	_, err = collection.QueryWithOptions(filter, QueryOptions{Limit: limit}, entries)
+	return
+}
+
+func (collection *LogCollection) QueryWithOptions(filter interface{}, options QueryOptions, entries interface{}) (result QueryResult, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	constraints := map[string]interface{}{}
+	collectEqualityConstraints(reflect.ValueOf(filter), constraints)
+
+	ids := []uuid.UUID{}
+	if id, ok := idConstraint(constraints); ok {
+		ids = append(ids, id)
+	} else {
+		fields := []string{}
+		for field := range collection.indexes {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		ids, err = indexCandidates(constraints, fields, collection.lookupIndex, func() ([]uuid.UUID, error) {
+			return collection.getIds(), nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	result, err = loadMatching(collection.GetName(), ids, collection.loadRaw, filter, options, entries)
+	return
+}
+
+// SetSchema stores the schema next to the segments, the collection keeps it
+// in memory since no other process can have the collection open.
+func (collection *LogCollection) SetSchema(schema []byte) (err error) {
+	compiled, err := parseSchema(schema)
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	err = writeSchemaFile(collection.getDirectory(), schema)
+	if err != nil {
+		return
+	}
+
+	collection.schema = compiled
+	return
+}
+
+func (collection *LogCollection) Schema() (schema []byte, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	schema, _, err = readSchemaFile(collection.getDirectory())
+	return
+}
+
+// RemoveExpired deletes the entries whose expiry time has passed.
+func (collection *LogCollection) RemoveExpired() (removed int, err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	now := time.Now()
+	record := logRecord{Op: logBatch}
+	for _, id := range collection.getIds() {
+		raw, readError := collection.readRaw(id)
+		if readError != nil {
+			err = readError
+			return
+		}
+
+		if documentExpired(raw, now) {
+			record.Records = append(record.Records, logRecord{Op: logDelete, ID: id})
+		}
+	}
+
+	if len(record.Records) == 0 {
+		return
+	}
+
+	err = collection.appendRecord(record)
+	if err != nil {
+		return
+	}
+
+	removed = len(record.Records)
+	return
+}
+
+// Count returns the number of entries in the collection.
+func (collection *LogCollection) Count() int {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	return len(collection.index)
+}
+
+// scheduleCompaction starts a compaction in the background once enough
+// entries have been overwritten or deleted, the caller holds the lock.
+func (collection *LogCollection) scheduleCompaction() {
+	if collection.compacting || collection.CompactionThreshold == 0 || collection.stale < collection.CompactionThreshold {
+		return
+	}
+
+	sealed, err := collection.sealSegments()
+	if err != nil {
+		return
+	}
+
+	collection.compactions.Add(1)
+	go func() {
+		defer collection.compactions.Done()
+		collection.compactSegments(sealed)
+	}()
+}
+
+// Compact rewrites all segments into one that only holds the latest version
+// of every entry and waits for it to finish.
+func (collection *LogCollection) Compact() (err error) {
+	collection.mux.Lock()
+	for collection.compacting {
+		collection.mux.Unlock()
+		collection.compactions.Wait()
+		collection.mux.Lock()
+	}
+
+	sealed, err := collection.sealSegments()
+	if err == nil {
+		collection.compactions.Add(1)
+		defer collection.compactions.Done()
+	}
+	collection.mux.Unlock()
+	if err != nil {
+		return
+	}
+
+	err = collection.compactSegments(sealed)
+	return
+}
+
+// sealSegments starts a new active segment and returns the ones before it,
+// which are no longer written to and can be compacted without the lock.
+func (collection *LogCollection) sealSegments() (sealed []int, err error) {
+	if collection.activeSize > 0 {
+		err = collection.startSegment()
+		if err != nil {
+			return
+		}
+	}
+
+	for number := range collection.segments {
+		if number < collection.active {
+			sealed = append(sealed, number)
+		}
+	}
+	sort.Ints(sealed)
+
+	collection.compacting = true
+	collection.stale = 0
+	return
+}
+
+// compactSegments replaces the sealed segments with one segment that has the
+// number of the last of them. Deletes of entries written to the other sealed
+// segments are kept, so that replaying the segments still gives the right
+// entries if a crash leaves some of them behind.
+func (collection *LogCollection) compactSegments(sealed []int) (err error) {
+	defer func() {
+		collection.mux.Lock()
+		collection.compacting = false
+		if err != nil {
+			collection.stale += collection.CompactionThreshold
+		}
+		collection.mux.Unlock()
+	}()
+
+	if len(sealed) == 0 {
+		return
+	}
+
+	target := sealed[len(sealed)-1]
+	documents := map[uuid.UUID]json.RawMessage{}
+	writtenBefore := map[uuid.UUID]bool{}
+
+	var apply func(number int, record logRecord)
+	apply = func(number int, record logRecord) {
+		switch record.Op {
+		case logPut:
+			documents[record.ID] = record.Document
+			if number != target {
+				writtenBefore[record.ID] = true
+			}
+		case logDelete:
+			delete(documents, record.ID)
+		case logBatch:
+			for _, child := range record.Records {
+				apply(number, child)
+			}
+		}
+	}
+
+	for _, number := range sealed {
+		file, openError := os.Open(collection.getSegmentFilename(number))
+		if openError != nil {
+			err = openError
+			return
+		}
+
+		_, complete, readError := readSegment(file, func(record logRecord, location logLocation) {
+			apply(number, record)
+		})
+		file.Close()
+		if readError != nil {
+			err = readError
+			return
+		}
+		if !complete {
+			err = CorruptSegmentError{Segment: file.Name()}
+			return
+		}
+	}
+
+	ids := []uuid.UUID{}
+	for id := range documents {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i int, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+
+	records := []logRecord{}
+	for _, id := range ids {
+		records = append(records, logRecord{Op: logPut, ID: id, Document: documents[id]})
+	}
+	for id := range writtenBefore {
+		if _, live := documents[id]; !live {
+			records = append(records, logRecord{Op: logDelete, ID: id})
+		}
+	}
+
+	compacted, err := ioutil.TempFile(collection.getDirectory(), temporaryFilePrefix+"compaction-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			compacted.Close()
+			os.Remove(compacted.Name())
+		}
+	}()
+
+	locations := map[uuid.UUID]logLocation{}
+	writer := bufio.NewWriter(compacted)
+	offset := int64(0)
+	for _, record := range records {
+		serialized, marshalError := json.Marshal(record)
+		if marshalError != nil {
+			err = marshalError
+			return
+		}
+
+		line := formatLogLine(serialized)
+		_, err = writer.Write(line)
+		if err != nil {
+			return
+		}
+
+		if record.Op == logPut {
+			locations[record.ID] = logLocation{segment: target, offset: offset, length: int64(len(line))}
+		}
+		offset += int64(len(line))
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return
+	}
+
+	err = compacted.Sync()
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	err = os.Rename(compacted.Name(), collection.getSegmentFilename(target))
+	if err != nil {
+		return
+	}
+
+	err = syncDirectory(collection.getDirectory())
+	if err != nil {
+		return
+	}
+
+	collection.segments[target].Close()
+	collection.segments[target] = compacted
+
+	for id, location := range locations {
+		if current, exists := collection.index[id]; exists && current.segment <= target {
+			collection.index[id] = location
+		}
+	}
+
+	for _, number := range sealed[:len(sealed)-1] {
+		collection.segments[number].Close()
+		delete(collection.segments, number)
+
+		err = os.Remove(collection.getSegmentFilename(number))
+		if err != nil {
+			return
+		}
+	}
+
+	err = syncDirectory(collection.getDirectory())
+	return
+}
+
+// logIndex maps the index keys of a field to the entries stored under them.
+type logIndex map[string]map[uuid.UUID]bool
+
+func (index logIndex) add(key string, id uuid.UUID) {
+	if index[key] == nil {
+		index[key] = map[uuid.UUID]bool{}
+	}
+	index[key][id] = true
+}
+
+func (index logIndex) remove(key string, id uuid.UUID) {
+	delete(index[key], id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+type logIndexChange struct {
+	field string
+	key   string
+	id    uuid.UUID
+	add   bool
+}
+
+func (collection *LogCollection) getIndexesFilename() string {
+	return filepath.Join(collection.getDirectory(), logIndexesFilename)
+}
+
+// buildIndexes builds the indexes declared in the indexes file from the
+// stored entries, since they are only kept in memory.
+func (collection *LogCollection) buildIndexes() (err error) {
+	raw, err := ioutil.ReadFile(collection.getIndexesFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	fields := []string{}
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return
+	}
+
+	for _, field := range fields {
+		index, buildError := collection.buildIndex(field)
+		if buildError != nil {
+			err = buildError
+			return
+		}
+
+		collection.indexes[field] = index
+	}
+
+	return
+}
+
+func (collection *LogCollection) buildIndex(field string) (index logIndex, err error) {
+	index = logIndex{}
+	for id := range collection.index {
+		raw, readError := collection.readRaw(id)
+		if readError != nil {
+			err = readError
+			return
+		}
+
+		for _, key := range documentIndexKeys(parseDocument(raw), field) {
+			index.add(key, id)
+		}
+	}
+
+	return
+}
+
+// writeIndexes stores the indexed fields, with field added or removed.
+func (collection *LogCollection) writeIndexes(field string, add bool) (err error) {
+	fields := []string{}
+	for existing := range collection.indexes {
+		if existing != field {
+			fields = append(fields, existing)
+		}
+	}
+	if add {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	serialized, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomically(collection.getIndexesFilename(), serialized, 0600)
+	return
+}
+
+// indexChanges returns how the indexes change when the record is applied. It
+// is called before the record is written, so that a write that is stored
+// always updates the indexes.
+func (collection *LogCollection) indexChanges(record logRecord) (changes []logIndexChange, err error) {
+	if len(collection.indexes) == 0 {
+		return
+	}
+
+	records := []logRecord{record}
+	if record.Op == logBatch {
+		records = record.Records
+	}
+
+	for _, child := range records {
+		previous, readError := collection.readRaw(child.ID)
+		if _, ok := readError.(EntryDoesNotExistError); ok {
+			readError = nil
+		}
+		if readError != nil {
+			err = readError
+			return
+		}
+
+		oldDocument := parseDocument(previous)
+		newDocument := parseDocument(child.Document)
+		for field := range collection.indexes {
+			for _, key := range documentIndexKeys(oldDocument, field) {
+				changes = append(changes, logIndexChange{field: field, key: key, id: child.ID})
+			}
+			for _, key := range documentIndexKeys(newDocument, field) {
+				changes = append(changes, logIndexChange{field: field, key: key, id: child.ID, add: true})
+			}
+		}
+	}
+
+	return
+}
+
+func (collection *LogCollection) applyIndexChanges(changes []logIndexChange) {
+	for _, change := range changes {
+		if change.add {
+			collection.indexes[change.field].add(change.key, change.id)
+		} else {
+			collection.indexes[change.field].remove(change.key, change.id)
+		}
+	}
+}
+
+func (collection *LogCollection) lookupIndex(field string, key string) (ids []string, err error) {
+	for id := range collection.indexes[field][key] {
+		ids = append(ids, id.String())
+	}
+
+	return
+}
+
+// CreateIndex declares an index on a field, or a dotted path into nested
+// objects. The index is kept in memory and built again when the collection
+// is opened.
+func (collection *LogCollection) CreateIndex(field string) (err error) {
+	err = validateIndexField(field)
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	index, err := collection.buildIndex(field)
+	if err != nil {
+		return
+	}
+
+	err = collection.writeIndexes(field, true)
+	if err != nil {
+		return
+	}
+
+	collection.indexes[field] = index
+	return
+}
+
+func (collection *LogCollection) DropIndex(field string) (err error) {
+	err = validateIndexField(field)
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	if _, exists := collection.indexes[field]; !exists {
+		err = IndexDoesNotExistError{Field: field, CollectionName: collection.GetName()}
+		return
+	}
+
+	err = collection.writeIndexes(field, false)
+	if err != nil {
+		return
+	}
+
+	delete(collection.indexes, field)
+	return
+}
+
+func (collection *LogCollection) Indexes() (fields []string, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	fields = []string{}
+	for field := range collection.indexes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return
+}
+
+func (collection *LogCollection) closeFiles() {
+	for number, file := range collection.segments {
+		file.Close()
+		delete(collection.segments, number)
+	}
+
+	if collection.lock != nil {
+		unlockFile(collection.lock)
+		collection.lock.Close()
+		collection.lock = nil
+	}
+}
+
+// Close waits for a running compaction and closes the segment files, the
+// collection has to be opened again to be used.
+func (collection *LogCollection) Close() (err error) {
+	collection.compactions.Wait()
+
+	logCollectionsMux.Lock()
+	defer logCollectionsMux.Unlock()
+
+	for key, existing := range logCollections {
+		if existing == collection {
+			delete(logCollections, key)
+		}
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	collection.closeFiles()
+	return
+}
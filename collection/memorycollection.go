@@ -0,0 +1,436 @@
+package collection
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var _ Collection = &MemoryCollection{}
+var _ Indexer = &MemoryCollection{}
+var _ Expirer = &MemoryCollection{}
+var _ SchemaValidator = &MemoryCollection{}
+var _ Historian = &MemoryCollection{}
+var _ HistoryKeeper = &MemoryCollection{}
+
+// MemoryCollection keeps its entries in memory and behaves like a
+// FilesystemCollection, with the same revisions, filters and errors. It is
+// meant for tests and for data that does not have to survive a restart.
+type MemoryCollection struct {
+	name      string
+	mux       sync.RWMutex
+	documents map[uuid.UUID][]byte
+	indexes   map[string]bool
+	rawSchema []byte
+	schema    *compiledSchema
+	retention int
+	history   map[uuid.UUID][]HistoryRecord
+}
+
+func NewMemoryCollection(name string) *MemoryCollection {
+	return &MemoryCollection{
+		name:      name,
+		documents: map[uuid.UUID][]byte{},
+		indexes:   map[string]bool{},
+		history:   map[uuid.UUID][]HistoryRecord{},
+	}
+}
+
+func (collection *MemoryCollection) GetName() string {
+	return collection.name
+}
+
+// loadRaw reads a stored entry, expired entries do not exist.
+func (collection *MemoryCollection) loadRaw(id uuid.UUID) (raw []byte, err error) {
+	raw, exists := collection.documents[id]
+	if !exists {
+		err = EntryDoesNotExistError{}
+	}
+
+	return unlessExpired(raw, err)
+}
+
+func (collection *MemoryCollection) getIds() (ids []uuid.UUID) {
+	ids = []uuid.UUID{}
+	for id := range collection.documents {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i int, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+
+	return
+}
+
+// Persist stores the entry whether it exists or not, see Upsert.
+func (collection *MemoryCollection) Persist(entry Entry) (err error) {
+	_, err = collection.write(entry, writeUpsert)
+	return
+}
+
+func (collection *MemoryCollection) Insert(entry Entry) (err error) {
+	_, err = collection.write(entry, writeInsert)
+	return
+}
+
+func (collection *MemoryCollection) Replace(entry Entry) (err error) {
+	_, err = collection.write(entry, writeReplace)
+	return
+}
+
+func (collection *MemoryCollection) Upsert(entry Entry) (created bool, err error) {
+	return collection.write(entry, writeUpsert)
+}
+
+func (collection *MemoryCollection) write(entry Entry, mode writeMode) (created bool, err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	if entry.GetID() == uuid.Nil {
+		if mode == writeReplace {
+			err = EntryDoesNotExistError{}
+			return
+		}
+
+		entry.SetID(uuid.Must(uuid.NewV4()))
+	}
+
+	oldRaw, err := collection.loadRaw(entry.GetID())
+	exists := err == nil
+	err = nil
+
+	if exists && mode == writeInsert {
+		err = EntryAlreadyExistsError{}
+		return
+	} else if !exists && mode == writeReplace {
+		err = EntryDoesNotExistError{}
+		return
+	}
+
+	oldDocument := parseDocument(oldRaw)
+	err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(oldDocument))
+	if err != nil {
+		return
+	}
+
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	_, stored, revision, err := nextRevision(collection.GetName(), entry.GetID(), serialized, oldDocument, collection.schema)
+	if err != nil {
+		return
+	}
+
+	collection.documents[entry.GetID()] = stored
+	collection.recordHistory(entry.GetID(), oldRaw, stored)
+	setRevision(entry, revision)
+	created = !exists
+	return
+}
+
+func (collection *MemoryCollection) Delete(entry Entry) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	oldRaw, err := collection.loadRaw(entry.GetID())
+	if err != nil {
+		return
+	}
+
+	err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(parseDocument(oldRaw)))
+	if err != nil {
+		return
+	}
+
+	collection.remove(entry.GetID(), oldRaw)
+	return
+}
+
+// remove deletes the stored entry and records it in the history, the caller
+// holds the lock.
+func (collection *MemoryCollection) remove(id uuid.UUID, oldRaw []byte) {
+	delete(collection.documents, id)
+	collection.recordHistory(id, oldRaw, nil)
+}
+
+func (collection *MemoryCollection) WriteBatch(batch Batch) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	operations, revisions, err := prepareBatch(collection.GetName(), batch, collection.loadRaw, collection.schema)
+	if err != nil {
+		return
+	}
+
+	for _, operation := range operations {
+		if operation.Document != nil {
+			collection.documents[operation.ID] = operation.Document
+		} else {
+			delete(collection.documents, operation.ID)
+		}
+		collection.recordHistory(operation.ID, operation.Previous, operation.Document)
+	}
+
+	finishBatch(batch, operations, revisions)
+	return
+}
+
+func (collection *MemoryCollection) Patch(id uuid.UUID, patch Patch, entry Entry) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	raw, err := collection.loadRaw(id)
+	if err != nil {
+		return
+	}
+
+	expectedRevision := uint64(0)
+	if entry != nil {
+		expectedRevision = getExpectedRevision(entry)
+	}
+
+	oldDocument := parseDocument(raw)
+	err = checkRevision(id, expectedRevision, documentRevision(oldDocument))
+	if err != nil {
+		return
+	}
+
+	patched, err := applyPatch(raw, id, patch)
+	if err != nil {
+		return
+	}
+
+	_, stored, _, err := nextRevision(collection.GetName(), id, patched, oldDocument, collection.schema)
+	if err != nil {
+		return
+	}
+
+	collection.documents[id] = stored
+	collection.recordHistory(id, raw, stored)
+	if entry == nil {
+		return
+	}
+
+	err = json.Unmarshal(stored, entry)
+	return
+}
+
+func (collection *MemoryCollection) Load(id uuid.UUID, entry Entry) (err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	raw, err := collection.loadRaw(id)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+func (collection *MemoryCollection) LoadAll(entries interface{}, limit int) (err error) {
+	_, err = collection.LoadAllWithOptions(entries, QueryOptions{Limit: limit})
+	return
+}
+
+func (collection *MemoryCollection) LoadAllWithOptions(entries interface{}, options QueryOptions) (result QueryResult, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	result, err = loadMatching(collection.GetName(), collection.getIds(), collection.loadRaw, nil, options, entries)
+	return
+}
+
+func (collection *MemoryCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
+	_, err = collection.QueryWithOptions(filter, QueryOptions{Limit: limit}, entries)
+	return
+}
+
+func (collection *MemoryCollection) QueryWithOptions(filter interface{}, options QueryOptions, entries interface{}) (result QueryResult, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	constraints := map[string]interface{}{}
+	collectEqualityConstraints(reflect.ValueOf(filter), constraints)
+
+	ids := []uuid.UUID{}
+	if id, ok := idConstraint(constraints); ok {
+		ids = append(ids, id)
+	} else {
+		ids = collection.getIds()
+	}
+
+	result, err = loadMatching(collection.GetName(), ids, collection.loadRaw, filter, options, entries)
+	return
+}
+
+func (collection *MemoryCollection) SetSchema(schema []byte) (err error) {
+	compiled, err := parseSchema(schema)
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	collection.rawSchema = schema
+	collection.schema = compiled
+	return
+}
+
+func (collection *MemoryCollection) Schema() (schema []byte, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	schema = collection.rawSchema
+	return
+}
+
+// recordHistory adds a write to the history of the entry if the collection
+// keeps history, the caller holds the lock.
+func (collection *MemoryCollection) recordHistory(id uuid.UUID, previous []byte, document []byte) {
+	if collection.retention != 0 {
+		collection.history[id] = appendHistory(collection.history[id], previous, document, collection.retention, time.Now())
+	}
+}
+
+func (collection *MemoryCollection) SetHistoryRetention(revisions int) (err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	collection.retention = revisions
+	if revisions == 0 {
+		collection.history = map[uuid.UUID][]HistoryRecord{}
+	}
+
+	return
+}
+
+func (collection *MemoryCollection) HistoryRetention() (revisions int, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	revisions = collection.retention
+	return
+}
+
+// History returns the stored revisions of the entry, oldest first.
+func (collection *MemoryCollection) History(id uuid.UUID) (records []HistoryRecord, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	current, err := collection.loadRaw(id)
+	return historyOrCurrent(collection.history[id], current, err)
+}
+
+func (collection *MemoryCollection) LoadRevision(id uuid.UUID, revision uint64, entry Entry) (err error) {
+	records, err := collection.History(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findRevision(records, id, revision)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+// LoadAsOf loads the revision of the entry that was stored at the time.
+func (collection *MemoryCollection) LoadAsOf(id uuid.UUID, at time.Time, entry Entry) (err error) {
+	records, err := collection.History(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findAsOf(records, at)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+func (collection *MemoryCollection) Revert(id uuid.UUID, revision uint64, entry Entry) error {
+	return revert(collection, collection.History, id, revision, entry)
+}
+
+// RemoveExpired deletes the entries whose expiry time has passed.
+func (collection *MemoryCollection) RemoveExpired() (removed int, err error) {
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	now := time.Now()
+	for id, raw := range collection.documents {
+		if documentExpired(raw, now) {
+			collection.remove(id, raw)
+			removed++
+		}
+	}
+
+	return
+}
+
+// Count returns the number of entries in the collection.
+func (collection *MemoryCollection) Count() int {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	return len(collection.documents)
+}
+
+// CreateIndex only records the field, queries on a MemoryCollection always
+// scan every entry. It validates the field like FilesystemCollection does.
+func (collection *MemoryCollection) CreateIndex(field string) (err error) {
+	err = validateIndexField(field)
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	collection.indexes[field] = true
+	return
+}
+
+func (collection *MemoryCollection) DropIndex(field string) (err error) {
+	err = validateIndexField(field)
+	if err != nil {
+		return
+	}
+
+	collection.mux.Lock()
+	defer collection.mux.Unlock()
+
+	if !collection.indexes[field] {
+		err = IndexDoesNotExistError{Field: field, CollectionName: collection.GetName()}
+		return
+	}
+
+	delete(collection.indexes, field)
+	return
+}
+
+func (collection *MemoryCollection) Indexes() (fields []string, err error) {
+	collection.mux.RLock()
+	defer collection.mux.RUnlock()
+
+	fields = []string{}
+	for field := range collection.indexes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return
+}
@@ -0,0 +1,275 @@
+package collection
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+func (sortField SortField) String() string {
+	if sortField.Descending {
+		return "-" + sortField.Field
+	}
+
+	return sortField.Field
+}
+
+// ParseSort parses a comma separated list of fields where a leading minus
+// sorts that field in descending order, e.g. "-BirthDate,Name".
+func ParseSort(value string) (sortFields []SortField) {
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(strings.TrimPrefix(field, "-"), "+")
+		if field == "" {
+			continue
+		}
+
+		sortFields = append(sortFields, SortField{Field: field, Descending: descending})
+	}
+
+	return
+}
+
+func FormatSort(sortFields []SortField) string {
+	fields := []string{}
+	for _, sortField := range sortFields {
+		fields = append(fields, sortField.String())
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// QueryOptions controls how the entries found by LoadAllWithOptions and
+// QueryWithOptions are returned. A zero Limit means no limit, Limit and Offset
+// must not be negative. Cursor is the NextCursor of a previous QueryResult and
+// continues where that page ended. Fields limits UntypedEntry results to the
+// given fields and the ID.
+type QueryOptions struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Sort   []SortField
+	Fields []string
+}
+
+type InvalidQueryOptionsError struct {
+	Message string
+}
+
+func (err InvalidQueryOptionsError) Error() string {
+	return "Invalid query options: " + err.Message
+}
+
+func (options QueryOptions) Validate() (err error) {
+	if options.Limit < 0 {
+		err = InvalidQueryOptionsError{Message: "limit must not be negative"}
+	} else if options.Offset < 0 {
+		err = InvalidQueryOptionsError{Message: "offset must not be negative"}
+	}
+
+	return
+}
+
+func ParseFields(value string) (fields []string) {
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return
+}
+
+// QueryResult describes the page that was loaded, NextCursor is empty when
+// there are no more entries.
+type QueryResult struct {
+	NextCursor string
+}
+
+type InvalidCursorError struct{}
+
+func (err InvalidCursorError) Error() string {
+	return "Cursor is invalid or was created with another sort order"
+}
+
+type sortValue struct {
+	Value  interface{} `json:"value"`
+	Exists bool        `json:"exists"`
+}
+
+type cursorPosition struct {
+	Sort   string      `json:"sort"`
+	Values []sortValue `json:"values"`
+}
+
+// withIDTiebreaker makes the order total so that pages never overlap, even if
+// several entries have the same values for the requested sort fields.
+func withIDTiebreaker(sortFields []SortField) []SortField {
+	for _, sortField := range sortFields {
+		if sortField.Field == "ID" {
+			return sortFields
+		}
+	}
+
+	return append(append([]SortField{}, sortFields...), SortField{Field: "ID"})
+}
+
+func sortValuesOf(entry reflect.Value, sortFields []SortField) (values []sortValue) {
+	for _, sortField := range sortFields {
+		if sortField.Field == "ID" {
+			if id, ok := entryIDOf(entry); ok {
+				values = append(values, sortValue{Value: id.String(), Exists: true})
+				continue
+			}
+		}
+
+		value, exists := normalizeField(lookupPath(entry, sortField.Field))
+		values = append(values, sortValue{Value: value, Exists: exists})
+	}
+
+	return
+}
+
+// entryIDOf returns the ID of a struct entry through GetID, since its type may
+// serialize the ID under another name than ID. Map entries keep it as ID.
+func entryIDOf(entry reflect.Value) (id uuid.UUID, ok bool) {
+	if entry.Kind() != reflect.Struct || !entry.CanAddr() {
+		return
+	}
+
+	identified, ok := entry.Addr().Interface().(Entry)
+	if ok {
+		id = identified.GetID()
+	}
+	return
+}
+
+// compareSortValues orders two entries by the values of their sort fields,
+// entries that are missing a field or hold values that cannot be compared are
+// sorted first.
+func compareSortValues(a []sortValue, b []sortValue, sortFields []SortField) int {
+	for i, sortField := range sortFields {
+		result := 0
+		if !a[i].Exists || !b[i].Exists {
+			if a[i].Exists {
+				result = 1
+			} else if b[i].Exists {
+				result = -1
+			}
+		} else if compared, ok := compareValues(a[i].Value, b[i].Value); ok {
+			result = compared
+		}
+
+		if sortField.Descending {
+			result = -result
+		}
+
+		if result != 0 {
+			return result
+		}
+	}
+
+	return 0
+}
+
+func compareEntries(a reflect.Value, b reflect.Value, sortFields []SortField) int {
+	return compareSortValues(sortValuesOf(a, sortFields), sortValuesOf(b, sortFields), sortFields)
+}
+
+func sortEntries(entries []reflect.Value, sortFields []SortField) {
+	if len(sortFields) == 0 {
+		return
+	}
+
+	sort.SliceStable(entries, func(i int, j int) bool {
+		return compareEntries(entries[i], entries[j], sortFields) < 0
+	})
+}
+
+func encodeCursor(entry reflect.Value, sortFields []SortField) string {
+	position := cursorPosition{
+		Sort:   FormatSort(sortFields),
+		Values: sortValuesOf(entry, withIDTiebreaker(sortFields)),
+	}
+
+	serialized, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(serialized)
+}
+
+func decodeCursor(cursor string, sortFields []SortField) (position cursorPosition, err error) {
+	serialized, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(serialized, &position)
+	}
+
+	if err != nil || position.Sort != FormatSort(sortFields) || len(position.Values) != len(withIDTiebreaker(sortFields)) {
+		err = InvalidCursorError{}
+	}
+
+	return
+}
+
+// cursorID returns the ID that the cursor of a query without sort fields, or
+// sorted on the ID alone, points at.
+func cursorID(position cursorPosition) (id uuid.UUID, err error) {
+	value, _ := position.Values[0].Value.(string)
+	id, err = uuid.FromString(value)
+	if err != nil {
+		err = InvalidCursorError{}
+	}
+
+	return
+}
+
+// paginate applies the cursor, offset and limit to entries that are already
+// in the order given by the sort fields.
+func paginate(entries []reflect.Value, options QueryOptions, cursor *cursorPosition) (page []reflect.Value, result QueryResult) {
+	page = entries
+
+	if cursor != nil {
+		sortFields := withIDTiebreaker(options.Sort)
+		start := sort.Search(len(page), func(i int) bool {
+			return compareSortValues(sortValuesOf(page[i], sortFields), cursor.Values, sortFields) > 0
+		})
+		page = page[start:]
+	}
+
+	if options.Offset > 0 {
+		if options.Offset >= len(page) {
+			page = page[len(page):]
+		} else {
+			page = page[options.Offset:]
+		}
+	}
+
+	if options.Limit != 0 && len(page) > options.Limit {
+		page = page[:options.Limit]
+		result.NextCursor = encodeCursor(page[len(page)-1], options.Sort)
+	}
+
+	return
+}
+
+var untypedEntryType = reflect.TypeOf(UntypedEntry{})
+
+// project applies the requested fields to map results, struct results already
+// only contain the fields of their type.
+func project(entry reflect.Value, fields []string) {
+	if len(fields) == 0 || entry.Kind() != reflect.Map || !entry.Type().ConvertibleTo(untypedEntryType) {
+		return
+	}
+
+	untypedEntry := entry.Convert(untypedEntryType).Interface().(UntypedEntry)
+	untypedEntry.Project(fields)
+}
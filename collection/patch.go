@@ -0,0 +1,444 @@
+package collection
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+type InvalidPatchError struct {
+	Message string
+}
+
+func (err InvalidPatchError) Error() string {
+	return "Invalid patch: " + err.Message
+}
+
+type PatchTestFailedError struct {
+	Path string
+}
+
+func (err PatchTestFailedError) Error() string {
+	return "Patch test failed for " + err.Path
+}
+
+// Patch is a change to an existing entry, either a MergePatch or a JSONPatch.
+type Patch interface {
+	apply(document interface{}) (interface{}, error)
+}
+
+// MergePatch is a JSON Merge Patch document as described in RFC 7396.
+type MergePatch []byte
+
+// JSONPatch is a JSON Patch document as described in RFC 6902.
+type JSONPatch []byte
+
+func (patch MergePatch) apply(document interface{}) (result interface{}, err error) {
+	var patchDocument interface{}
+	err = json.Unmarshal(patch, &patchDocument)
+	if err != nil {
+		err = InvalidPatchError{Message: "not valid JSON"}
+		return
+	}
+
+	result = mergePatch(document, patchDocument)
+	return
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (patch JSONPatch) apply(document interface{}) (result interface{}, err error) {
+	operations := []jsonPatchOperation{}
+	err = json.Unmarshal(patch, &operations)
+	if err != nil {
+		err = InvalidPatchError{Message: "not a JSON array of operations"}
+		return
+	}
+
+	result = document
+	for _, operation := range operations {
+		result, err = operation.apply(result)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (operation jsonPatchOperation) apply(document interface{}) (result interface{}, err error) {
+	if operation.Path == nil {
+		err = InvalidPatchError{Message: "operation " + operation.Op + " is missing path"}
+		return
+	}
+
+	path, err := parsePointer(*operation.Path)
+	if err != nil {
+		return
+	}
+
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if len(operation.Value) == 0 {
+			err = InvalidPatchError{Message: "operation " + operation.Op + " is missing value"}
+			return
+		}
+
+		err = json.Unmarshal(operation.Value, &value)
+		if err != nil {
+			return
+		}
+	case "move", "copy":
+		if operation.From == nil {
+			err = InvalidPatchError{Message: "operation " + operation.Op + " is missing from"}
+			return
+		}
+
+		from, parseError := parsePointer(*operation.From)
+		if parseError != nil {
+			err = parseError
+			return
+		}
+
+		if operation.Op == "move" && strings.HasPrefix(*operation.Path, *operation.From+"/") {
+			err = InvalidPatchError{Message: "cannot move " + *operation.From + " into one of its children"}
+			return
+		}
+
+		value, err = getPointerValue(document, from)
+		if err != nil {
+			return
+		}
+
+		if operation.Op == "move" {
+			document, err = removePointerValue(document, from)
+			if err != nil {
+				return
+			}
+		} else {
+			value = copyValue(value)
+		}
+	}
+
+	switch operation.Op {
+	case "add", "move", "copy":
+		result, err = addPointerValue(document, path, value)
+	case "remove":
+		result, err = removePointerValue(document, path)
+	case "replace":
+		result, err = replacePointerValue(document, path, value)
+	case "test":
+		current, getError := getPointerValue(document, path)
+		if getError != nil || !reflect.DeepEqual(current, value) {
+			err = PatchTestFailedError{Path: *operation.Path}
+			return
+		}
+		result = document
+	default:
+		err = InvalidPatchError{Message: "unknown operation " + operation.Op}
+	}
+
+	return
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) (tokens []string, err error) {
+	if pointer == "" {
+		return
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		err = InvalidPatchError{Message: "path " + pointer + " does not start with /"}
+		return
+	}
+
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.Replace(token, "~1", "/", -1)
+		token = strings.Replace(token, "~0", "~", -1)
+		tokens = append(tokens, token)
+	}
+
+	return
+}
+
+func pathNotFound(tokens []string) error {
+	return InvalidPatchError{Message: "path /" + strings.Join(tokens, "/") + " does not exist"}
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (index int, err error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	index, err = strconv.Atoi(token)
+	if err != nil || index < 0 || index > length || (index == length && !allowEnd) || (len(token) > 1 && token[0] == '0') {
+		err = InvalidPatchError{Message: "invalid array index " + token}
+	}
+
+	return
+}
+
+func getPointerValue(document interface{}, tokens []string) (value interface{}, err error) {
+	value = document
+	for i, token := range tokens {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			child, exists := container[token]
+			if !exists {
+				err = pathNotFound(tokens[:i+1])
+				return
+			}
+			value = child
+		case []interface{}:
+			index, indexError := arrayIndex(token, len(container), false)
+			if indexError != nil {
+				err = indexError
+				return
+			}
+			value = container[index]
+		default:
+			err = pathNotFound(tokens[:i+1])
+			return
+		}
+	}
+
+	return
+}
+
+// modifyPointerValue walks to the container holding the last token and
+// replaces it with what change returns, since changing the length of an
+// array gives a new slice that has to be stored in its parent.
+func modifyPointerValue(document interface{}, tokens []string, change func(container interface{}, token string) (interface{}, error)) (result interface{}, err error) {
+	if len(tokens) == 1 {
+		return change(document, tokens[0])
+	}
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		child, exists := container[tokens[0]]
+		if !exists {
+			err = pathNotFound(tokens[:1])
+			return
+		}
+
+		child, err = modifyPointerValue(child, tokens[1:], change)
+		if err != nil {
+			return
+		}
+
+		container[tokens[0]] = child
+		result = container
+	case []interface{}:
+		index, indexError := arrayIndex(tokens[0], len(container), false)
+		if indexError != nil {
+			err = indexError
+			return
+		}
+
+		child, childError := modifyPointerValue(container[index], tokens[1:], change)
+		if childError != nil {
+			err = childError
+			return
+		}
+
+		container[index] = child
+		result = container
+	default:
+		err = pathNotFound(tokens[:1])
+	}
+
+	return
+}
+
+func addPointerValue(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	return modifyPointerValue(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch typed := container.(type) {
+		case map[string]interface{}:
+			typed[token] = value
+			return typed, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(typed), true)
+			if err != nil {
+				return nil, err
+			}
+
+			typed = append(typed, nil)
+			copy(typed[index+1:], typed[index:])
+			typed[index] = value
+			return typed, nil
+		}
+
+		return nil, pathNotFound(tokens)
+	})
+}
+
+func removePointerValue(document interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, InvalidPatchError{Message: "cannot remove the whole entry"}
+	}
+
+	return modifyPointerValue(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch typed := container.(type) {
+		case map[string]interface{}:
+			if _, exists := typed[token]; !exists {
+				return nil, pathNotFound(tokens)
+			}
+
+			delete(typed, token)
+			return typed, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(typed), false)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(typed[:index], typed[index+1:]...), nil
+		}
+
+		return nil, pathNotFound(tokens)
+	})
+}
+
+func replacePointerValue(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	return modifyPointerValue(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch typed := container.(type) {
+		case map[string]interface{}:
+			if _, exists := typed[token]; !exists {
+				return nil, pathNotFound(tokens)
+			}
+
+			typed[token] = value
+			return typed, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(typed), false)
+			if err != nil {
+				return nil, err
+			}
+
+			typed[index] = value
+			return typed, nil
+		}
+
+		return nil, pathNotFound(tokens)
+	})
+}
+
+func copyValue(value interface{}) (copied interface{}) {
+	serialized, _ := json.Marshal(value)
+	json.Unmarshal(serialized, &copied)
+	return
+}
+
+// applyPatch applies the patch to a stored entry and makes sure that the
+// result is still an entry with the same ID.
+func applyPatch(raw []byte, id uuid.UUID, patch Patch) (patched []byte, err error) {
+	var document interface{}
+	err = json.Unmarshal(raw, &document)
+	if err != nil {
+		return
+	}
+
+	document, err = patch.apply(document)
+	if err != nil {
+		return
+	}
+
+	object, ok := document.(map[string]interface{})
+	if !ok {
+		err = InvalidPatchError{Message: "the patched entry is not a JSON object"}
+		return
+	}
+
+	object["ID"] = id.String()
+
+	patched, err = json.Marshal(object)
+	return
+}
+
+// Patch applies a MergePatch or JSONPatch to the stored entry while holding
+// the collection lock and loads the result into entry unless it is nil. If
+// entry is Revisioned its revision is required to match the stored one.
+func (collection FilesystemCollection) Patch(id uuid.UUID, patch Patch, entry Entry) (err error) {
+	unlock, err := collection.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	raw, err := collection.loadRaw(id)
+	if err != nil {
+		return
+	}
+
+	expectedRevision := uint64(0)
+	if entry != nil {
+		expectedRevision = getExpectedRevision(entry)
+	}
+
+	err = checkRevision(id, expectedRevision, documentRevision(parseDocument(raw)))
+	if err != nil {
+		return
+	}
+
+	patched, err := applyPatch(raw, id, patch)
+	if err != nil {
+		return
+	}
+
+	_, err = collection.writeRaw(id, patched, expectedRevision)
+	if err != nil || entry == nil {
+		return
+	}
+
+	raw, err = collection.loadRaw(id)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
@@ -0,0 +1,97 @@
+package collection
+
+import (
+	"encoding/json"
+	"strconv"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// RevisionField is the key that holds the revision of a stored entry, it is
+// incremented by every write.
+const RevisionField = "_revision"
+
+// Revisioned entries get optimistic concurrency control, a write or delete of
+// an entry with a revision other than 0 fails with a RevisionConflictError
+// unless it matches the stored revision.
+type Revisioned interface {
+	GetRevision() uint64
+	SetRevision(uint64)
+}
+
+type RevisionedEntry struct {
+	BaseEntry
+	Revision uint64 `json:"_revision,omitempty"`
+}
+
+func (entry *RevisionedEntry) GetRevision() uint64 {
+	return entry.Revision
+}
+
+func (entry *RevisionedEntry) SetRevision(revision uint64) {
+	entry.Revision = revision
+}
+
+type RevisionConflictError struct {
+	ID               uuid.UUID
+	ExpectedRevision uint64
+	ActualRevision   uint64
+}
+
+func (err RevisionConflictError) Error() string {
+	return "Entry " + err.ID.String() + " has revision " + strconv.FormatUint(err.ActualRevision, 10) +
+		" but revision " + strconv.FormatUint(err.ExpectedRevision, 10) + " was expected"
+}
+
+func getExpectedRevision(entry Entry) uint64 {
+	if revisioned, ok := entry.(Revisioned); ok {
+		return revisioned.GetRevision()
+	}
+
+	return 0
+}
+
+func setRevision(entry Entry, revision uint64) {
+	if revisioned, ok := entry.(Revisioned); ok {
+		revisioned.SetRevision(revision)
+	}
+}
+
+func documentRevision(document map[string]interface{}) uint64 {
+	switch revision := document[RevisionField].(type) {
+	case uint64:
+		return revision
+	case float64:
+		return uint64(revision)
+	case json.Number:
+		parsed, _ := strconv.ParseUint(string(revision), 10, 64)
+		return parsed
+	}
+
+	return 0
+}
+
+func checkRevision(id uuid.UUID, expected uint64, actual uint64) error {
+	if expected != 0 && expected != actual {
+		return RevisionConflictError{ID: id, ExpectedRevision: expected, ActualRevision: actual}
+	}
+
+	return nil
+}
+
+// FormatETag and ParseETag convert between revisions and HTTP entity tags.
+func FormatETag(revision uint64) string {
+	return "\"" + strconv.FormatUint(revision, 10) + "\""
+}
+
+func ParseETag(etag string) (revision uint64, err error) {
+	if len(etag) > 2 && etag[:2] == "W/" {
+		etag = etag[2:]
+	}
+
+	if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+		etag = etag[1 : len(etag)-1]
+	}
+
+	return strconv.ParseUint(etag, 10, 64)
+}
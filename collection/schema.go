@@ -0,0 +1,655 @@
+package collection
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const schemaFileSuffix = ".schema.json"
+
+type InvalidSchemaError struct {
+	Message string
+}
+
+func (err InvalidSchemaError) Error() string {
+	return "Invalid schema: " + err.Message
+}
+
+// Violation is a part of an entry that does not match the schema, Path is a
+// JSON Pointer to the value.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when an entry that is written does not match
+// the schema of the collection.
+type ValidationError struct {
+	ID             uuid.UUID
+	CollectionName string
+	Violations     []Violation
+}
+
+func (err ValidationError) Error() string {
+	messages := []string{}
+	for _, violation := range err.Violations {
+		messages = append(messages, strings.TrimSpace(violation.Path+" "+violation.Message))
+	}
+
+	return "Entry " + err.CollectionName + "/" + err.ID.String() + " does not match the schema: " + strings.Join(messages, ", ")
+}
+
+// SchemaValidator is implemented by collections that validate the entries
+// written to them against a JSON Schema. SetSchema with a nil schema removes
+// it, entries that are already stored are not validated. Schema returns nil
+// when the collection has no schema.
+//
+// The ID, revision and expiry time are left out of the validated entry. Only
+// a subset of JSON Schema is supported, the keywords in SchemaKeywords are
+// validated and those in SchemaAnnotations are accepted and ignored. Schemas
+// with any other keyword, e.g. $ref or format, are rejected with an
+// InvalidSchemaError rather than being half enforced.
+type SchemaValidator interface {
+	SetSchema(schema []byte) error
+	Schema() ([]byte, error)
+}
+
+// compiledSchema is a parsed JSON Schema, a nil schema accepts everything.
+type compiledSchema struct {
+	never                bool
+	types                []string
+	enum                 []interface{}
+	hasConst             bool
+	constant             interface{}
+	properties           map[string]*compiledSchema
+	required             []string
+	closed               bool
+	additionalProperties *compiledSchema
+	items                *compiledSchema
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	minLength            *int
+	maxLength            *int
+	minItems             *int
+	maxItems             *int
+	minProperties        *int
+	maxProperties        *int
+	pattern              *regexp.Regexp
+	allOf                []*compiledSchema
+	anyOf                []*compiledSchema
+	oneOf                []*compiledSchema
+	not                  *compiledSchema
+}
+
+var schemaTypes = []string{"null", "boolean", "object", "array", "number", "string", "integer"}
+
+// SchemaKeywords are the JSON Schema keywords that entries are validated
+// against, exclusiveMinimum and exclusiveMaximum take numbers as in draft 6
+// and later.
+var SchemaKeywords = []string{
+	"type", "enum", "const",
+	"properties", "required", "additionalProperties", "minProperties", "maxProperties",
+	"items", "minItems", "maxItems",
+	"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum",
+	"minLength", "maxLength", "pattern",
+	"allOf", "anyOf", "oneOf", "not",
+}
+
+// SchemaAnnotations are the JSON Schema keywords that describe a schema
+// without affecting validation, they are accepted and ignored.
+var SchemaAnnotations = []string{
+	"$schema", "$id", "id", "$comment",
+	"title", "description", "default", "examples",
+	"readOnly", "writeOnly", "deprecated",
+}
+
+// parseSchema parses and compiles a JSON Schema, a nil schema means none.
+func parseSchema(raw []byte) (schema *compiledSchema, err error) {
+	if raw == nil {
+		return
+	}
+
+	var value interface{}
+	err = json.Unmarshal(raw, &value)
+	if err != nil {
+		err = InvalidSchemaError{Message: "not valid JSON"}
+		return
+	}
+
+	schema, err = compileSchema(value, "")
+	if err == nil && schema == nil {
+		schema = &compiledSchema{}
+	}
+
+	return
+}
+
+func compileSchema(value interface{}, path string) (schema *compiledSchema, err error) {
+	if allowed, ok := value.(bool); ok {
+		if !allowed {
+			schema = &compiledSchema{never: true}
+		}
+		return
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		err = InvalidSchemaError{Message: schemaPath(path) + " must be an object or a boolean"}
+		return
+	}
+
+	schema = &compiledSchema{}
+
+	keywords := []string{}
+	for keyword := range object {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		keywordValue := object[keyword]
+		keywordPath := path + "/" + escapePointerToken(keyword)
+		invalid := InvalidSchemaError{Message: schemaPath(keywordPath) + " is not valid"}
+
+		switch keyword {
+		case "type":
+			schema.types, err = compileTypes(keywordValue, keywordPath)
+		case "enum":
+			values, ok := keywordValue.([]interface{})
+			if !ok {
+				err = invalid
+			}
+			schema.enum = values
+		case "const":
+			schema.hasConst = true
+			schema.constant = keywordValue
+		case "properties":
+			properties, ok := keywordValue.(map[string]interface{})
+			if !ok {
+				err = invalid
+				break
+			}
+
+			schema.properties = map[string]*compiledSchema{}
+			for name, property := range properties {
+				schema.properties[name], err = compileSchema(property, keywordPath+"/"+escapePointerToken(name))
+				if err != nil {
+					break
+				}
+			}
+		case "required":
+			schema.required, err = compileStrings(keywordValue, invalid)
+		case "additionalProperties":
+			if allowed, ok := keywordValue.(bool); ok {
+				schema.closed = !allowed
+				break
+			}
+			schema.additionalProperties, err = compileSchema(keywordValue, keywordPath)
+		case "items":
+			schema.items, err = compileSchema(keywordValue, keywordPath)
+		case "minimum":
+			schema.minimum, err = compileNumber(keywordValue, invalid)
+		case "maximum":
+			schema.maximum, err = compileNumber(keywordValue, invalid)
+		case "exclusiveMinimum":
+			schema.exclusiveMinimum, err = compileNumber(keywordValue, invalid)
+		case "exclusiveMaximum":
+			schema.exclusiveMaximum, err = compileNumber(keywordValue, invalid)
+		case "minLength":
+			schema.minLength, err = compileCount(keywordValue, invalid)
+		case "maxLength":
+			schema.maxLength, err = compileCount(keywordValue, invalid)
+		case "minItems":
+			schema.minItems, err = compileCount(keywordValue, invalid)
+		case "maxItems":
+			schema.maxItems, err = compileCount(keywordValue, invalid)
+		case "minProperties":
+			schema.minProperties, err = compileCount(keywordValue, invalid)
+		case "maxProperties":
+			schema.maxProperties, err = compileCount(keywordValue, invalid)
+		case "pattern":
+			pattern, ok := keywordValue.(string)
+			if !ok {
+				err = invalid
+				break
+			}
+
+			schema.pattern, err = regexp.Compile(pattern)
+			if err != nil {
+				err = invalid
+			}
+		case "allOf":
+			schema.allOf, err = compileSchemas(keywordValue, keywordPath, invalid)
+		case "anyOf":
+			schema.anyOf, err = compileSchemas(keywordValue, keywordPath, invalid)
+		case "oneOf":
+			schema.oneOf, err = compileSchemas(keywordValue, keywordPath, invalid)
+		case "not":
+			schema.not, err = compileSchema(keywordValue, keywordPath)
+			if err == nil && schema.not == nil {
+				schema.not = &compiledSchema{}
+			}
+		default:
+			if !isSchemaAnnotation(keyword) {
+				err = InvalidSchemaError{Message: schemaPath(path) + " uses " + keyword + " which is not supported, the supported keywords are " + strings.Join(SchemaKeywords, ", ")}
+			}
+		}
+
+		if err != nil {
+			schema = nil
+			return
+		}
+	}
+
+	return
+}
+
+func isSchemaAnnotation(keyword string) bool {
+	for _, annotation := range SchemaAnnotations {
+		if annotation == keyword {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileTypes(value interface{}, path string) (types []string, err error) {
+	invalid := InvalidSchemaError{Message: schemaPath(path) + " must be a type name or a list of type names"}
+
+	if name, ok := value.(string); ok {
+		value = []interface{}{name}
+	}
+
+	types, err = compileStrings(value, invalid)
+	if err != nil {
+		return
+	}
+
+	for _, name := range types {
+		known := false
+		for _, schemaType := range schemaTypes {
+			known = known || name == schemaType
+		}
+
+		if !known {
+			err = InvalidSchemaError{Message: schemaPath(path) + " has the unknown type " + strconv.Quote(name)}
+			return
+		}
+	}
+
+	return
+}
+
+func compileStrings(value interface{}, invalid error) (texts []string, err error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		err = invalid
+		return
+	}
+
+	texts = []string{}
+	for _, item := range values {
+		text, ok := item.(string)
+		if !ok {
+			err = invalid
+			return
+		}
+
+		texts = append(texts, text)
+	}
+
+	return
+}
+
+func compileNumber(value interface{}, invalid error) (number *float64, err error) {
+	typed, ok := value.(float64)
+	if !ok {
+		err = invalid
+		return
+	}
+
+	number = &typed
+	return
+}
+
+func compileCount(value interface{}, invalid error) (count *int, err error) {
+	typed, ok := value.(float64)
+	if !ok || typed < 0 || typed != math.Trunc(typed) {
+		err = invalid
+		return
+	}
+
+	converted := int(typed)
+	count = &converted
+	return
+}
+
+func compileSchemas(value interface{}, path string, invalid error) (schemas []*compiledSchema, err error) {
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		err = invalid
+		return
+	}
+
+	for i, item := range values {
+		schema, compileError := compileSchema(item, path+"/"+strconv.Itoa(i))
+		if compileError != nil {
+			err = compileError
+			return
+		}
+
+		schemas = append(schemas, schema)
+	}
+
+	return
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "the schema"
+	}
+
+	return "#" + path
+}
+
+func escapePointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// validate appends a violation for every part of value, found at path, that
+// does not match the schema.
+func (schema *compiledSchema) validate(value interface{}, path string, violations []Violation) []Violation {
+	if schema == nil {
+		return violations
+	}
+
+	if schema.never {
+		return append(violations, Violation{Path: path, Message: "is not allowed"})
+	}
+
+	if len(schema.types) > 0 && !matchesSchemaType(value, schema.types) {
+		return append(violations, Violation{Path: path, Message: "must be of type " + strings.Join(schema.types, " or ")})
+	}
+
+	if schema.enum != nil {
+		found := false
+		for _, allowed := range schema.enum {
+			found = found || reflect.DeepEqual(value, allowed)
+		}
+
+		if !found {
+			violations = append(violations, Violation{Path: path, Message: "must be one of the values in enum"})
+		}
+	}
+
+	if schema.hasConst && !reflect.DeepEqual(value, schema.constant) {
+		violations = append(violations, Violation{Path: path, Message: "must be equal to const"})
+	}
+
+	switch typed := value.(type) {
+	case float64:
+		violations = schema.validateNumber(typed, path, violations)
+	case string:
+		violations = schema.validateString(typed, path, violations)
+	case []interface{}:
+		violations = schema.validateArray(typed, path, violations)
+	case map[string]interface{}:
+		violations = schema.validateObject(typed, path, violations)
+	}
+
+	for _, subschema := range schema.allOf {
+		violations = subschema.validate(value, path, violations)
+	}
+
+	if schema.anyOf != nil && countMatching(schema.anyOf, value) == 0 {
+		violations = append(violations, Violation{Path: path, Message: "must match at least one schema in anyOf"})
+	}
+
+	if schema.oneOf != nil && countMatching(schema.oneOf, value) != 1 {
+		violations = append(violations, Violation{Path: path, Message: "must match exactly one schema in oneOf"})
+	}
+
+	if schema.not != nil && len(schema.not.validate(value, path, nil)) == 0 {
+		violations = append(violations, Violation{Path: path, Message: "must not match the schema in not"})
+	}
+
+	return violations
+}
+
+func (schema *compiledSchema) validateNumber(number float64, path string, violations []Violation) []Violation {
+	if schema.minimum != nil && number < *schema.minimum {
+		violations = append(violations, Violation{Path: path, Message: "must be at least " + formatSchemaNumber(*schema.minimum)})
+	}
+
+	if schema.maximum != nil && number > *schema.maximum {
+		violations = append(violations, Violation{Path: path, Message: "must be at most " + formatSchemaNumber(*schema.maximum)})
+	}
+
+	if schema.exclusiveMinimum != nil && number <= *schema.exclusiveMinimum {
+		violations = append(violations, Violation{Path: path, Message: "must be greater than " + formatSchemaNumber(*schema.exclusiveMinimum)})
+	}
+
+	if schema.exclusiveMaximum != nil && number >= *schema.exclusiveMaximum {
+		violations = append(violations, Violation{Path: path, Message: "must be less than " + formatSchemaNumber(*schema.exclusiveMaximum)})
+	}
+
+	return violations
+}
+
+func (schema *compiledSchema) validateString(text string, path string, violations []Violation) []Violation {
+	length := utf8.RuneCountInString(text)
+
+	if schema.minLength != nil && length < *schema.minLength {
+		violations = append(violations, Violation{Path: path, Message: "must be at least " + strconv.Itoa(*schema.minLength) + " characters long"})
+	}
+
+	if schema.maxLength != nil && length > *schema.maxLength {
+		violations = append(violations, Violation{Path: path, Message: "must be at most " + strconv.Itoa(*schema.maxLength) + " characters long"})
+	}
+
+	if schema.pattern != nil && !schema.pattern.MatchString(text) {
+		violations = append(violations, Violation{Path: path, Message: "must match the pattern " + strconv.Quote(schema.pattern.String())})
+	}
+
+	return violations
+}
+
+func (schema *compiledSchema) validateArray(items []interface{}, path string, violations []Violation) []Violation {
+	if schema.minItems != nil && len(items) < *schema.minItems {
+		violations = append(violations, Violation{Path: path, Message: "must have at least " + strconv.Itoa(*schema.minItems) + " items"})
+	}
+
+	if schema.maxItems != nil && len(items) > *schema.maxItems {
+		violations = append(violations, Violation{Path: path, Message: "must have at most " + strconv.Itoa(*schema.maxItems) + " items"})
+	}
+
+	for i, item := range items {
+		violations = schema.items.validate(item, path+"/"+strconv.Itoa(i), violations)
+	}
+
+	return violations
+}
+
+func (schema *compiledSchema) validateObject(object map[string]interface{}, path string, violations []Violation) []Violation {
+	if schema.minProperties != nil && len(object) < *schema.minProperties {
+		violations = append(violations, Violation{Path: path, Message: "must have at least " + strconv.Itoa(*schema.minProperties) + " properties"})
+	}
+
+	if schema.maxProperties != nil && len(object) > *schema.maxProperties {
+		violations = append(violations, Violation{Path: path, Message: "must have at most " + strconv.Itoa(*schema.maxProperties) + " properties"})
+	}
+
+	for _, name := range schema.required {
+		if _, exists := object[name]; !exists {
+			violations = append(violations, Violation{Path: path + "/" + escapePointerToken(name), Message: "is required"})
+		}
+	}
+
+	names := []string{}
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertyPath := path + "/" + escapePointerToken(name)
+		if property, declared := schema.properties[name]; declared {
+			violations = property.validate(object[name], propertyPath, violations)
+		} else if schema.closed {
+			violations = append(violations, Violation{Path: propertyPath, Message: "is not allowed"})
+		} else {
+			violations = schema.additionalProperties.validate(object[name], propertyPath, violations)
+		}
+	}
+
+	return violations
+}
+
+func countMatching(schemas []*compiledSchema, value interface{}) (count int) {
+	for _, schema := range schemas {
+		if len(schema.validate(value, "", nil)) == 0 {
+			count++
+		}
+	}
+
+	return
+}
+
+func matchesSchemaType(value interface{}, types []string) bool {
+	for _, name := range types {
+		switch typed := value.(type) {
+		case nil:
+			if name == "null" {
+				return true
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case float64:
+			if name == "number" || (name == "integer" && typed == math.Trunc(typed)) {
+				return true
+			}
+		case string:
+			if name == "string" {
+				return true
+			}
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func formatSchemaNumber(number float64) string {
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+// validateDocument checks a document that is about to be stored against the
+// schema, without the fields that the collection manages itself.
+func validateDocument(schema *compiledSchema, collectionName string, id uuid.UUID, document map[string]interface{}) error {
+	if schema == nil {
+		return nil
+	}
+
+	validated := map[string]interface{}{}
+	for key, value := range document {
+		if key != "ID" && key != RevisionField && key != ExpiresAtField {
+			validated[key] = value
+		}
+	}
+
+	violations := schema.validate(validated, "", nil)
+	if len(violations) > 0 {
+		return ValidationError{ID: id, CollectionName: collectionName, Violations: violations}
+	}
+
+	return nil
+}
+
+// schemaFilename returns the schema file of a collection directory, which is
+// kept next to the directory like the lock file.
+func schemaFilename(directory string) string {
+	return filepath.Join(filepath.Dir(directory), "."+filepath.Base(directory)+schemaFileSuffix)
+}
+
+// readSchemaFile reads the schema of a collection directory, raw is nil when
+// there is none.
+func readSchemaFile(directory string) (raw []byte, schema *compiledSchema, err error) {
+	raw, err = ioutil.ReadFile(schemaFilename(directory))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	schema, err = parseSchema(raw)
+	return
+}
+
+func writeSchemaFile(directory string, raw []byte) (err error) {
+	if raw == nil {
+		err = os.Remove(schemaFilename(directory))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	err = writeFileAtomically(schemaFilename(directory), raw, 0600)
+	return
+}
+
+func (collection FilesystemCollection) SetSchema(schema []byte) (err error) {
+	_, err = parseSchema(schema)
+	if err != nil {
+		return
+	}
+
+	lock := collection.createAndLock
+	if schema == nil {
+		lock = collection.lock
+	}
+
+	unlock, err := lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	err = writeSchemaFile(collection.getDirectory(), schema)
+	return
+}
+
+func (collection FilesystemCollection) Schema() (schema []byte, err error) {
+	unlock, err := collection.rlock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	schema, _, err = readSchemaFile(collection.getDirectory())
+	return
+}
@@ -0,0 +1,753 @@
+package collection
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+)
+
+var _ Collection = &SQLiteCollection{}
+var _ Backend = &SQLiteBackend{}
+var _ Expirer = &SQLiteCollection{}
+var _ SchemaValidator = &SQLiteCollection{}
+var _ Historian = &SQLiteCollection{}
+var _ HistoryKeeper = &SQLiteCollection{}
+
+var sqliteTables = []string{
+	`CREATE TABLE IF NOT EXISTS entries (
+		collection TEXT NOT NULL,
+		id TEXT NOT NULL,
+		document TEXT NOT NULL,
+		PRIMARY KEY (collection, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schemas (
+		collection TEXT NOT NULL PRIMARY KEY,
+		schema TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS history_retention (
+		collection TEXT NOT NULL PRIMARY KEY,
+		revisions INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS history (
+		collection TEXT NOT NULL,
+		id TEXT NOT NULL,
+		records TEXT NOT NULL,
+		PRIMARY KEY (collection, id)
+	)`,
+}
+
+// sqliteDriverName is the sqlite3 driver with the functions that filters are
+// translated to, see sqlFilter.
+const sqliteDriverName = "sqlite3_storage"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(connection *sqlite3.SQLiteConn) (err error) {
+			err = connection.RegisterFunc("storage_compare", sqliteCompare, true)
+			if err != nil {
+				return
+			}
+
+			err = connection.RegisterFunc("storage_regexp", sqliteRegexp, true)
+			return
+		},
+	})
+}
+
+// SQLiteBackend stores every collection in a single SQLite database file, one
+// row per entry with the entry as a JSON document.
+type SQLiteBackend struct {
+	db *sql.DB
+}
+
+func OpenSQLiteBackend(filename string) (backend *SQLiteBackend, err error) {
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open(sqliteDriverName, filename)
+	if err != nil {
+		return
+	}
+
+	// A single connection serializes the writes, SQLite only allows one
+	// writer at a time anyway.
+	db.SetMaxOpenConns(1)
+
+	for _, table := range sqliteTables {
+		_, err = db.Exec(table)
+		if err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	backend = &SQLiteBackend{db: db}
+	return
+}
+
+func (backend *SQLiteBackend) Collection(name string) *SQLiteCollection {
+	return &SQLiteCollection{db: backend.db, name: name}
+}
+
+func (backend *SQLiteBackend) Open(name string) (Collection, error) {
+	return backend.Collection(name), nil
+}
+
+func (backend *SQLiteBackend) Info() (collectionsInfo CollectionsInfo, err error) {
+	collectionsInfo = CollectionsInfo{}
+
+	rows, err := backend.db.Query("SELECT collection, COUNT(*) FROM entries GROUP BY collection ORDER BY collection")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		info := CollectionInfo{}
+		err = rows.Scan(&info.Name, &info.Entries)
+		if err != nil {
+			return
+		}
+
+		info.Path = "/" + info.Name + "/"
+		collectionsInfo = append(collectionsInfo, info)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (backend *SQLiteBackend) Close() error {
+	return backend.db.Close()
+}
+
+// SQLiteCollection is a collection in a SQLiteBackend. Filters are translated
+// into SQL using the JSON functions of SQLite to narrow down the entries that
+// are read, the full filter is then applied to those entries like in
+// FilesystemCollection so that the results are the same.
+type SQLiteCollection struct {
+	db   *sql.DB
+	name string
+}
+
+func (collection *SQLiteCollection) GetName() string {
+	return collection.name
+}
+
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (collection *SQLiteCollection) loadRawWith(queryer sqlQueryer) func(id uuid.UUID) ([]byte, error) {
+	return func(id uuid.UUID) (raw []byte, err error) {
+		err = queryer.QueryRow("SELECT document FROM entries WHERE collection = ? AND id = ?", collection.name, id.String()).Scan(&raw)
+		if err == sql.ErrNoRows {
+			err = EntryDoesNotExistError{}
+		}
+
+		return unlessExpired(raw, err)
+	}
+}
+
+func (collection *SQLiteCollection) loadSchemaWith(queryer sqlQueryer) (raw []byte, schema *compiledSchema, err error) {
+	err = queryer.QueryRow("SELECT schema FROM schemas WHERE collection = ?", collection.name).Scan(&raw)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	schema, err = parseSchema(raw)
+	return
+}
+
+func storeDocument(transaction *sql.Tx, collectionName string, id uuid.UUID, document []byte) (err error) {
+	_, err = transaction.Exec("INSERT OR REPLACE INTO entries (collection, id, document) VALUES (?, ?, ?)", collectionName, id.String(), string(document))
+	return
+}
+
+func removeDocument(transaction *sql.Tx, collectionName string, id uuid.UUID) (err error) {
+	_, err = transaction.Exec("DELETE FROM entries WHERE collection = ? AND id = ?", collectionName, id.String())
+	return
+}
+
+// inTransaction runs change in a transaction that is committed if change
+// succeeds and rolled back otherwise.
+func (collection *SQLiteCollection) inTransaction(change func(transaction *sql.Tx) error) (err error) {
+	transaction, err := collection.db.Begin()
+	if err != nil {
+		return
+	}
+
+	err = change(transaction)
+	if err != nil {
+		transaction.Rollback()
+		return
+	}
+
+	err = transaction.Commit()
+	return
+}
+
+// Persist stores the entry whether it exists or not, see Upsert.
+func (collection *SQLiteCollection) Persist(entry Entry) (err error) {
+	_, err = collection.write(entry, writeUpsert)
+	return
+}
+
+func (collection *SQLiteCollection) Insert(entry Entry) (err error) {
+	_, err = collection.write(entry, writeInsert)
+	return
+}
+
+func (collection *SQLiteCollection) Replace(entry Entry) (err error) {
+	_, err = collection.write(entry, writeReplace)
+	return
+}
+
+func (collection *SQLiteCollection) Upsert(entry Entry) (created bool, err error) {
+	return collection.write(entry, writeUpsert)
+}
+
+func (collection *SQLiteCollection) write(entry Entry, mode writeMode) (created bool, err error) {
+	if entry.GetID() == uuid.Nil {
+		if mode == writeReplace {
+			err = EntryDoesNotExistError{}
+			return
+		}
+
+		entry.SetID(uuid.Must(uuid.NewV4()))
+	}
+
+	revision := uint64(0)
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		oldRaw, err := collection.loadRawWith(transaction)(entry.GetID())
+		exists := err == nil
+		if _, ok := err.(EntryDoesNotExistError); ok {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+
+		if exists && mode == writeInsert {
+			err = EntryAlreadyExistsError{}
+			return
+		} else if !exists && mode == writeReplace {
+			err = EntryDoesNotExistError{}
+			return
+		}
+
+		oldDocument := parseDocument(oldRaw)
+		err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(oldDocument))
+		if err != nil {
+			return
+		}
+
+		serialized, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+
+		_, schema, err := collection.loadSchemaWith(transaction)
+		if err != nil {
+			return
+		}
+
+		_, stored, nextRevisionNumber, err := nextRevision(collection.GetName(), entry.GetID(), serialized, oldDocument, schema)
+		if err != nil {
+			return
+		}
+
+		err = storeDocument(transaction, collection.GetName(), entry.GetID(), stored)
+		if err != nil {
+			return
+		}
+
+		err = collection.recordHistory(transaction, entry.GetID(), oldRaw, stored)
+		revision = nextRevisionNumber
+		created = !exists
+		return
+	})
+	if err != nil {
+		created = false
+		return
+	}
+
+	setRevision(entry, revision)
+	return
+}
+
+func (collection *SQLiteCollection) Delete(entry Entry) (err error) {
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		oldRaw, err := collection.loadRawWith(transaction)(entry.GetID())
+		if err != nil {
+			return
+		}
+
+		err = checkRevision(entry.GetID(), getExpectedRevision(entry), documentRevision(parseDocument(oldRaw)))
+		if err != nil {
+			return
+		}
+
+		err = collection.remove(transaction, entry.GetID(), oldRaw)
+		return
+	})
+
+	return
+}
+
+// remove deletes the stored entry and records it in the history.
+func (collection *SQLiteCollection) remove(transaction *sql.Tx, id uuid.UUID, oldRaw []byte) (err error) {
+	err = removeDocument(transaction, collection.GetName(), id)
+	if err != nil {
+		return
+	}
+
+	err = collection.recordHistory(transaction, id, oldRaw, nil)
+	return
+}
+
+// WriteBatch applies every operation of the batch in one transaction.
+func (collection *SQLiteCollection) WriteBatch(batch Batch) (err error) {
+	var operations []journalOperation
+	var revisions []uint64
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		_, schema, err := collection.loadSchemaWith(transaction)
+		if err != nil {
+			return
+		}
+
+		batchOperations, batchRevisions, err := prepareBatch(collection.GetName(), batch, collection.loadRawWith(transaction), schema)
+		if err != nil {
+			return
+		}
+
+		for _, operation := range batchOperations {
+			if operation.Document != nil {
+				err = storeDocument(transaction, collection.GetName(), operation.ID, operation.Document)
+			} else {
+				err = removeDocument(transaction, collection.GetName(), operation.ID)
+			}
+			if err != nil {
+				return
+			}
+
+			err = collection.recordHistory(transaction, operation.ID, operation.Previous, operation.Document)
+			if err != nil {
+				return
+			}
+		}
+
+		operations, revisions = batchOperations, batchRevisions
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	finishBatch(batch, operations, revisions)
+	return
+}
+
+func (collection *SQLiteCollection) Patch(id uuid.UUID, patch Patch, entry Entry) (err error) {
+	expectedRevision := uint64(0)
+	if entry != nil {
+		expectedRevision = getExpectedRevision(entry)
+	}
+
+	var stored []byte
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		raw, err := collection.loadRawWith(transaction)(id)
+		if err != nil {
+			return
+		}
+
+		oldDocument := parseDocument(raw)
+		err = checkRevision(id, expectedRevision, documentRevision(oldDocument))
+		if err != nil {
+			return
+		}
+
+		patched, err := applyPatch(raw, id, patch)
+		if err != nil {
+			return
+		}
+
+		_, schema, err := collection.loadSchemaWith(transaction)
+		if err != nil {
+			return
+		}
+
+		_, stored, _, err = nextRevision(collection.GetName(), id, patched, oldDocument, schema)
+		if err != nil {
+			return
+		}
+
+		err = storeDocument(transaction, collection.GetName(), id, stored)
+		if err != nil {
+			return
+		}
+
+		err = collection.recordHistory(transaction, id, raw, stored)
+		return
+	})
+	if err != nil || entry == nil {
+		return
+	}
+
+	err = json.Unmarshal(stored, entry)
+	return
+}
+
+func (collection *SQLiteCollection) Load(id uuid.UUID, entry Entry) (err error) {
+	raw, err := collection.loadRawWith(collection.db)(id)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+func (collection *SQLiteCollection) LoadAll(entries interface{}, limit int) (err error) {
+	_, err = collection.LoadAllWithOptions(entries, QueryOptions{Limit: limit})
+	return
+}
+
+func (collection *SQLiteCollection) LoadAllWithOptions(entries interface{}, options QueryOptions) (result QueryResult, err error) {
+	return collection.QueryWithOptions(nil, options, entries)
+}
+
+func (collection *SQLiteCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
+	_, err = collection.QueryWithOptions(filter, QueryOptions{Limit: limit}, entries)
+	return
+}
+
+func (collection *SQLiteCollection) QueryWithOptions(filter interface{}, options QueryOptions, entries interface{}) (result QueryResult, err error) {
+	err = options.Validate()
+	if err != nil {
+		return
+	}
+
+	where, args, exact := sqlFilter(filter, filtersDocuments(entries))
+	order := " ORDER BY id"
+	if exact {
+		page, pageArgs, remaining, ok, pageError := sqlPage(options)
+		if pageError != nil {
+			err = pageError
+			return
+		}
+
+		if ok {
+			where, order, options = where+page, "", remaining
+			args = append(args, pageArgs...)
+		}
+	}
+
+	rows, err := collection.db.Query("SELECT id, document FROM entries WHERE collection = ?"+where+order, append([]interface{}{collection.name}, args...)...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	documents := map[uuid.UUID][]byte{}
+	for rows.Next() {
+		var idString string
+		var document []byte
+		err = rows.Scan(&idString, &document)
+		if err != nil {
+			return
+		}
+
+		id, parseError := uuid.FromString(idString)
+		if parseError != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+		documents[id] = document
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	loadRaw := func(id uuid.UUID) (raw []byte, err error) {
+		raw, exists := documents[id]
+		if !exists {
+			err = EntryDoesNotExistError{}
+		}
+
+		return unlessExpired(raw, err)
+	}
+
+	result, err = loadMatching(collection.GetName(), ids, loadRaw, filter, options, entries)
+	return
+}
+
+func (collection *SQLiteCollection) SetSchema(schema []byte) (err error) {
+	_, err = parseSchema(schema)
+	if err != nil {
+		return
+	}
+
+	if schema == nil {
+		_, err = collection.db.Exec("DELETE FROM schemas WHERE collection = ?", collection.name)
+		return
+	}
+
+	_, err = collection.db.Exec("INSERT OR REPLACE INTO schemas (collection, schema) VALUES (?, ?)", collection.name, string(schema))
+	return
+}
+
+func (collection *SQLiteCollection) Schema() (schema []byte, err error) {
+	schema, _, err = collection.loadSchemaWith(collection.db)
+	return
+}
+
+func (collection *SQLiteCollection) historyRetentionWith(queryer sqlQueryer) (revisions int, err error) {
+	err = queryer.QueryRow("SELECT revisions FROM history_retention WHERE collection = ?", collection.name).Scan(&revisions)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return
+}
+
+func (collection *SQLiteCollection) historyWith(queryer sqlQueryer, id uuid.UUID) (records []HistoryRecord, err error) {
+	var raw []byte
+	err = queryer.QueryRow("SELECT records FROM history WHERE collection = ? AND id = ?", collection.name, id.String()).Scan(&raw)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, &records)
+	return
+}
+
+// recordHistory adds a write to the history of the entry if the collection
+// keeps history.
+func (collection *SQLiteCollection) recordHistory(transaction *sql.Tx, id uuid.UUID, previous []byte, document []byte) (err error) {
+	retention, err := collection.historyRetentionWith(transaction)
+	if err != nil || retention == 0 {
+		return
+	}
+
+	records, err := collection.historyWith(transaction, id)
+	if err != nil {
+		return
+	}
+
+	serialized, err := json.Marshal(appendHistory(records, previous, document, retention, time.Now()))
+	if err != nil {
+		return
+	}
+
+	_, err = transaction.Exec("INSERT OR REPLACE INTO history (collection, id, records) VALUES (?, ?, ?)", collection.name, id.String(), string(serialized))
+	return
+}
+
+func (collection *SQLiteCollection) SetHistoryRetention(revisions int) (err error) {
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		if revisions != 0 {
+			_, err = transaction.Exec("INSERT OR REPLACE INTO history_retention (collection, revisions) VALUES (?, ?)", collection.name, revisions)
+			return
+		}
+
+		_, err = transaction.Exec("DELETE FROM history_retention WHERE collection = ?", collection.name)
+		if err != nil {
+			return
+		}
+
+		_, err = transaction.Exec("DELETE FROM history WHERE collection = ?", collection.name)
+		return
+	})
+
+	return
+}
+
+func (collection *SQLiteCollection) HistoryRetention() (revisions int, err error) {
+	return collection.historyRetentionWith(collection.db)
+}
+
+// History returns the stored revisions of the entry, oldest first.
+func (collection *SQLiteCollection) History(id uuid.UUID) (records []HistoryRecord, err error) {
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		stored, err := collection.historyWith(transaction, id)
+		if err != nil {
+			return
+		}
+
+		current, err := collection.loadRawWith(transaction)(id)
+		records, err = historyOrCurrent(stored, current, err)
+		return
+	})
+
+	return
+}
+
+func (collection *SQLiteCollection) LoadRevision(id uuid.UUID, revision uint64, entry Entry) (err error) {
+	records, err := collection.History(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findRevision(records, id, revision)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+// LoadAsOf loads the revision of the entry that was stored at the time.
+func (collection *SQLiteCollection) LoadAsOf(id uuid.UUID, at time.Time, entry Entry) (err error) {
+	records, err := collection.History(id)
+	if err != nil {
+		return
+	}
+
+	raw, err := findAsOf(records, at)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, entry)
+	return
+}
+
+func (collection *SQLiteCollection) Revert(id uuid.UUID, revision uint64, entry Entry) error {
+	return revert(collection, collection.History, id, revision, entry)
+}
+
+// RemoveExpired deletes the entries whose expiry time has passed.
+func (collection *SQLiteCollection) RemoveExpired() (removed int, err error) {
+	err = collection.inTransaction(func(transaction *sql.Tx) (err error) {
+		rows, err := transaction.Query("SELECT id, document FROM entries WHERE collection = ? AND json_extract(document, '$."+ExpiresAtField+"') IS NOT NULL", collection.name)
+		if err != nil {
+			return
+		}
+
+		now := time.Now()
+		expired := map[uuid.UUID][]byte{}
+		for rows.Next() {
+			var idString string
+			var document []byte
+			err = rows.Scan(&idString, &document)
+			if err != nil {
+				rows.Close()
+				return
+			}
+
+			id, parseError := uuid.FromString(idString)
+			if parseError == nil && documentExpired(document, now) {
+				expired[id] = document
+			}
+		}
+		rows.Close()
+
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+
+		for id, document := range expired {
+			err = collection.remove(transaction, id, document)
+			if err != nil {
+				return
+			}
+		}
+
+		removed = len(expired)
+		return
+	})
+	if err != nil {
+		removed = 0
+	}
+
+	return
+}
+
+// sqlNotExpired matches the documents that documentExpired does not consider
+// expired at the time given as argument.
+const sqlNotExpired = "(json_type(document, '$." + ExpiresAtField + "') IS NOT 'text'" +
+	" OR json_extract(document, '$." + ExpiresAtField + "') = '0001-01-01T00:00:00Z'" +
+	" OR julianday(json_extract(document, '$." + ExpiresAtField + "')) IS NULL" +
+	" OR julianday(json_extract(document, '$." + ExpiresAtField + "')) > julianday(?))"
+
+// sqlPage translates the cursor, offset, limit and sort of options into SQL
+// for a filter that is translated exactly, which is possible without sort
+// fields or when sorting on the ID alone. Other sort fields are left to
+// compareValues, which orders mixed types differently than SQLite does. The
+// returned options are what is left for loadMatching to apply.
+func sqlPage(options QueryOptions) (clause string, args []interface{}, remaining QueryOptions, ok bool, err error) {
+	descending := false
+	if len(options.Sort) == 1 && options.Sort[0].Field == "ID" {
+		descending = options.Sort[0].Descending
+	} else if len(options.Sort) > 0 {
+		return
+	}
+
+	if options.Cursor != "" {
+		position, cursorError := decodeCursor(options.Cursor, options.Sort)
+		if cursorError != nil {
+			err = cursorError
+			return
+		}
+
+		lastID, cursorError := cursorID(position)
+		if cursorError != nil {
+			err = cursorError
+			return
+		}
+
+		if descending {
+			clause += " AND id < ?"
+		} else {
+			clause += " AND id > ?"
+		}
+		args = append(args, lastID.String())
+	}
+
+	// Expired entries are left out by loadMatching as well, but they must not
+	// count towards the offset and limit.
+	clause += " AND " + sqlNotExpired
+	args = append(args, time.Now().UTC().Format(time.RFC3339Nano))
+
+	clause += " ORDER BY id"
+	if descending {
+		clause += " DESC"
+	}
+
+	// One more entry than the limit is read to tell whether there is a next page.
+	if options.Limit != 0 {
+		clause += " LIMIT ? OFFSET ?"
+		args = append(args, options.Limit+1, options.Offset)
+	} else if options.Offset != 0 {
+		clause += " LIMIT -1 OFFSET ?"
+		args = append(args, options.Offset)
+	}
+
+	remaining = options
+	remaining.Offset = 0
+	remaining.Cursor = ""
+	ok = true
+	return
+}
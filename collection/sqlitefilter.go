@@ -0,0 +1,553 @@
+package collection
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// sqlCondition is a filter field translated into an SQL condition on the
+// stored documents. An empty clause does not restrict the documents. exact is
+// set when the clause matches the same documents as the filter field, without
+// it the clause matches more and only narrows down the documents that are read.
+type sqlCondition struct {
+	clause string
+	args   []interface{}
+	exact  bool
+}
+
+var sqlOperators = map[Operator]string{
+	OperatorEqual:              "=",
+	OperatorGreaterThan:        ">",
+	OperatorGreaterThanOrEqual: ">=",
+	OperatorLessThan:           "<",
+	OperatorLessThanOrEqual:    "<=",
+}
+
+// sqlFilter translates a filter into SQL conditions on the stored documents,
+// exact is set when they match the same entries as the filter. The filter is
+// applied to the entries after they have been unmarshalled, so conditions are
+// only exact when documents is set, i.e. when the entries are maps that hold
+// the documents as they are stored. Struct entries only get the equality
+// conditions, which narrow down the entries that are read.
+func sqlFilter(filter interface{}, documents bool) (where string, args []interface{}, exact bool) {
+	if filter == nil {
+		exact = true
+		return
+	}
+
+	filterValue := reflect.ValueOf(filter)
+	if filterValue.Kind() == reflect.Map && filterValue.Type().Key().Kind() != reflect.String {
+		return
+	} else if filterValue.Kind() != reflect.Struct && filterValue.Kind() != reflect.Map {
+		// passesFilter lets no entry pass other filters.
+		where, exact = " AND 0", true
+		return
+	}
+
+	constraints := map[string]interface{}{}
+	collectEqualityConstraints(filterValue, constraints)
+
+	id, byID := idConstraint(constraints)
+	if byID {
+		where += " AND id = ?"
+		args = append(args, id.String())
+	}
+
+	filterFields := FilterFields(filter)
+	fields := []string{}
+	for field := range filterFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	exact = true
+	for _, field := range fields {
+		condition := sqlField(field, filterFields[field], documents)
+		exact = exact && condition.exact
+		if condition.clause != "" {
+			where += " AND " + condition.clause
+			args = append(args, condition.args...)
+		}
+	}
+
+	if !documents {
+		exact = len(filterFields) == 0 || (byID && len(filterFields) == 1 && fmt.Sprint(constraints["ID"]) == id.String())
+	}
+
+	return
+}
+
+// filtersDocuments reports whether entries points to a slice of maps, which
+// the stored documents are unmarshalled into without changing them.
+func filtersDocuments(entries interface{}) bool {
+	entriesType := reflect.TypeOf(entries)
+	if entriesType == nil || entriesType.Kind() != reflect.Ptr || entriesType.Elem().Kind() != reflect.Slice {
+		return false
+	}
+
+	elementType := entriesType.Elem().Elem()
+	return elementType.Kind() == reflect.Map && elementType.Key().Kind() == reflect.String && elementType.Elem().Kind() == reflect.Interface
+}
+
+// sqlField translates a filter field. A dotted field can be a single key or a
+// path into nested objects, so it is translated into a condition on either,
+// which is never exact.
+func sqlField(field string, value interface{}, documents bool) sqlCondition {
+	paths := sqlJSONPaths(field)
+	if len(paths) == 0 {
+		return sqlCondition{}
+	}
+
+	if documents && len(paths) == 1 {
+		return sqlFieldValue(paths[0], value, false, false)
+	}
+
+	alternatives := []string{}
+	args := []interface{}{}
+	for _, path := range paths {
+		condition := sqlFieldValue(path, value, true, !documents)
+		if condition.clause == "" {
+			return sqlCondition{}
+		}
+
+		alternatives = append(alternatives, condition.clause)
+		args = append(args, condition.args...)
+	}
+
+	return sqlCondition{clause: "(" + strings.Join(alternatives, " OR ") + ")", args: args}
+}
+
+// sqlJSONPaths returns the JSON paths lookupPath can resolve a field to, the
+// field as a single key and split on its dot. Fields with more dots, which
+// lookupPath can split in more ways, fields that index into arrays and fields
+// with characters that are escaped in the stored keys are not translated.
+func sqlJSONPaths(field string) (paths []string) {
+	if strings.Count(field, ".") > 1 || strings.ContainsAny(field, "\"\\<>&\u2028\u2029") || strings.IndexFunc(field, unicode.IsControl) >= 0 {
+		return
+	}
+
+	paths = append(paths, "$.\""+field+"\"")
+	if !strings.Contains(field, ".") {
+		return
+	}
+
+	segments := strings.Split(field, ".")
+	for _, segment := range segments {
+		if segment == "" || strings.Trim(segment, "0123456789") == "" {
+			return nil
+		}
+	}
+
+	paths = append(paths, "$.\""+strings.Join(segments, "\".\"")+"\"")
+	return
+}
+
+// sqlFieldValue translates the value of a filter field for the field at path.
+// With superset set only conditions that match more documents when the path
+// is not the one the filter looks at are translated, i.e. none that match
+// missing fields, and with equalityOnly only equality is translated.
+func sqlFieldValue(path string, value interface{}, superset bool, equalityOnly bool) sqlCondition {
+	if value == nil {
+		if superset {
+			return sqlCondition{}
+		}
+
+		return sqlMissing(path)
+	}
+
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() == reflect.Ptr {
+		reflected = reflected.Elem()
+	}
+	if !reflected.IsValid() {
+		return sqlCondition{}
+	}
+
+	switch reflected.Type() {
+	case conditionType:
+		return sqlConditions(path, Conditions{reflected.Interface().(Condition)}, superset, equalityOnly)
+	case conditionsType:
+		return sqlConditions(path, reflected.Interface().(Conditions), superset, equalityOnly)
+	}
+
+	if reflected.Kind() == reflect.Ptr {
+		return sqlCondition{}
+	}
+
+	return sqlEquality(path, reflected.Interface(), superset)
+}
+
+func sqlConditions(path string, conditions Conditions, superset bool, equalityOnly bool) sqlCondition {
+	translated := sqlCondition{exact: true}
+	clauses := []string{}
+	for _, condition := range conditions {
+		conditionClause := sqlConditionClause(path, condition, superset, equalityOnly)
+		translated.exact = translated.exact && conditionClause.exact
+		if conditionClause.clause != "" {
+			clauses = append(clauses, conditionClause.clause)
+			translated.args = append(translated.args, conditionClause.args...)
+		}
+	}
+
+	if len(clauses) > 0 {
+		translated.clause = "(" + strings.Join(clauses, " AND ") + ")"
+	}
+
+	return translated
+}
+
+// sqlConditionClause translates a condition like Condition.passes applies it.
+func sqlConditionClause(path string, condition Condition, superset bool, equalityOnly bool) sqlCondition {
+	if equalityOnly && condition.Operator != OperatorEqual {
+		return sqlCondition{}
+	}
+
+	switch condition.Operator {
+	case "":
+		return sqlCondition{exact: true}
+	case OperatorEqual:
+		return sqlEquality(path, condition.Value, superset)
+	case OperatorNotEqual:
+		return sqlNot(sqlEquality(path, condition.Value, false), superset)
+	case OperatorIn:
+		return sqlIn(path, condition.Value, superset)
+	case OperatorNotIn:
+		return sqlNot(sqlIn(path, condition.Value, false), superset)
+	case OperatorExists:
+		if expected, _ := condition.Value.(bool); expected {
+			return sqlExists(path)
+		} else if superset {
+			return sqlCondition{}
+		}
+
+		return sqlMissing(path)
+	case OperatorGreaterThan, OperatorGreaterThanOrEqual, OperatorLessThan, OperatorLessThanOrEqual:
+		return sqlComparison(path, condition.Operator, condition.Value)
+	case OperatorPrefix, OperatorContains, OperatorRegex:
+		return sqlStringMatch(path, condition)
+	}
+
+	return sqlCondition{clause: "0", exact: true}
+}
+
+func sqlNot(condition sqlCondition, superset bool) sqlCondition {
+	if superset || !condition.exact {
+		return sqlCondition{}
+	} else if condition.clause == "" {
+		return sqlCondition{clause: "0", exact: true}
+	}
+
+	return sqlCondition{clause: "NOT " + condition.clause, args: condition.args, exact: true}
+}
+
+func sqlMissing(path string) sqlCondition {
+	return sqlCondition{clause: "(coalesce(json_type(entries.document, ?), 'null') = 'null')", args: []interface{}{path}, exact: true}
+}
+
+func sqlExists(path string) sqlCondition {
+	return sqlCondition{clause: "(coalesce(json_type(entries.document, ?), 'null') != 'null')", args: []interface{}{path}, exact: true}
+}
+
+// sqlEquality matches a field that is equal to the value, or an array that
+// contains it, like matchesValue. Null values also match missing fields.
+func sqlEquality(path string, value interface{}, superset bool) sqlCondition {
+	normalized, ok := normalizeValue(value)
+	if !ok {
+		return sqlCondition{clause: "0", exact: true}
+	}
+
+	matches := sqlMatches(path, normalized)
+	if !isNullValue(value) {
+		return matches
+	} else if superset || !matches.exact {
+		return sqlCondition{}
+	}
+
+	missing := sqlMissing(path)
+	return sqlCondition{
+		clause: "(" + missing.clause + " OR " + matches.clause + ")",
+		args:   append(missing.args, matches.args...),
+		exact:  true,
+	}
+}
+
+func sqlIn(path string, value interface{}, superset bool) sqlCondition {
+	translated := sqlCondition{exact: true}
+	clauses := []string{}
+	for _, element := range conditionValues(value) {
+		if isNullValue(element) {
+			if superset {
+				return sqlCondition{}
+			}
+
+			missing := sqlMissing(path)
+			clauses = append(clauses, missing.clause)
+			translated.args = append(translated.args, missing.args...)
+		}
+
+		normalized, ok := normalizeValue(element)
+		if !ok {
+			continue
+		}
+
+		matches := sqlMatches(path, normalized)
+		if !matches.exact {
+			return sqlCondition{}
+		}
+
+		clauses = append(clauses, matches.clause)
+		translated.args = append(translated.args, matches.args...)
+	}
+
+	if len(clauses) == 0 {
+		return sqlCondition{clause: "0", exact: true}
+	}
+
+	translated.clause = "(" + strings.Join(clauses, " OR ") + ")"
+	return translated
+}
+
+// sqlMatches matches the field against a normalized value like matchesValue,
+// objects are not translated.
+func sqlMatches(path string, value interface{}) sqlCondition {
+	array, isArray := value.([]interface{})
+	if !isArray {
+		if !isScalarValue(value) {
+			return sqlCondition{}
+		}
+
+		clause, args := sqlElementMatch(path, value)
+		return sqlCondition{clause: clause, args: args, exact: true}
+	}
+
+	clauses := []string{"coalesce(json_type(entries.document, ?), '') = 'array'"}
+	args := []interface{}{path}
+	for _, element := range array {
+		if !isScalarValue(element) {
+			return sqlCondition{}
+		}
+
+		clause, elementArgs := sqlElementMatch(path, element)
+		clauses = append(clauses, clause)
+		args = append(args, elementArgs...)
+	}
+
+	return sqlCondition{clause: "(" + strings.Join(clauses, " AND ") + ")", args: args, exact: true}
+}
+
+func isScalarValue(value interface{}) bool {
+	switch value.(type) {
+	case nil, string, float64, bool, UntypedValue:
+		return true
+	}
+
+	return false
+}
+
+// sqlElementMatch matches a field that is equal to the scalar value or an
+// array that contains it, at any depth of nested arrays but not in objects.
+// Those are the values json_tree finds at paths of array indexes only.
+func sqlElementMatch(path string, value interface{}) (clause string, args []interface{}) {
+	row, rowArgs := "json_tree.type = 'null'", []interface{}{}
+	if value != nil {
+		row, rowArgs = sqlRowComparison("json_tree", OperatorEqual, value)
+	}
+
+	clause = "EXISTS (SELECT 1 FROM json_tree(entries.document, ?) WHERE trim(substr(json_tree.fullkey, length(?) + 1), '[]0123456789') = '' AND " + row + ")"
+	args = append([]interface{}{path, path}, rowArgs...)
+	return
+}
+
+// sqlValue applies a condition on a json_value row that holds the type and
+// value of the field, so that the condition can be written like those on
+// json_each and json_tree rows.
+func sqlValue(path string, row string, rowArgs []interface{}) sqlCondition {
+	return sqlCondition{
+		clause: "EXISTS (SELECT 1 FROM (SELECT json_type(entries.document, ?) AS type, json_extract(entries.document, ?) AS value) AS json_value WHERE " + row + ")",
+		args:   append([]interface{}{path, path}, rowArgs...),
+		exact:  true,
+	}
+}
+
+func sqlComparison(path string, operator Operator, value interface{}) sqlCondition {
+	normalized, ok := normalizeValue(value)
+	if !ok || normalized == nil || !isScalarValue(normalized) {
+		return sqlCondition{clause: "0", exact: true}
+	}
+
+	row, args := sqlRowComparison("json_value", operator, normalized)
+	return sqlValue(path, row, args)
+}
+
+func sqlStringMatch(path string, condition Condition) sqlCondition {
+	pattern, isString := condition.Value.(string)
+	if !isString {
+		return sqlCondition{clause: "0", exact: true}
+	}
+
+	switch condition.Operator {
+	case OperatorPrefix:
+		return sqlValue(path, "json_value.type = 'text' AND substr(CAST(json_value.value AS BLOB), 1, ?) = CAST(? AS BLOB)", []interface{}{len(pattern), pattern})
+	case OperatorContains:
+		return sqlValue(path, "json_value.type = 'text' AND instr(CAST(json_value.value AS BLOB), CAST(? AS BLOB)) > 0", []interface{}{pattern})
+	}
+
+	return sqlValue(path, "json_value.type = 'text' AND storage_regexp(?, json_value.value)", []interface{}{pattern})
+}
+
+// sqlRowComparison compares the value of a json_each like row with a scalar
+// like compareValues. Numbers are compared in SQL and so are strings, unless
+// they hold times. Strings are compared to numbers as numbers, which is left
+// to storage_compare, like comparisons with times and untyped values.
+func sqlRowComparison(row string, operator Operator, value interface{}) (clause string, args []interface{}) {
+	compare := "storage_compare(?, " + row + ".type, " + row + ".value, ?, ?)"
+	numeric := row + ".type IN ('integer','real')"
+
+	switch typed := value.(type) {
+	case float64:
+		if !math.IsNaN(typed) {
+			clause = "((" + numeric + " AND " + row + ".value " + sqlOperators[operator] + " ?) OR (" + row + ".type = 'text' AND " + compare + "))"
+			args = []interface{}{typed, string(operator), "number", strconv.FormatFloat(typed, 'g', -1, 64)}
+			return
+		}
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, typed); err != nil {
+			clause = "(" + row + ".type = 'text' AND " + row + ".value " + sqlOperators[operator] + " ?)"
+			args = []interface{}{typed}
+
+			number, parseError := strconv.ParseFloat(typed, 64)
+			if parseError == nil && !math.IsNaN(number) {
+				clause = "(" + clause + " OR (" + numeric + " AND " + row + ".value " + sqlOperators[operator] + " ?))"
+				args = append(args, number)
+			} else if parseError == nil {
+				clause = "(" + clause + " OR (" + numeric + " AND " + compare + "))"
+				args = append(args, string(operator), "string", typed)
+			}
+			return
+		}
+	}
+
+	kind, text := "string", ""
+	switch typed := value.(type) {
+	case float64:
+		kind, text = "number", strconv.FormatFloat(typed, 'g', -1, 64)
+	case bool:
+		kind, text = "bool", strconv.FormatBool(typed)
+	case UntypedValue:
+		kind, text = "untyped", string(typed)
+	case string:
+		text = typed
+	}
+
+	clause = compare
+	args = []interface{}{string(operator), kind, text}
+	return
+}
+
+// sqliteCompare is the storage_compare function of the SQLite backend. It
+// compares the value of a json_each like row with a filter value of the given
+// kind like Condition.passes does.
+func sqliteCompare(operator string, entryType interface{}, entryValue interface{}, filterKind string, filterText string) bool {
+	var entry interface{}
+	switch entryType {
+	case "integer", "real":
+		switch typed := entryValue.(type) {
+		case int64:
+			entry = float64(typed)
+		case float64:
+			entry = typed
+		default:
+			return false
+		}
+	case "text":
+		switch typed := entryValue.(type) {
+		case string:
+			entry = typed
+		case []byte:
+			entry = string(typed)
+		default:
+			return false
+		}
+	case "true", "false":
+		entry = entryType == "true"
+	default:
+		return false
+	}
+
+	var filterValue interface{} = filterText
+	switch filterKind {
+	case "number":
+		number, err := strconv.ParseFloat(filterText, 64)
+		if err != nil {
+			return false
+		}
+		filterValue = number
+	case "bool":
+		filterValue = filterText == "true"
+	case "untyped":
+		filterValue = UntypedValue(filterText).coerce(entry)
+	}
+
+	if Operator(operator) == OperatorEqual {
+		return valuesEqual(entry, filterValue)
+	}
+
+	result, ok := compareValues(entry, filterValue)
+	if !ok {
+		return false
+	}
+
+	switch Operator(operator) {
+	case OperatorGreaterThan:
+		return result > 0
+	case OperatorGreaterThanOrEqual:
+		return result >= 0
+	case OperatorLessThan:
+		return result < 0
+	case OperatorLessThanOrEqual:
+		return result <= 0
+	}
+
+	return false
+}
+
+// maxSQLitePatterns limits the compiled patterns that are kept between calls
+// of storage_regexp.
+const maxSQLitePatterns = 1000
+
+var sqlitePatterns = map[string]*regexp.Regexp{}
+var sqlitePatternsMux sync.Mutex
+
+// sqliteRegexp is the storage_regexp function of the SQLite backend, invalid
+// patterns match nothing since the query is rejected by prepareFilter anyway.
+func sqliteRegexp(pattern string, value interface{}) bool {
+	text, isText := value.(string)
+	if !isText {
+		return false
+	}
+
+	sqlitePatternsMux.Lock()
+	compiled, compiledBefore := sqlitePatterns[pattern]
+	sqlitePatternsMux.Unlock()
+
+	if !compiledBefore {
+		compiled, _ = regexp.Compile(pattern)
+
+		sqlitePatternsMux.Lock()
+		if len(sqlitePatterns) >= maxSQLitePatterns {
+			sqlitePatterns = map[string]*regexp.Regexp{}
+		}
+		sqlitePatterns[pattern] = compiled
+		sqlitePatternsMux.Unlock()
+	}
+
+	return compiled != nil && compiled.MatchString(text)
+}
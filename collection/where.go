@@ -0,0 +1,87 @@
+package collection
+
+// Filter is a map filter built with Where. Every field holds explicit
+// Conditions, which means that zero values such as "", 0 and uuid.Nil are
+// matched instead of ignored like in struct filters.
+type Filter map[string]interface{}
+
+// FieldFilter adds a condition on a field to a Filter.
+type FieldFilter struct {
+	filter Filter
+	field  string
+}
+
+// Where starts a Filter with a condition on field, e.g.
+// Where("Count").Eq(0).And("Name").Eq("").
+func Where(field string) FieldFilter {
+	return Filter{}.And(field)
+}
+
+// And adds another condition to the filter, all conditions have to pass.
+func (filter Filter) And(field string) FieldFilter {
+	return FieldFilter{filter: filter, field: field}
+}
+
+func (field FieldFilter) with(condition Condition) (filter Filter) {
+	filter = Filter{}
+	for key, value := range field.filter {
+		filter[key] = value
+	}
+
+	conditions, _ := filter[field.field].(Conditions)
+	filter[field.field] = append(append(Conditions{}, conditions...), condition)
+	return
+}
+
+func (field FieldFilter) Eq(value interface{}) Filter {
+	return field.with(Eq(value))
+}
+
+func (field FieldFilter) Ne(value interface{}) Filter {
+	return field.with(Ne(value))
+}
+
+func (field FieldFilter) Gt(value interface{}) Filter {
+	return field.with(Gt(value))
+}
+
+func (field FieldFilter) Gte(value interface{}) Filter {
+	return field.with(Gte(value))
+}
+
+func (field FieldFilter) Lt(value interface{}) Filter {
+	return field.with(Lt(value))
+}
+
+func (field FieldFilter) Lte(value interface{}) Filter {
+	return field.with(Lte(value))
+}
+
+func (field FieldFilter) In(values ...interface{}) Filter {
+	return field.with(In(values...))
+}
+
+func (field FieldFilter) Nin(values ...interface{}) Filter {
+	return field.with(Nin(values...))
+}
+
+func (field FieldFilter) Exists(exists bool) Filter {
+	return field.with(Exists(exists))
+}
+
+// IsNull requires the field to be null or missing.
+func (field FieldFilter) IsNull() Filter {
+	return field.with(Eq(nil))
+}
+
+func (field FieldFilter) HasPrefix(prefix string) Filter {
+	return field.with(HasPrefix(prefix))
+}
+
+func (field FieldFilter) Contains(substring string) Filter {
+	return field.with(Contains(substring))
+}
+
+func (field FieldFilter) Matches(pattern string) Filter {
+	return field.with(Matches(pattern))
+}
@@ -1,8 +1,12 @@
 package main // import "github.com/mojlighetsministeriet/storage"
 
 import (
+	"log"
 	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/mojlighetsministeriet/storage/collection"
 	"github.com/mojlighetsministeriet/storage/remote"
 	"github.com/mojlighetsministeriet/utils"
 )
@@ -14,7 +18,41 @@ func main() {
 	}
 	bodyLimit := utils.GetEnv("BODY_LIMIT", "5M")
 	port := ":" + utils.GetEnv("PORT", "443")
+	dataDirectory := utils.GetEnv("DATA_DIR", collection.DefaultRoot)
 
-	service := remote.NewService(useTLS, true, bodyLimit)
+	var backend collection.Backend
+	switch utils.GetEnv("STORAGE_BACKEND", "filesystem") {
+	case "filesystem":
+		err := collection.RecoverFilesystemCollections(dataDirectory)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		backend = collection.FilesystemBackend{Root: dataDirectory}
+	case "memory":
+		backend = collection.NewMemoryBackend()
+	case "sqlite":
+		sqliteBackend, err := collection.OpenSQLiteBackend(utils.GetEnv("SQLITE_FILE", filepath.Join(dataDirectory, "collections.db")))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer sqliteBackend.Close()
+		backend = sqliteBackend
+	default:
+		log.Fatal("STORAGE_BACKEND must be filesystem, memory or sqlite")
+	}
+
+	sweepInterval, err := time.ParseDuration(utils.GetEnv("SWEEP_INTERVAL", remote.DefaultSweepInterval.String()))
+	if err != nil {
+		log.Fatal("SWEEP_INTERVAL must be a duration, e.g. 1m")
+	}
+
+	if sweepInterval > 0 {
+		sweeper := remote.StartSweeper(backend, sweepInterval)
+		defer sweeper.Stop()
+	}
+
+	service := remote.NewServiceWithBackend(useTLS, true, bodyLimit, backend)
 	service.Listen(port)
 }
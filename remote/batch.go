@@ -0,0 +1,93 @@
+package remote
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mojlighetsministeriet/storage/collection"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	batchPut    = "put"
+	batchDelete = "delete"
+)
+
+// batchRequest is the body of POST /:collection/_batch. Deletes only need
+// the ID and, for revision checks, the _revision of the entry.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchOperation struct {
+	Op    string      `json:"op"`
+	Entry interface{} `json:"entry"`
+}
+
+type deletedEntry struct {
+	ID       uuid.UUID
+	Revision uint64 `json:"_revision,omitempty"`
+}
+
+func encodeBatch(batch collection.Batch) (request batchRequest) {
+	for _, operation := range batch.Operations {
+		if operation.Delete {
+			entry := deletedEntry{ID: operation.Entry.GetID()}
+			if revisioned, ok := operation.Entry.(collection.Revisioned); ok {
+				entry.Revision = revisioned.GetRevision()
+			}
+
+			request.Operations = append(request.Operations, batchOperation{Op: batchDelete, Entry: entry})
+		} else {
+			request.Operations = append(request.Operations, batchOperation{Op: batchPut, Entry: operation.Entry})
+		}
+	}
+
+	return
+}
+
+func decodeBatch(request batchRequest) (batch collection.Batch, entries []*collection.UntypedEntry, err error) {
+	for _, operation := range request.Operations {
+		object, ok := operation.Entry.(map[string]interface{})
+		if !ok {
+			err = collection.InvalidBatchError{Message: "operation without entry"}
+			return
+		}
+
+		entry := collection.UntypedEntry(object)
+		entries = append(entries, &entry)
+
+		switch operation.Op {
+		case batchPut:
+			batch.Put(&entry)
+		case batchDelete:
+			batch.Delete(&entry)
+		default:
+			err = collection.InvalidBatchError{Message: "unknown operation " + operation.Op}
+			return
+		}
+	}
+
+	return
+}
+
+// translateBatchError turns the conflict returned by the service back into
+// the RevisionConflictError of the entry that failed the batch.
+func translateBatchError(err error) error {
+	responseError, ok := err.(ResponseError)
+	if !ok {
+		return err
+	}
+
+	switch responseError.StatusCode {
+	case http.StatusNotFound:
+		return collection.EntryDoesNotExistError{}
+	case http.StatusPreconditionFailed:
+		conflict := collection.RevisionConflictError{}
+		if json.Unmarshal(responseError.Body, &conflict) == nil {
+			return conflict
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,194 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/mojlighetsministeriet/storage/collection"
+)
+
+var _ collection.Watcher = &RemoteCollection{}
+
+const eventStreamContentType = "text/event-stream"
+
+// parseSince reads the sequence number to resume a change feed from, the
+// since query parameter or the Last-Event-ID header an EventSource sends when
+// it reconnects.
+func parseSince(context echo.Context) (since uint64, resume bool, err error) {
+	value := context.QueryParam("since")
+	if value == "" {
+		value = context.Request().Header.Get("Last-Event-ID")
+	}
+	if value == "" {
+		return
+	}
+
+	since, err = strconv.ParseUint(value, 10, 64)
+	resume = err == nil
+	return
+}
+
+// parseChangesFilter is parseFilter for the change feed, where since is the
+// sequence number to resume from rather than a field.
+func parseChangesFilter(values url.Values) (filter map[string]interface{}, err error) {
+	filterValues := url.Values{}
+	for key, value := range values {
+		if key != "since" {
+			filterValues[key] = value
+		}
+	}
+
+	return parseFilter(filterValues)
+}
+
+type compactedResponse struct {
+	Message string `json:"message"`
+	Oldest  uint64 `json:"oldest"`
+}
+
+// respondChangesCompacted tells a watcher that the changes it wants to resume
+// from are no longer kept.
+func respondChangesCompacted(context echo.Context, compactedError collection.ChangesCompactedError) error {
+	return context.JSON(http.StatusGone, compactedResponse{
+		Message: "Gone",
+		Oldest:  compactedError.Oldest,
+	})
+}
+
+// streamChanges writes the changes as Server-Sent Events until the channel is
+// closed, which happens when the client disconnects or after a change of type
+// error. Errors have no sequence number and are sent without an id, so that
+// an EventSource resumes after the last change it received.
+func streamChanges(context echo.Context, changes <-chan collection.Change) (err error) {
+	response := context.Response()
+	response.Header().Set("Content-Type", eventStreamContentType)
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	for change := range changes {
+		data, marshalError := json.Marshal(change)
+		if marshalError != nil {
+			return marshalError
+		}
+
+		event := "event: " + string(change.Type) + "\ndata: " + string(data) + "\n\n"
+		if change.Type != collection.ChangeError {
+			event = "id: " + strconv.FormatUint(change.Sequence, 10) + "\n" + event
+		}
+
+		_, err = response.Write([]byte(event))
+		if err != nil {
+			return
+		}
+		response.Flush()
+	}
+
+	return
+}
+
+// Watch sends the changes made to the collection from now on that pass the
+// filter. The channel is closed when ctx is done or the connection is lost, a
+// lost connection is reported with a change of type error first. WatchSince
+// with the last received sequence number resumes the feed.
+func (collection RemoteCollection) Watch(ctx context.Context, filter interface{}) (<-chan collection.Change, error) {
+	return openChangeStream(ctx, collection.httpClient, collection.url+"/_changes?"+encodeFilter(filter).Encode())
+}
+
+func (collection RemoteCollection) WatchSince(ctx context.Context, filter interface{}, since uint64) (changes <-chan collection.Change, err error) {
+	values := encodeFilter(filter)
+	values.Set("since", strconv.FormatUint(since, 10))
+	changes, err = openChangeStream(ctx, collection.httpClient, collection.url+"/_changes?"+values.Encode())
+	err = translateChangesError(err, since)
+	return
+}
+
+func translateChangesError(err error, since uint64) error {
+	responseError, ok := err.(ResponseError)
+	if !ok || responseError.StatusCode != http.StatusGone {
+		return err
+	}
+
+	response := compactedResponse{}
+	json.Unmarshal(responseError.Body, &response)
+	return collection.ChangesCompactedError{Since: since, Oldest: response.Oldest}
+}
+
+// openChangeStream requests a change feed and decodes its events until the
+// stream ends or ctx is done. Read errors are sent as a change of type error.
+func openChangeStream(ctx context.Context, client *http.Client, url string) (changes <-chan collection.Change, err error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", eventStreamContentType)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		err = ResponseError{
+			StatusCode:  response.StatusCode,
+			Status:      response.Status,
+			ContentType: response.Header.Get("Content-Type"),
+			Body:        body,
+			Header:      response.Header,
+		}
+		return
+	}
+
+	stream := make(chan collection.Change)
+	go func() {
+		defer close(stream)
+		defer response.Body.Close()
+
+		data := ""
+		scanner := bufio.NewScanner(response.Body)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "data:") {
+				data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+				continue
+			}
+			if line != "" || data == "" {
+				continue
+			}
+
+			change := collection.Change{}
+			unmarshalError := json.Unmarshal([]byte(data), &change)
+			data = ""
+			if unmarshalError != nil {
+				continue
+			}
+
+			select {
+			case stream <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if scanner.Err() != nil && ctx.Err() == nil {
+			select {
+			case stream <- collection.Change{Type: collection.ChangeError, Error: scanner.Err().Error()}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	changes = stream
+	return
+}
@@ -0,0 +1,222 @@
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mojlighetsministeriet/storage/collection"
+)
+
+// reservedQueryParameters are query parameters that control the listing
+// instead of filtering on a field.
+var reservedQueryParameters = []string{"limit", "offset", "cursor", "sort", "fields"}
+
+const nextCursorHeader = "X-Next-Cursor"
+
+var operatorParameterPattern = regexp.MustCompile(`^(.+)\[(\$[a-z]+)\]$`)
+
+func isReservedQueryParameter(key string) bool {
+	for _, reserved := range reservedQueryParameters {
+		if key == reserved {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseFilter turns query parameters into a map filter. A plain field=value
+// parameter requires equality, or that an array contains the value, while
+// field[$op]=value adds a condition, where $in and $nin take every value of
+// the repeated parameter. Repeating a plain parameter, or a parameter with
+// another operator, requires all of the values.
+// Values are untyped and matched as the type of the stored field.
+func parseFilter(values url.Values) (filter map[string]interface{}, err error) {
+	filter = make(map[string]interface{})
+
+	for key, value := range values {
+		if isReservedQueryParameter(key) {
+			continue
+		}
+
+		result := operatorParameterPattern.FindStringSubmatch(key)
+		if result == nil {
+			if len(value) == 1 {
+				filter[key] = collection.UntypedValue(value[0])
+				continue
+			}
+
+			conditions := collection.Conditions{}
+			for _, item := range value {
+				conditions = append(conditions, collection.Eq(collection.UntypedValue(item)))
+			}
+			filter[key] = conditions
+			continue
+		}
+
+		field := result[1]
+		operator, parseError := collection.ParseOperator(result[2])
+		if parseError != nil {
+			err = parseError
+			return
+		}
+
+		conditions, _ := filter[field].(collection.Conditions)
+		if operator == collection.OperatorIn || operator == collection.OperatorNotIn {
+			items := []interface{}{}
+			for _, item := range value {
+				items = append(items, collection.UntypedValue(item))
+			}
+			filter[field] = append(conditions, collection.Condition{Operator: operator, Value: items})
+			continue
+		}
+
+		for _, item := range value {
+			condition, parseError := parseCondition(operator, item)
+			if parseError != nil {
+				err = parseError
+				return
+			}
+			conditions = append(conditions, condition)
+		}
+		filter[field] = conditions
+	}
+
+	return
+}
+
+func parseCondition(operator collection.Operator, value string) (condition collection.Condition, err error) {
+	condition.Operator = operator
+
+	switch operator {
+	case collection.OperatorExists:
+		condition.Value = value != "false" && value != "0"
+	case collection.OperatorRegex:
+		if _, compileError := regexp.Compile(value); compileError != nil {
+			err = collection.InvalidPatternError{Pattern: value, Message: compileError.Error()}
+		}
+		condition.Value = value
+	case collection.OperatorPrefix, collection.OperatorContains:
+		condition.Value = value
+	default:
+		condition.Value = collection.UntypedValue(value)
+	}
+
+	return
+}
+
+// encodeFilter is the inverse of parseFilter and is used by RemoteCollection
+// for struct and map filters.
+func encodeFilter(filter interface{}) (values url.Values) {
+	values = url.Values{}
+
+	for field, value := range collection.FilterFields(filter) {
+		switch typed := value.(type) {
+		case collection.Condition:
+			encodeCondition(values, field, typed)
+		case collection.Conditions:
+			for _, condition := range typed {
+				encodeCondition(values, field, condition)
+			}
+		default:
+			reflected := reflect.ValueOf(value)
+			if reflected.Kind() == reflect.Slice && reflected.Type().Elem().Kind() != reflect.Uint8 {
+				for i := 0; i < reflected.Len(); i++ {
+					values.Add(field, encodeFilterValue(reflected.Index(i).Interface()))
+				}
+			} else {
+				values.Add(field, encodeFilterValue(value))
+			}
+		}
+	}
+
+	return
+}
+
+func encodeCondition(values url.Values, field string, condition collection.Condition) {
+	key := field + "[" + string(condition.Operator) + "]"
+
+	switch condition.Operator {
+	case collection.OperatorIn, collection.OperatorNotIn:
+		reflected := reflect.ValueOf(condition.Value)
+		for i := 0; i < reflected.Len(); i++ {
+			values.Add(key, encodeFilterValue(reflected.Index(i).Interface()))
+		}
+	default:
+		values.Add(key, encodeFilterValue(condition.Value))
+	}
+}
+
+func encodeFilterValue(value interface{}) string {
+	reflected := reflect.ValueOf(value)
+	for reflected.Kind() == reflect.Ptr && !reflected.IsNil() {
+		reflected = reflected.Elem()
+		value = reflected.Interface()
+	}
+
+	if !reflected.IsValid() || reflected.Kind() == reflect.Ptr {
+		return "null"
+	}
+
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case collection.UntypedValue:
+		return string(typed)
+	case time.Time:
+		return typed.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return typed.String()
+	}
+
+	return fmt.Sprint(value)
+}
+
+func encodeQueryOptions(values url.Values, options collection.QueryOptions) {
+	values.Set("limit", strconv.Itoa(options.Limit))
+
+	if options.Offset != 0 {
+		values.Set("offset", strconv.Itoa(options.Offset))
+	}
+
+	if options.Cursor != "" {
+		values.Set("cursor", options.Cursor)
+	}
+
+	if len(options.Sort) > 0 {
+		values.Set("sort", collection.FormatSort(options.Sort))
+	}
+
+	if len(options.Fields) > 0 {
+		values.Set("fields", strings.Join(options.Fields, ","))
+	}
+}
+
+func parseQueryOptions(values url.Values) (options collection.QueryOptions, err error) {
+	limitString := values.Get("limit")
+	if limitString != "" {
+		options.Limit, err = strconv.Atoi(limitString)
+		if err != nil {
+			return
+		}
+	}
+
+	offsetString := values.Get("offset")
+	if offsetString != "" {
+		options.Offset, err = strconv.Atoi(offsetString)
+		if err != nil {
+			return
+		}
+	}
+
+	options.Cursor = values.Get("cursor")
+	options.Sort = collection.ParseSort(values.Get("sort"))
+	options.Fields = collection.ParseFields(values.Get("fields"))
+	err = options.Validate()
+	return
+}
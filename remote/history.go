@@ -0,0 +1,117 @@
+package remote
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/mojlighetsministeriet/storage/collection"
+	uuid "github.com/satori/go.uuid"
+)
+
+var _ collection.Historian = &RemoteCollection{}
+var _ collection.HistoryKeeper = &RemoteCollection{}
+
+type historyRetention struct {
+	Revisions int `json:"revisions"`
+}
+
+type invalidHistoryParameterError struct{}
+
+func (err invalidHistoryParameterError) Error() string {
+	return "Invalid rev or asOf parameter"
+}
+
+// loadPastRevision loads the revision given by the rev parameter or the one
+// stored at the RFC 3339 time given by the asOf parameter.
+func loadPastRevision(context echo.Context, historian collection.Historian, id uuid.UUID, entry collection.Entry) (err error) {
+	if rev := context.QueryParam("rev"); rev != "" {
+		revision, parseError := strconv.ParseUint(rev, 10, 64)
+		if parseError != nil {
+			return invalidHistoryParameterError{}
+		}
+
+		return historian.LoadRevision(id, revision, entry)
+	}
+
+	at, err := time.Parse(time.RFC3339, context.QueryParam("asOf"))
+	if err != nil {
+		return invalidHistoryParameterError{}
+	}
+
+	return historian.LoadAsOf(id, at, entry)
+}
+
+func (collection RemoteCollection) SetHistoryRetention(revisions int) (err error) {
+	_, _, err = collection.sendRequest(http.MethodPut, collection.url+"/_history", nil, historyRetention{Revisions: revisions}, nil)
+	return
+}
+
+func (collection RemoteCollection) HistoryRetention() (revisions int, err error) {
+	retention := historyRetention{}
+	_, _, err = collection.sendRequest(http.MethodGet, collection.url+"/_history", nil, nil, &retention)
+	revisions = retention.Revisions
+	return
+}
+
+// History returns the stored revisions of the entry, oldest first.
+func (collection RemoteCollection) History(id uuid.UUID) (records []collection.HistoryRecord, err error) {
+	_, _, err = collection.sendRequest(http.MethodGet, collection.url+"/"+id.String()+"/_history", nil, nil, &records)
+	err = translateHistoryError(err, id, 0)
+	return
+}
+
+func (collection RemoteCollection) LoadRevision(id uuid.UUID, revision uint64, entry collection.Entry) (err error) {
+	values := url.Values{}
+	values.Set("rev", strconv.FormatUint(revision, 10))
+	_, _, err = collection.sendRequest(http.MethodGet, collection.url+"/"+id.String()+"?"+values.Encode(), nil, nil, entry)
+	err = translateHistoryError(err, id, revision)
+	return
+}
+
+// LoadAsOf loads the revision of the entry that was stored at the time.
+func (collection RemoteCollection) LoadAsOf(id uuid.UUID, at time.Time, entry collection.Entry) (err error) {
+	values := url.Values{}
+	values.Set("asOf", at.Format(time.RFC3339Nano))
+	_, _, err = collection.sendRequest(http.MethodGet, collection.url+"/"+id.String()+"?"+values.Encode(), nil, nil, entry)
+	err = translateHistoryError(err, id, 0)
+	return
+}
+
+func (collection RemoteCollection) Revert(id uuid.UUID, revision uint64, entry collection.Entry) (err error) {
+	header, expectedRevision := revisionHeader(entry)
+
+	var response interface{}
+	if entry != nil {
+		response = entry
+	}
+
+	values := url.Values{}
+	values.Set("rev", strconv.FormatUint(revision, 10))
+	_, _, err = collection.sendRequest(http.MethodPost, collection.url+"/"+id.String()+"/_revert?"+values.Encode(), header, nil, response)
+	if responseError, ok := err.(ResponseError); ok && responseError.StatusCode == http.StatusNotFound {
+		err = translateHistoryError(err, id, revision)
+		return
+	}
+
+	err = translateWriteError(translateValidationError(err, collection.name), id, expectedRevision)
+	return
+}
+
+// translateHistoryError turns a 404 into a RevisionDoesNotExistError when a
+// revision was asked for and into an EntryDoesNotExistError otherwise, the
+// service does not tell them apart.
+func translateHistoryError(err error, id uuid.UUID, revision uint64) error {
+	responseError, ok := err.(ResponseError)
+	if !ok || responseError.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	if revision != 0 {
+		return collection.RevisionDoesNotExistError{ID: id, Revision: revision}
+	}
+
+	return collection.EntryDoesNotExistError{}
+}
@@ -1,22 +1,26 @@
 package remote
 
 import (
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
-	"strings"
 
 	"github.com/PuerkitoBio/purell"
-	"github.com/google/go-querystring/query"
 	"github.com/mojlighetsministeriet/storage/collection"
 	"github.com/mojlighetsministeriet/utils/httprequest"
 	uuid "github.com/satori/go.uuid"
 )
 
+var _ collection.Collection = &RemoteCollection{}
+
 var lastSlashPattern = regexp.MustCompile(`/([^/]+)$`)
 
 type responseID struct {
-	ID uuid.UUID
+	ID       uuid.UUID
+	Revision uint64 `json:"_revision"`
 }
 
 func NewRemoteCollection(url string) (collection *RemoteCollection, err error) {
@@ -33,18 +37,20 @@ func NewRemoteCollection(url string) (collection *RemoteCollection, err error) {
 	}
 
 	collection = &RemoteCollection{
-		url:    url,
-		name:   result[1],
-		client: client,
+		url:        url,
+		name:       result[1],
+		client:     client,
+		httpClient: &http.Client{},
 	}
 
 	return
 }
 
 type RemoteCollection struct {
-	url    string
-	name   string
-	client *httprequest.JSONClient
+	url        string
+	name       string
+	client     *httprequest.JSONClient
+	httpClient *http.Client
 }
 
 func (collection RemoteCollection) GetName() string {
@@ -52,24 +58,173 @@ func (collection RemoteCollection) GetName() string {
 }
 
 func (collection RemoteCollection) Persist(entry collection.Entry) (err error) {
+	if entry.GetID() == uuid.Nil {
+		err = collection.Insert(entry)
+	} else {
+		_, err = collection.Upsert(entry)
+	}
+
+	return
+}
+
+func (collection RemoteCollection) Insert(entry collection.Entry) (err error) {
+	header, expectedRevision := revisionHeader(entry)
 	response := responseID{}
-	err = collection.client.Post(collection.url, entry, &response)
+	_, _, err = collection.sendRequest(http.MethodPost, collection.url, header, entry, &response)
 	if err != nil {
+		err = translateInsertError(translateValidationError(err, collection.name), entry.GetID(), expectedRevision)
 		return
 	}
 
 	entry.SetID(response.ID)
+	setRevision(entry, response.Revision)
+
+	return
+}
+
+func (collection RemoteCollection) Replace(entry collection.Entry) (err error) {
+	header, expectedRevision := revisionHeader(entry)
+	if expectedRevision == 0 {
+		header.Set("If-Match", "*")
+	}
+
+	_, err = collection.put(entry, header, expectedRevision)
+	return
+}
+
+func (collection RemoteCollection) Upsert(entry collection.Entry) (created bool, err error) {
+	header, expectedRevision := revisionHeader(entry)
+	return collection.put(entry, header, expectedRevision)
+}
+
+func (collection RemoteCollection) put(entry collection.Entry, header http.Header, expectedRevision uint64) (created bool, err error) {
+	response := responseID{}
+	statusCode, _, err := collection.sendRequest(http.MethodPut, collection.url+"/"+entry.GetID().String(), header, entry, &response)
+	if err != nil {
+		err = translateWriteError(translateValidationError(err, collection.name), entry.GetID(), expectedRevision)
+		return
+	}
+
+	setRevision(entry, response.Revision)
+	created = statusCode == http.StatusCreated
 
 	return
 }
 
 func (collection RemoteCollection) Delete(entry collection.Entry) (err error) {
-	err = collection.client.Delete(collection.url+"/"+entry.GetID().String(), nil)
+	header, expectedRevision := revisionHeader(entry)
+	_, _, err = collection.sendRequest(http.MethodDelete, collection.url+"/"+entry.GetID().String(), header, nil, nil)
+	err = translateWriteError(err, entry.GetID(), expectedRevision)
+	return
+}
+
+func (collection RemoteCollection) WriteBatch(batch collection.Batch) (err error) {
+	response := []responseID{}
+	_, _, err = collection.sendRequest(http.MethodPost, collection.url+"/_batch", nil, encodeBatch(batch), &response)
+	if err != nil {
+		err = translateBatchError(translateValidationError(err, collection.name))
+		return
+	}
+
+	for i, operation := range batch.Operations {
+		if !operation.Delete && i < len(response) {
+			operation.Entry.SetID(response[i].ID)
+			setRevision(operation.Entry, response[i].Revision)
+		}
+	}
+
 	return
 }
 
+func (collection RemoteCollection) Patch(id uuid.UUID, patch collection.Patch, entry collection.Entry) (err error) {
+	contentType, body, err := encodePatch(patch)
+	if err != nil {
+		return
+	}
+
+	header, expectedRevision := revisionHeader(entry)
+	header.Set("Content-Type", contentType)
+
+	var response interface{}
+	if entry != nil {
+		response = entry
+	}
+
+	_, _, err = collection.sendRequest(http.MethodPatch, collection.url+"/"+id.String(), header, body, response)
+	err = translateWriteError(translateValidationError(err, collection.name), id, expectedRevision)
+	return
+}
+
+// revisionHeader returns an If-Match header for entries that have a revision.
+func revisionHeader(entry collection.Entry) (header http.Header, expectedRevision uint64) {
+	header = http.Header{}
+	if revisioned, ok := entry.(collection.Revisioned); ok && revisioned.GetRevision() != 0 {
+		expectedRevision = revisioned.GetRevision()
+		header.Set("If-Match", collection.FormatETag(expectedRevision))
+	}
+
+	return
+}
+
+func setRevision(entry collection.Entry, revision uint64) {
+	if revisioned, ok := entry.(collection.Revisioned); ok {
+		revisioned.SetRevision(revision)
+	}
+}
+
+func setRevisionFromETag(entry collection.Entry, header http.Header) {
+	if revision, err := collection.ParseETag(header.Get("ETag")); err == nil {
+		setRevision(entry, revision)
+	}
+}
+
+// translateWriteError turns failed preconditions into the errors returned by
+// FilesystemCollection. The service includes the ETag of the stored entry
+// unless the entry is missing.
+func translateWriteError(err error, id uuid.UUID, expectedRevision uint64) error {
+	responseError, ok := err.(ResponseError)
+	if !ok || responseError.StatusCode != http.StatusPreconditionFailed {
+		return err
+	}
+
+	etag := responseError.Header.Get("ETag")
+	if etag == "" {
+		return collection.EntryDoesNotExistError{}
+	}
+
+	actualRevision, _ := collection.ParseETag(etag)
+	return collection.RevisionConflictError{ID: id, ExpectedRevision: expectedRevision, ActualRevision: actualRevision}
+}
+
+func translateInsertError(err error, id uuid.UUID, expectedRevision uint64) error {
+	if responseError, ok := err.(ResponseError); ok && responseError.StatusCode == http.StatusConflict {
+		return collection.EntryAlreadyExistsError{}
+	}
+
+	return translateWriteError(err, id, expectedRevision)
+}
+
+func encodePatch(patch collection.Patch) (contentType string, body json.RawMessage, err error) {
+	switch typed := patch.(type) {
+	case collection.MergePatch:
+		return collection.MergePatchContentType, json.RawMessage(typed), nil
+	case collection.JSONPatch:
+		return collection.JSONPatchContentType, json.RawMessage(typed), nil
+	}
+
+	err = collection.InvalidPatchError{Message: "unsupported patch type"}
+	return
+}
+
+// Load sets the revision of Revisioned entries from the ETag, which the
+// service sends even when the body does not hold the revision.
 func (collection RemoteCollection) Load(id uuid.UUID, entry collection.Entry) (err error) {
-	err = collection.client.Get(collection.url+"/"+id.String(), entry)
+	_, header, err := collection.sendRequest(http.MethodGet, collection.url+"/"+id.String(), nil, nil, entry)
+	if err != nil {
+		return
+	}
+
+	setRevisionFromETag(entry, header)
 	return
 }
 
@@ -78,21 +233,43 @@ func (collection RemoteCollection) LoadAll(entries interface{}, limit int) (err
 	return
 }
 
-func (collection RemoteCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
-	filterValues, err := query.Values(filter)
+func (collection RemoteCollection) LoadAllWithOptions(entries interface{}, options collection.QueryOptions) (result collection.QueryResult, err error) {
+	err = options.Validate()
 	if err != nil {
 		return
 	}
 
-	for key, values := range filterValues {
-		numberOfValues := len(values)
-		if (numberOfValues == 1 && values[0] == "0001-01-01T00:00:00Z") ||
-			(numberOfValues == 16 && strings.Join(values, ".") == "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0") {
-			delete(filterValues, key)
-		}
+	values := url.Values{}
+	encodeQueryOptions(values, options)
+	_, header, err := collection.sendRequest(http.MethodGet, collection.url+"?"+values.Encode(), nil, nil, entries)
+	if err != nil {
+		return
 	}
 
+	result.NextCursor = header.Get(nextCursorHeader)
+	return
+}
+
+func (collection RemoteCollection) Query(filter interface{}, limit int, entries interface{}) (err error) {
+	filterValues := encodeFilter(filter)
 	queryString := "limit=" + strconv.Itoa(limit) + "&" + filterValues.Encode()
 	err = collection.client.Get(collection.url+"?"+queryString, &entries)
 	return
 }
+
+func (collection RemoteCollection) QueryWithOptions(filter interface{}, options collection.QueryOptions, entries interface{}) (result collection.QueryResult, err error) {
+	err = options.Validate()
+	if err != nil {
+		return
+	}
+
+	values := encodeFilter(filter)
+	encodeQueryOptions(values, options)
+	_, header, err := collection.sendRequest(http.MethodGet, collection.url+"?"+values.Encode(), nil, nil, entries)
+	if err != nil {
+		return
+	}
+
+	result.NextCursor = header.Get(nextCursorHeader)
+	return
+}
@@ -1,6 +1,11 @@
 package remote_test
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,8 +17,12 @@ import (
 )
 
 func TestQuery(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
 	go func() {
-		service := remote.NewService(false, false, "5M")
+		service := remote.NewService(false, false, "5M", root)
 		service.Listen(":4528")
 	}()
 
@@ -73,8 +82,12 @@ func TestQuery(test *testing.T) {
 }
 
 func TestLimit(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
 	go func() {
-		service := remote.NewService(false, false, "5M")
+		service := remote.NewService(false, false, "5M", root)
 		service.Listen(":4529")
 	}()
 
@@ -128,8 +141,12 @@ func TestLimit(test *testing.T) {
 }
 
 func TestFailDeleteWithWrongID(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
 	go func() {
-		service := remote.NewService(false, false, "5M")
+		service := remote.NewService(false, false, "5M", root)
 		service.Listen(":4530")
 	}()
 
@@ -150,3 +167,918 @@ func TestFailDeleteWithWrongID(test *testing.T) {
 	assert.Error(test, err)
 	assert.Equal(test, "404 Not Found (application/json; charset=utf-8): {\"message\":\"Not Found\"}", err.Error())
 }
+
+func TestQueryWithConditions(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4531")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4531/test-remote-collection-authors-conditions")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name      string
+		BirthDate time.Time
+	}
+
+	selmaBirthDate, _ := time.Parse(time.RFC3339, "1858-10-20T00:00:00Z")
+	astridBirthDate, _ := time.Parse(time.RFC3339, "1907-11-14T00:00:00Z")
+	authors := []Author{
+		Author{
+			Name:      "Selma Lagerlöf",
+			BirthDate: selmaBirthDate,
+		},
+		Author{
+			Name:      "Astrid Lindgren",
+			BirthDate: astridBirthDate,
+		},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	before1900, _ := time.Parse(time.RFC3339, "1900-01-01T00:00:00Z")
+	authorsQueryResponse := []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"BirthDate": collection.Lt(before1900)}, 0, &authorsQueryResponse)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(authorsQueryResponse))
+	assert.Equal(test, authors[0].Name, authorsQueryResponse[0].Name)
+
+	authorsQueryResponse = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Name": collection.In("Astrid Lindgren", "Tove Jansson")}, 0, &authorsQueryResponse)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(authorsQueryResponse))
+	assert.Equal(test, authors[1].Name, authorsQueryResponse[0].Name)
+
+	commaAuthor := Author{Name: "Jansson, Tove"}
+	err = remoteCollection.Persist(&commaAuthor)
+	assert.NoError(test, err)
+
+	authorsQueryResponse = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Name": collection.In("Jansson, Tove", "Astrid Lindgren")}, 0, &authorsQueryResponse)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(authorsQueryResponse))
+
+	authorsQueryResponse = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Name": collection.Nin("Jansson, Tove", "Astrid Lindgren")}, 0, &authorsQueryResponse)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(authorsQueryResponse))
+	assert.Equal(test, authors[0].Name, authorsQueryResponse[0].Name)
+}
+
+func TestSort(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4532")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4532/test-remote-collection-authors-sort")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name string
+	}
+
+	authors := []Author{
+		Author{Name: "Selma Lagerlöf"},
+		Author{Name: "Anna Andersson"},
+		Author{Name: "Lena Hansson"},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	authorsQueryResponse := []Author{}
+	_, err = remoteCollection.LoadAllWithOptions(&authorsQueryResponse, collection.QueryOptions{
+		Limit: 2,
+		Sort:  collection.ParseSort("-Name"),
+	})
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(authorsQueryResponse))
+	assert.Equal(test, "Selma Lagerlöf", authorsQueryResponse[0].Name)
+	assert.Equal(test, "Lena Hansson", authorsQueryResponse[1].Name)
+}
+
+func TestPagination(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4533")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4533/test-remote-collection-authors-pagination")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name string
+	}
+
+	authors := []Author{
+		Author{Name: "Selma Lagerlöf"},
+		Author{Name: "Anna Andersson"},
+		Author{Name: "Lena Hansson"},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	firstPage := []Author{}
+	result, err := remoteCollection.LoadAllWithOptions(&firstPage, collection.QueryOptions{Limit: 2, Sort: collection.ParseSort("Name")})
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(firstPage))
+	assert.NotEqual(test, "", result.NextCursor)
+
+	secondPage := []Author{}
+	result, err = remoteCollection.LoadAllWithOptions(&secondPage, collection.QueryOptions{Limit: 2, Cursor: result.NextCursor, Sort: collection.ParseSort("Name")})
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(secondPage))
+	assert.Equal(test, "Selma Lagerlöf", secondPage[0].Name)
+	assert.Equal(test, "", result.NextCursor)
+
+	_, err = remoteCollection.LoadAllWithOptions(&secondPage, collection.QueryOptions{Offset: -1})
+	assert.IsType(test, collection.InvalidQueryOptionsError{}, err)
+
+	for _, query := range []string{"limit=-1", "offset=-1"} {
+		response, err := http.Get("http://localhost:4533/test-remote-collection-authors-pagination?" + query)
+		assert.NoError(test, err)
+		response.Body.Close()
+		assert.Equal(test, http.StatusBadRequest, response.StatusCode)
+	}
+}
+
+func TestPatch(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4534")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4534/test-remote-collection-authors-patch")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name      string
+		Pseudonym string
+	}
+
+	author := Author{Name: "Selma Lagerlöf"}
+	err = remoteCollection.Persist(&author)
+	assert.NoError(test, err)
+
+	patchedAuthor := Author{}
+	err = remoteCollection.Patch(author.GetID(), collection.MergePatch(`{"Pseudonym":"Mathilda"}`), &patchedAuthor)
+	assert.NoError(test, err)
+	assert.Equal(test, "Selma Lagerlöf", patchedAuthor.Name)
+	assert.Equal(test, "Mathilda", patchedAuthor.Pseudonym)
+
+	err = remoteCollection.Patch(author.GetID(), collection.JSONPatch(`[{"op":"replace","path":"/Name","value":"Selma Ottilia Lovisa Lagerlöf"}]`), &patchedAuthor)
+	assert.NoError(test, err)
+	assert.Equal(test, "Selma Ottilia Lovisa Lagerlöf", patchedAuthor.Name)
+
+	err = remoteCollection.Patch(author.GetID(), collection.JSONPatch(`[{"op":"test","path":"/Name","value":"Selma Lagerlöf"}]`), nil)
+	assert.Error(test, err)
+	assert.Equal(test, "409 Conflict (application/json; charset=utf-8): {\"message\":\"Conflict\"}", err.Error())
+}
+
+func TestRevisionConflict(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4535")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4535/test-remote-collection-authors-revision")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.RevisionedEntry
+		Name string
+	}
+
+	author := Author{Name: "Selma Lagerlöf"}
+	err = remoteCollection.Persist(&author)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), author.GetRevision())
+
+	staleAuthor := Author{}
+	err = remoteCollection.Load(author.GetID(), &staleAuthor)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), staleAuthor.GetRevision())
+
+	author.Name = "Selma Ottilia Lovisa Lagerlöf"
+	err = remoteCollection.Persist(&author)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), author.GetRevision())
+
+	staleAuthor.Name = "Mathilda Roos"
+	err = remoteCollection.Persist(&staleAuthor)
+	assert.Equal(test, collection.RevisionConflictError{ID: author.GetID(), ExpectedRevision: 1, ActualRevision: 2}, err)
+
+	err = remoteCollection.Delete(&staleAuthor)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	hiddenRevisionAuthor := unserializedRevisionAuthor{}
+	err = remoteCollection.Load(author.GetID(), &hiddenRevisionAuthor)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), hiddenRevisionAuthor.GetRevision())
+
+	hiddenRevisionAuthor.Name = "Selma Lagerlöf"
+	err = remoteCollection.Persist(&hiddenRevisionAuthor)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(3), hiddenRevisionAuthor.GetRevision())
+
+	err = remoteCollection.Delete(&author)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+
+	err = remoteCollection.Delete(&hiddenRevisionAuthor)
+	assert.NoError(test, err)
+}
+
+// unserializedRevisionAuthor keeps its revision out of the JSON body, which
+// leaves the ETag as the only way to learn it.
+type unserializedRevisionAuthor struct {
+	collection.BaseEntry
+	Name     string
+	revision uint64
+}
+
+func (author *unserializedRevisionAuthor) GetRevision() uint64 {
+	return author.revision
+}
+
+func (author *unserializedRevisionAuthor) SetRevision(revision uint64) {
+	author.revision = revision
+}
+
+func TestInsertReplaceUpsert(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4536")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4536/test-remote-collection-authors-upsert")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.RevisionedEntry
+		Name string
+	}
+
+	author := Author{Name: "Karin Boye"}
+	err = remoteCollection.Insert(&author)
+	assert.NoError(test, err)
+	assert.NotEqual(test, uuid.Nil, author.GetID())
+	assert.Equal(test, uint64(1), author.GetRevision())
+
+	duplicate := Author{Name: "Karin Maria Boye"}
+	duplicate.SetID(author.GetID())
+	err = remoteCollection.Insert(&duplicate)
+	assert.Equal(test, collection.EntryAlreadyExistsError{}, err)
+
+	author.Name = "Karin Maria Boye"
+	err = remoteCollection.Replace(&author)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), author.GetRevision())
+
+	missing := Author{Name: "Edith Södergran"}
+	missing.SetID(uuid.Must(uuid.NewV4()))
+	err = remoteCollection.Replace(&missing)
+	assert.Equal(test, collection.EntryDoesNotExistError{}, err)
+
+	created, err := remoteCollection.Upsert(&missing)
+	assert.NoError(test, err)
+	assert.True(test, created)
+	assert.Equal(test, uint64(1), missing.GetRevision())
+
+	created, err = remoteCollection.Upsert(&missing)
+	assert.NoError(test, err)
+	assert.False(test, created)
+	assert.Equal(test, uint64(2), missing.GetRevision())
+}
+
+func TestQueryTypedValues(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4537")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4537/test-remote-collection-authors-typed")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name     string
+		Age      int
+		Active   bool
+		Nickname *string
+	}
+
+	nickname := "Mårbacka"
+	authors := []Author{
+		{Name: "Selma Lagerlöf", Age: 81, Active: true, Nickname: &nickname},
+		{Name: "Hjalmar Söderberg", Age: 72},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Age": 81}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Selma Lagerlöf", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(Author{Active: true}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Selma Lagerlöf", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Active": collection.Eq(false)}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Hjalmar Söderberg", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Nickname": nil}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Hjalmar Söderberg", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Age": collection.Lt(75)}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Hjalmar Söderberg", found[0].Name)
+}
+
+func TestQueryDotPaths(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4538")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4538/test-remote-collection-authors-nested")
+	assert.NoError(test, err)
+
+	type Address struct {
+		City string
+	}
+
+	type Author struct {
+		collection.BaseEntry
+		Name    string
+		Address Address
+		Genres  []string
+	}
+
+	authors := []Author{
+		{Name: "Selma Lagerlöf", Address: Address{City: "Sunne"}, Genres: []string{"novels", "sagas"}},
+		{Name: "Ola Hansson", Address: Address{City: "Lund"}, Genres: []string{"poetry"}},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Address.City": "Lund"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Ola Hansson", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(Author{Address: Address{City: "Sunne"}}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Selma Lagerlöf", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"Genres.1": "sagas"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Selma Lagerlöf", found[0].Name)
+}
+
+func TestQueryJSONTags(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4539")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4539/test-remote-collection-authors-tags")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name  string `json:"name" url:"full_name"`
+		Born  int    `json:"born,omitempty"`
+		Since int    `json:"since,omitempty"`
+	}
+
+	authors := []Author{
+		{Name: "Karin Boye", Born: 1900, Since: 1922},
+		{Name: "Edith Södergran", Born: 1892, Since: 1916},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Author{}
+	err = remoteCollection.Query(Author{Name: "Karin Boye"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, 1900, found[0].Born)
+
+	found = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"born": collection.Lt(1900)}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Edith Södergran", found[0].Name)
+
+	found = []Author{}
+	err = remoteCollection.Query(map[string]interface{}{"since": 1922}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Karin Boye", found[0].Name)
+}
+
+func TestQueryWhere(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4540")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4540/test-remote-collection-authors-where")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name      string
+		Books     int
+		BirthDate time.Time
+	}
+
+	birthDate, _ := time.Parse(time.RFC3339, "1858-10-20T00:00:00Z")
+	authors := []Author{
+		{Name: "Selma Lagerlöf", Books: 0, BirthDate: birthDate},
+		{Name: "", Books: 0},
+		{Name: "Hjalmar Söderberg", Books: 4},
+	}
+
+	for i := range authors {
+		err = remoteCollection.Persist(&authors[i])
+		assert.NoError(test, err)
+	}
+
+	found := []Author{}
+	err = remoteCollection.Query(collection.Where("Books").Eq(0), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(found))
+
+	found = []Author{}
+	err = remoteCollection.Query(collection.Where("Name").Eq(""), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, authors[1].ID, found[0].ID)
+
+	found = []Author{}
+	err = remoteCollection.Query(collection.Where("BirthDate").Eq(time.Time{}).And("Books").Gt(0), 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Hjalmar Söderberg", found[0].Name)
+}
+
+func TestWriteBatch(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4541")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4541/test-remote-collection-authors-batch")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.RevisionedEntry
+		Name string
+	}
+
+	selma := Author{Name: "Selma Lagerlöf"}
+	karin := Author{Name: "Karin Boye"}
+	batch := collection.Batch{}
+	batch.Put(&selma).Put(&karin)
+	err = remoteCollection.WriteBatch(batch)
+	assert.NoError(test, err)
+	assert.NotEqual(test, uuid.Nil, selma.GetID())
+	assert.Equal(test, uint64(1), karin.GetRevision())
+
+	stale := karin
+	karin.Name = "Karin Maria Boye"
+	batch = collection.Batch{}
+	batch.Put(&karin).Delete(&selma)
+	err = remoteCollection.WriteBatch(batch)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(2), karin.GetRevision())
+
+	edith := Author{Name: "Edith Södergran"}
+	batch = collection.Batch{}
+	batch.Put(&edith).Delete(&stale)
+	err = remoteCollection.WriteBatch(batch)
+	assert.Equal(test, collection.RevisionConflictError{ID: karin.GetID(), ExpectedRevision: 1, ActualRevision: 2}, err)
+
+	found := []Author{}
+	err = remoteCollection.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "Karin Maria Boye", found[0].Name)
+}
+
+func TestMemoryBackend(test *testing.T) {
+	go func() {
+		service := remote.NewServiceWithBackend(false, false, "5M", collection.NewMemoryBackend())
+		service.Listen(":4542")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4542/authors")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name string
+	}
+
+	selma := Author{Name: "Selma Lagerlöf"}
+	err = remoteCollection.Persist(&selma)
+	assert.NoError(test, err)
+
+	found := []Author{}
+	err = remoteCollection.Query(Author{Name: "Selma Lagerlöf"}, 0, &found)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, selma.GetID(), found[0].GetID())
+
+	err = remoteCollection.Delete(&selma)
+	assert.NoError(test, err)
+
+	err = remoteCollection.Load(selma.GetID(), &Author{})
+	assert.Error(test, err)
+}
+
+func TestWatch(test *testing.T) {
+	root, err := ioutil.TempDir("", "remote-collection-test")
+	assert.NoError(test, err)
+	defer os.RemoveAll(root)
+
+	go func() {
+		service := remote.NewService(false, false, "5M", root)
+		service.Listen(":4543")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4543/test-remote-collection-authors-changes")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name    string
+		Country string
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes, err := remoteCollection.Watch(ctx, Author{Country: "Sweden"})
+	assert.NoError(test, err)
+
+	selma := Author{Name: "Selma Lagerlöf", Country: "Sweden"}
+	err = remoteCollection.Persist(&selma)
+	assert.NoError(test, err)
+
+	edith := Author{Name: "Edith Södergran", Country: "Finland"}
+	err = remoteCollection.Persist(&edith)
+	assert.NoError(test, err)
+
+	err = remoteCollection.Delete(&selma)
+	assert.NoError(test, err)
+
+	inserted := <-changes
+	assert.Equal(test, collection.ChangeInsert, inserted.Type)
+	assert.Equal(test, selma.GetID(), inserted.ID)
+
+	deleted := <-changes
+	assert.Equal(test, collection.ChangeDelete, deleted.Type)
+	assert.Equal(test, uint64(3), deleted.Sequence)
+
+	resumed, err := remoteCollection.WatchSince(ctx, nil, inserted.Sequence)
+	assert.NoError(test, err)
+	assert.Equal(test, edith.GetID(), (<-resumed).ID)
+	assert.Equal(test, deleted.Sequence, (<-resumed).Sequence)
+
+	retention := collection.ChangeRetention
+	collection.ChangeRetention = 1
+	defer func() {
+		collection.ChangeRetention = retention
+	}()
+
+	err = remoteCollection.Persist(&edith)
+	assert.NoError(test, err)
+
+	_, err = remoteCollection.WatchSince(ctx, nil, inserted.Sequence)
+	assert.Equal(test, collection.ChangesCompactedError{Since: inserted.Sequence, Oldest: 4}, err)
+}
+
+func TestExpiry(test *testing.T) {
+	go func() {
+		service := remote.NewServiceWithBackend(false, false, "5M", collection.NewMemoryBackend())
+		service.Listen(":4544")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4544/sessions")
+	assert.NoError(test, err)
+
+	type Session struct {
+		collection.BaseEntry
+		collection.Expiry
+		Data string
+	}
+
+	expired := Session{Data: "expired"}
+	expired.SetExpiresAt(time.Now().Add(-time.Minute))
+	err = remoteCollection.Persist(&expired)
+	assert.NoError(test, err)
+
+	err = remoteCollection.Load(expired.GetID(), &Session{})
+	assert.Error(test, err)
+
+	response, err := http.Post("http://localhost:4544/sessions?ttl=3600", "application/json", strings.NewReader("{\"Data\":\"active\"}"))
+	assert.NoError(test, err)
+	response.Body.Close()
+	assert.Equal(test, http.StatusCreated, response.StatusCode)
+
+	request, err := http.NewRequest(http.MethodPut, "http://localhost:4544/sessions/"+uuid.Must(uuid.NewV4()).String(), strings.NewReader("{\"Data\":\"ended\"}"))
+	assert.NoError(test, err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Expires-At", time.Now().Add(-time.Second).Format(time.RFC3339))
+	response, err = http.DefaultClient.Do(request)
+	assert.NoError(test, err)
+	response.Body.Close()
+	assert.Equal(test, http.StatusCreated, response.StatusCode)
+
+	response, err = http.Post("http://localhost:4544/sessions?ttl=soon", "application/json", strings.NewReader("{\"Data\":\"invalid\"}"))
+	assert.NoError(test, err)
+	response.Body.Close()
+	assert.Equal(test, http.StatusBadRequest, response.StatusCode)
+
+	found := []Session{}
+	err = remoteCollection.LoadAll(&found, 0)
+	assert.NoError(test, err)
+	assert.Equal(test, 1, len(found))
+	assert.Equal(test, "active", found[0].Data)
+	assert.True(test, found[0].GetExpiresAt().After(time.Now().Add(59*time.Minute)))
+}
+
+func TestSweeper(test *testing.T) {
+	backend := collection.NewMemoryBackend()
+	sessions, err := backend.Open("sessions")
+	assert.NoError(test, err)
+
+	type Session struct {
+		collection.BaseEntry
+		collection.Expiry
+		Data string
+	}
+
+	expired := Session{Data: "expired"}
+	expired.SetExpiresAt(time.Now().Add(-time.Minute))
+	err = sessions.Persist(&expired)
+	assert.NoError(test, err)
+
+	active := Session{Data: "active"}
+	active.ExpireAfter(time.Hour)
+	err = sessions.Persist(&active)
+	assert.NoError(test, err)
+
+	sweeper := remote.StartSweeper(backend, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	sweeper.Stop()
+
+	removed, err := sessions.(collection.Expirer).RemoveExpired()
+	assert.NoError(test, err)
+	assert.Equal(test, 0, removed)
+	assert.Equal(test, 1, sessions.(*collection.MemoryCollection).Count())
+}
+
+func TestSchema(test *testing.T) {
+	go func() {
+		service := remote.NewServiceWithBackend(false, false, "5M", collection.NewMemoryBackend())
+		service.Listen(":4545")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4545/authors")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.BaseEntry
+		Name      string `json:",omitempty"`
+		BirthYear int    `json:",omitempty"`
+	}
+
+	schema, err := remoteCollection.Schema()
+	assert.NoError(test, err)
+	assert.Nil(test, schema)
+
+	err = remoteCollection.SetSchema([]byte(`{"properties": {"BirthYear": {"type": "text"}}}`))
+	assert.IsType(test, collection.InvalidSchemaError{}, err)
+
+	err = remoteCollection.SetSchema([]byte(`{"required": ["Name"], "properties": {"Name": {"type": "string"}, "BirthYear": {"minimum": 1000}}}`))
+	assert.NoError(test, err)
+
+	schema, err = remoteCollection.Schema()
+	assert.NoError(test, err)
+	assert.Contains(test, string(schema), "BirthYear")
+
+	selma := Author{Name: "Selma Lagerlöf", BirthYear: 1858}
+	err = remoteCollection.Persist(&selma)
+	assert.NoError(test, err)
+
+	err = remoteCollection.Insert(&Author{BirthYear: 185})
+	validationError, ok := err.(collection.ValidationError)
+	assert.True(test, ok)
+	assert.Equal(test, "authors", validationError.CollectionName)
+	assert.Equal(test, []collection.Violation{
+		{Path: "/Name", Message: "is required"},
+		{Path: "/BirthYear", Message: "must be at least 1000"},
+	}, validationError.Violations)
+
+	err = remoteCollection.Patch(selma.GetID(), collection.MergePatch(`{"Name": null}`), nil)
+	validationError, ok = err.(collection.ValidationError)
+	assert.True(test, ok)
+	assert.Equal(test, selma.GetID(), validationError.ID)
+
+	err = remoteCollection.SetSchema(nil)
+	assert.NoError(test, err)
+
+	err = remoteCollection.Insert(&Author{BirthYear: 185})
+	assert.NoError(test, err)
+}
+
+func TestHistory(test *testing.T) {
+	go func() {
+		service := remote.NewServiceWithBackend(false, false, "5M", collection.NewMemoryBackend())
+		service.Listen(":4546")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	remoteCollection, err := remote.NewRemoteCollection("http://localhost:4546/authors")
+	assert.NoError(test, err)
+
+	type Author struct {
+		collection.RevisionedEntry
+		Name string
+	}
+
+	err = remoteCollection.SetHistoryRetention(collection.UnlimitedHistory)
+	assert.NoError(test, err)
+
+	retention, err := remoteCollection.HistoryRetention()
+	assert.NoError(test, err)
+	assert.Equal(test, collection.UnlimitedHistory, retention)
+
+	selma := Author{Name: "Selma"}
+	err = remoteCollection.Persist(&selma)
+	assert.NoError(test, err)
+
+	between := time.Now()
+	time.Sleep(time.Millisecond)
+
+	selma.Name = "Selma Lagerlöf"
+	err = remoteCollection.Persist(&selma)
+	assert.NoError(test, err)
+
+	records, err := remoteCollection.History(selma.GetID())
+	assert.NoError(test, err)
+	assert.Equal(test, 2, len(records))
+	assert.Equal(test, uint64(2), records[1].Revision)
+
+	first := Author{}
+	err = remoteCollection.LoadRevision(selma.GetID(), 1, &first)
+	assert.NoError(test, err)
+	assert.Equal(test, "Selma", first.Name)
+
+	response, err := http.Get("http://localhost:4546/authors/" + selma.GetID().String() + "?rev=1")
+	assert.NoError(test, err)
+	response.Body.Close()
+	assert.Equal(test, http.StatusOK, response.StatusCode)
+	assert.Equal(test, "", response.Header.Get("ETag"))
+
+	response, err = http.Get("http://localhost:4546/authors/" + selma.GetID().String())
+	assert.NoError(test, err)
+	response.Body.Close()
+	assert.Equal(test, collection.FormatETag(2), response.Header.Get("ETag"))
+
+	asOf := Author{}
+	err = remoteCollection.LoadAsOf(selma.GetID(), between, &asOf)
+	assert.NoError(test, err)
+	assert.Equal(test, uint64(1), asOf.GetRevision())
+
+	err = remoteCollection.LoadRevision(selma.GetID(), 5, &Author{})
+	assert.Equal(test, collection.RevisionDoesNotExistError{ID: selma.GetID(), Revision: 5}, err)
+
+	reverted := Author{}
+	reverted.SetRevision(2)
+	err = remoteCollection.Revert(selma.GetID(), 1, &reverted)
+	assert.NoError(test, err)
+	assert.Equal(test, "Selma", reverted.Name)
+	assert.Equal(test, uint64(3), reverted.GetRevision())
+
+	err = remoteCollection.Revert(selma.GetID(), 2, &selma)
+	assert.IsType(test, collection.RevisionConflictError{}, err)
+}
@@ -0,0 +1,84 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ResponseError is returned for responses with a non 2xx status code.
+type ResponseError struct {
+	StatusCode  int
+	Status      string
+	ContentType string
+	Body        []byte
+	Header      http.Header
+}
+
+func (err ResponseError) Error() string {
+	return err.Status + " (" + strings.ToLower(err.ContentType) + "): " + string(err.Body)
+}
+
+// sendRequest is used where the JSON client is not enough, i.e. when request
+// or response headers are needed. Errors are formatted the same way as the
+// ones returned by the JSON client.
+func (collection RemoteCollection) sendRequest(method string, url string, header http.Header, body interface{}, response interface{}) (statusCode int, responseHeader http.Header, err error) {
+	var bodyReader io.Reader
+	if body != nil {
+		serialized, marshalError := json.Marshal(body)
+		if marshalError != nil {
+			err = marshalError
+			return
+		}
+		bodyReader = bytes.NewReader(serialized)
+	}
+
+	request, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
+	request.Header.Set("Accept", "application/json")
+	if body != nil && request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResponse, err := collection.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer httpResponse.Body.Close()
+
+	statusCode = httpResponse.StatusCode
+	responseHeader = httpResponse.Header
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return
+	}
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		err = ResponseError{
+			StatusCode:  httpResponse.StatusCode,
+			Status:      httpResponse.Status,
+			ContentType: httpResponse.Header.Get("Content-Type"),
+			Body:        responseBody,
+			Header:      httpResponse.Header,
+		}
+		return
+	}
+
+	if response != nil && len(responseBody) > 0 {
+		err = json.Unmarshal(responseBody, response)
+	}
+
+	return
+}
@@ -0,0 +1,86 @@
+package remote
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mojlighetsministeriet/storage/collection"
+	uuid "github.com/satori/go.uuid"
+)
+
+var _ collection.SchemaValidator = &RemoteCollection{}
+
+// validationResponse is the body of a 422 response to a write that does not
+// match the schema of the collection. The violations are those of the
+// keywords in collection.SchemaKeywords, the only ones that are validated.
+type validationResponse struct {
+	Message    string                 `json:"message"`
+	ID         uuid.UUID              `json:"id"`
+	Violations []collection.Violation `json:"violations"`
+}
+
+// SetSchema sets the JSON Schema that the service validates entries written
+// to the collection against, a nil schema removes it. The schema may only use
+// collection.SchemaKeywords and collection.SchemaAnnotations, other keywords
+// are rejected with an InvalidSchemaError.
+func (collection RemoteCollection) SetSchema(schema []byte) (err error) {
+	if schema == nil {
+		_, _, err = collection.sendRequest(http.MethodDelete, collection.url+"/_schema", nil, nil, nil)
+		if responseError, ok := err.(ResponseError); ok && responseError.StatusCode == http.StatusNotFound {
+			err = nil
+		}
+		return
+	}
+
+	_, _, err = collection.sendRequest(http.MethodPut, collection.url+"/_schema", nil, json.RawMessage(schema), nil)
+	err = translateSchemaError(err)
+	return
+}
+
+// Schema returns the JSON Schema of the collection or nil if it has none.
+func (collection RemoteCollection) Schema() (schema []byte, err error) {
+	response := json.RawMessage{}
+	_, _, err = collection.sendRequest(http.MethodGet, collection.url+"/_schema", nil, nil, &response)
+	if responseError, ok := err.(ResponseError); ok && responseError.StatusCode == http.StatusNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	schema = response
+	return
+}
+
+func translateSchemaError(err error) error {
+	responseError, ok := err.(ResponseError)
+	if !ok || responseError.StatusCode != http.StatusBadRequest {
+		return err
+	}
+
+	message := struct {
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(responseError.Body, &message) != nil {
+		return err
+	}
+
+	return collection.InvalidSchemaError{Message: message.Message}
+}
+
+// translateValidationError turns a 422 response into the ValidationError
+// returned by the local collections.
+func translateValidationError(err error, collectionName string) error {
+	responseError, ok := err.(ResponseError)
+	if !ok || responseError.StatusCode != http.StatusUnprocessableEntity {
+		return err
+	}
+
+	response := validationResponse{}
+	if json.Unmarshal(responseError.Body, &response) != nil {
+		return err
+	}
+
+	return collection.ValidationError{ID: response.ID, CollectionName: collectionName, Violations: response.Violations}
+}
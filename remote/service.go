@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/schema"
 	"github.com/labstack/echo"
@@ -15,11 +17,17 @@ import (
 
 var decoder = schema.NewDecoder()
 
-func NewService(useTLS bool, behindProxy bool, bodyLimit string) (service *server.Server) {
+// NewService serves the collections stored in root.
+func NewService(useTLS bool, behindProxy bool, bodyLimit string, root string) (service *server.Server) {
+	return NewServiceWithBackend(useTLS, behindProxy, bodyLimit, collection.FilesystemBackend{Root: root})
+}
+
+// NewServiceWithBackend serves the collections opened by backend.
+func NewServiceWithBackend(useTLS bool, behindProxy bool, bodyLimit string, backend collection.Backend) (service *server.Server) {
 	service = server.NewServer(useTLS, behindProxy, bodyLimit)
 
 	service.GET("/", func(context echo.Context) (err error) {
-		info, err := collection.FilesystemCollectionsInfo()
+		info, err := backend.Info()
 		if err != nil {
 			return respondInternalServerError(context)
 		}
@@ -28,76 +36,589 @@ func NewService(useTLS bool, behindProxy bool, bodyLimit string) (service *serve
 	})
 
 	service.POST("/:collection", func(context echo.Context) error {
+		entry, err := readEntry(context)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid JSON")
+		}
+
+		if !applyExpiry(context, &entry) {
+			return respondStringBadRequest(context, "Invalid X-Expires-At header or ttl parameter")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		err = entryCollection.Insert(&entry)
+		if err != nil {
+			switch typedError := err.(type) {
+			case collection.EntryAlreadyExistsError:
+				return respondConflict(context)
+			case collection.RevisionConflictError:
+				return respondPreconditionFailed(context, typedError.ActualRevision)
+			case collection.ValidationError:
+				return respondUnprocessableEntity(context, typedError)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		return respondWritten(context, http.StatusCreated, entry)
+	})
+
+	service.PUT("/:collection/:id", func(context echo.Context) error {
+		id, err := uuid.FromString(context.Param("id"))
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid UUID")
+		}
+
+		entry, err := readEntry(context)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid JSON")
+		}
+
+		entry.SetID(id)
+		err = applyIfMatch(context, &entry)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid If-Match header")
+		}
+
+		if !applyExpiry(context, &entry) {
+			return respondStringBadRequest(context, "Invalid X-Expires-At header or ttl parameter")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		created := false
+		if context.Request().Header.Get("If-None-Match") == "*" {
+			err = entryCollection.Insert(&entry)
+			created = true
+		} else if context.Request().Header.Get("If-Match") != "" {
+			err = entryCollection.Replace(&entry)
+		} else {
+			created, err = entryCollection.Upsert(&entry)
+		}
+
+		if err != nil {
+			switch typedError := err.(type) {
+			case collection.EntryAlreadyExistsError, collection.EntryDoesNotExistError:
+				return respondPreconditionFailed(context, 0)
+			case collection.RevisionConflictError:
+				return respondPreconditionFailed(context, typedError.ActualRevision)
+			case collection.ValidationError:
+				return respondUnprocessableEntity(context, typedError)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		if created {
+			return respondWritten(context, http.StatusCreated, entry)
+		}
+
+		return respondWritten(context, http.StatusOK, entry)
+	})
+
+	service.POST("/:collection/_batch", func(context echo.Context) error {
 		body, err := ioutil.ReadAll(context.Request().Body)
 		if err != nil {
 			return respondInternalServerError(context)
 		}
 
-		entry := collection.UntypedEntry{}
-		err = json.Unmarshal(body, &entry)
+		request := batchRequest{}
+		err = json.Unmarshal(body, &request)
 		if err != nil {
 			return respondStringBadRequest(context, "Invalid JSON")
 		}
 
-		entryCollection := collection.FilesystemCollection{Name: context.Param("collection")}
-		err = entryCollection.Persist(&entry)
-		if err == nil {
-			return respondOK(context, struct {
-				ID uuid.UUID
-			}{
-				entry.GetID(),
-			})
+		batch, entries, err := decodeBatch(request)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid batch operation")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
 		}
 
-		return respondInternalServerError(context)
+		err = entryCollection.WriteBatch(batch)
+		if err != nil {
+			switch typedError := err.(type) {
+			case collection.EntryDoesNotExistError:
+				return respondNotFound(context)
+			case collection.InvalidBatchError:
+				return respondStringBadRequest(context, "Invalid batch operation")
+			case collection.RevisionConflictError:
+				return context.JSON(http.StatusPreconditionFailed, typedError)
+			case collection.ValidationError:
+				return respondUnprocessableEntity(context, typedError)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		results := []responseID{}
+		for _, entry := range entries {
+			results = append(results, responseID{ID: entry.GetID(), Revision: entry.GetRevision()})
+		}
+
+		return respondOK(context, results)
 	})
 
 	service.GET("/:collection", func(context echo.Context) (err error) {
-		limit := 0
-		limitString := context.QueryParam("limit")
-		if limitString != "" {
-			limit, err = strconv.Atoi(limitString)
-			if err != nil {
-				return respondStringBadRequest(context, "Limit must be integer")
-			}
+		options, err := parseQueryOptions(context.QueryParams())
+		if err != nil {
+			return respondStringBadRequest(context, "Limit and offset must be non-negative integers")
 		}
 
-		filter := make(map[string]interface{})
-		for key, value := range context.QueryParams() {
-			filter[key] = value[0]
+		filter, err := parseFilter(context.QueryParams())
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid filter")
 		}
 
-		delete(filter, "limit")
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
 
-		entryCollection := collection.FilesystemCollection{Name: context.Param("collection")}
 		entries := []collection.UntypedEntry{}
 
+		var result collection.QueryResult
 		if len(filter) > 0 {
-			err = entryCollection.Query(filter, limit, &entries)
+			result, err = entryCollection.QueryWithOptions(filter, options, &entries)
 		} else {
-			err = entryCollection.LoadAll(&entries, limit)
+			result, err = entryCollection.LoadAllWithOptions(&entries, options)
 		}
 
 		if err != nil {
+			switch err.(type) {
+			case collection.InvalidCursorError:
+				return respondStringBadRequest(context, "Invalid cursor")
+			case collection.InvalidPatternError:
+				return respondStringBadRequest(context, "Invalid filter")
+			}
+
 			return respondInternalServerError(context)
 		}
 
+		if result.NextCursor != "" {
+			setNextPageHeaders(context, result.NextCursor)
+		}
+
 		return respondOK(context, entries)
 	})
 
+	service.GET("/:collection/_changes", func(context echo.Context) error {
+		since, resume, err := parseSince(context)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid since")
+		}
+
+		filter, err := parseChangesFilter(context.QueryParams())
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid filter")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		watcher, ok := entryCollection.(collection.Watcher)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		var watchFilter interface{}
+		if len(filter) > 0 {
+			watchFilter = filter
+		}
+
+		var changes <-chan collection.Change
+		if resume {
+			changes, err = watcher.WatchSince(context.Request().Context(), watchFilter, since)
+		} else {
+			changes, err = watcher.Watch(context.Request().Context(), watchFilter)
+		}
+		if err != nil {
+			if typedError, ok := err.(collection.ChangesCompactedError); ok {
+				return respondChangesCompacted(context, typedError)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		return streamChanges(context, changes)
+	})
+
+	service.GET("/:collection/_indexes", func(context echo.Context) error {
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		indexer, ok := entryCollection.(collection.Indexer)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		fields, err := indexer.Indexes()
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		return respondOK(context, fields)
+	})
+
+	service.PUT("/:collection/_indexes/:field", func(context echo.Context) error {
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		indexer, ok := entryCollection.(collection.Indexer)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		err = indexer.CreateIndex(context.Param("field"))
+		if err != nil {
+			if _, ok := err.(collection.InvalidIndexFieldError); ok {
+				return respondStringBadRequest(context, "Invalid index field")
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		return respondEmptyOK(context)
+	})
+
+	service.DELETE("/:collection/_indexes/:field", func(context echo.Context) error {
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		indexer, ok := entryCollection.(collection.Indexer)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		err = indexer.DropIndex(context.Param("field"))
+		if err != nil {
+			switch err.(type) {
+			case collection.InvalidIndexFieldError:
+				return respondStringBadRequest(context, "Invalid index field")
+			case collection.IndexDoesNotExistError:
+				return respondNotFound(context)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		return respondEmptyOK(context)
+	})
+
+	service.GET("/:collection/_schema", func(context echo.Context) error {
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		validator, ok := entryCollection.(collection.SchemaValidator)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		schema, err := validator.Schema()
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		if schema == nil {
+			return respondNotFound(context)
+		}
+
+		return context.JSONBlob(http.StatusOK, schema)
+	})
+
+	// Schemas may only use collection.SchemaKeywords and
+	// collection.SchemaAnnotations, others are answered with 400 and a message
+	// that lists the supported keywords.
+	service.PUT("/:collection/_schema", func(context echo.Context) error {
+		schema, err := ioutil.ReadAll(context.Request().Body)
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		validator, ok := entryCollection.(collection.SchemaValidator)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		err = validator.SetSchema(schema)
+		if err != nil {
+			if typedError, ok := err.(collection.InvalidSchemaError); ok {
+				return context.JSON(http.StatusBadRequest, struct {
+					Message string `json:"message"`
+				}{typedError.Message})
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		return respondEmptyOK(context)
+	})
+
+	service.DELETE("/:collection/_schema", func(context echo.Context) error {
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		validator, ok := entryCollection.(collection.SchemaValidator)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		schema, err := validator.Schema()
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		if schema == nil {
+			return respondNotFound(context)
+		}
+
+		err = validator.SetSchema(nil)
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		return respondEmptyOK(context)
+	})
+
+	// The ETag is only sent for the current revision of an entry, since it is
+	// what If-Match is compared to. Past revisions read with rev or asOf hold
+	// their revision in the body.
 	service.GET("/:collection/:id", func(context echo.Context) error {
 		id, err := uuid.FromString(context.Param("id"))
 		if err != nil {
 			return respondStringBadRequest(context, "Invalid UUID")
 		}
 
-		entryCollection := collection.FilesystemCollection{Name: context.Param("collection")}
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
 		entry := collection.UntypedEntry{}
-		err = entryCollection.Load(id, &entry)
+		past := context.QueryParam("rev") != "" || context.QueryParam("asOf") != ""
+		if past {
+			historian, ok := entryCollection.(collection.Historian)
+			if !ok {
+				return respondNotImplemented(context)
+			}
+
+			err = loadPastRevision(context, historian, id, &entry)
+			if _, ok := err.(invalidHistoryParameterError); ok {
+				return respondStringBadRequest(context, "Invalid rev or asOf parameter")
+			}
+		} else {
+			err = entryCollection.Load(id, &entry)
+		}
 		if err != nil {
 			return respondNotFound(context)
 		}
 
+		if !past {
+			setETag(context, entry.GetRevision())
+		}
+
+		if fields := collection.ParseFields(context.QueryParam("fields")); len(fields) > 0 {
+			entry.Project(fields)
+		}
+
+		return respondOK(context, entry)
+	})
+
+	service.GET("/:collection/_history", func(context echo.Context) error {
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		keeper, ok := entryCollection.(collection.HistoryKeeper)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		revisions, err := keeper.HistoryRetention()
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		return respondOK(context, historyRetention{Revisions: revisions})
+	})
+
+	service.PUT("/:collection/_history", func(context echo.Context) error {
+		body, err := ioutil.ReadAll(context.Request().Body)
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		retention := historyRetention{}
+		err = json.Unmarshal(body, &retention)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid JSON")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		keeper, ok := entryCollection.(collection.HistoryKeeper)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		err = keeper.SetHistoryRetention(retention.Revisions)
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		return respondEmptyOK(context)
+	})
+
+	service.GET("/:collection/:id/_history", func(context echo.Context) error {
+		id, err := uuid.FromString(context.Param("id"))
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid UUID")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		historian, ok := entryCollection.(collection.Historian)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		records, err := historian.History(id)
+		if err != nil {
+			if _, ok := err.(collection.EntryDoesNotExistError); ok {
+				return respondNotFound(context)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		return respondOK(context, records)
+	})
+
+	service.POST("/:collection/:id/_revert", func(context echo.Context) error {
+		id, err := uuid.FromString(context.Param("id"))
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid UUID")
+		}
+
+		revision, err := strconv.ParseUint(context.QueryParam("rev"), 10, 64)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid rev parameter")
+		}
+
+		entry := collection.UntypedEntry{}
+		err = applyIfMatch(context, &entry)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid If-Match header")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		historian, ok := entryCollection.(collection.Historian)
+		if !ok {
+			return respondNotImplemented(context)
+		}
+
+		err = historian.Revert(id, revision, &entry)
+		if err != nil {
+			switch typedError := err.(type) {
+			case collection.EntryDoesNotExistError, collection.RevisionDoesNotExistError:
+				return respondNotFound(context)
+			case collection.RevisionConflictError:
+				return respondPreconditionFailed(context, typedError.ActualRevision)
+			case collection.ValidationError:
+				return respondUnprocessableEntity(context, typedError)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		setETag(context, entry.GetRevision())
+		return respondOK(context, entry)
+	})
+
+	service.PATCH("/:collection/:id", func(context echo.Context) error {
+		id, err := uuid.FromString(context.Param("id"))
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid UUID")
+		}
+
+		body, err := ioutil.ReadAll(context.Request().Body)
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		var patch collection.Patch = collection.MergePatch(body)
+		if strings.HasPrefix(context.Request().Header.Get("Content-Type"), collection.JSONPatchContentType) {
+			patch = collection.JSONPatch(body)
+		}
+
+		entry := collection.UntypedEntry{}
+		err = applyIfMatch(context, &entry)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid If-Match header")
+		}
+
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
+		err = entryCollection.Patch(id, patch, &entry)
+		if err != nil {
+			switch typedError := err.(type) {
+			case collection.EntryDoesNotExistError:
+				return respondNotFound(context)
+			case collection.InvalidPatchError:
+				return respondStringBadRequest(context, typedError.Message)
+			case collection.PatchTestFailedError:
+				return respondConflict(context)
+			case collection.RevisionConflictError:
+				return respondPreconditionFailed(context, typedError.ActualRevision)
+			case collection.ValidationError:
+				return respondUnprocessableEntity(context, typedError)
+			}
+
+			return respondInternalServerError(context)
+		}
+
+		setETag(context, entry.GetRevision())
 		return respondOK(context, entry)
 	})
 
@@ -107,15 +628,28 @@ func NewService(useTLS bool, behindProxy bool, bodyLimit string) (service *serve
 			return respondStringBadRequest(context, "Invalid UUID")
 		}
 
-		entryCollection := collection.FilesystemCollection{Name: context.Param("collection")}
+		entryCollection, err := backend.Open(context.Param("collection"))
+		if err != nil {
+			return respondInternalServerError(context)
+		}
+
 		entry := collection.UntypedEntry{}
 		entry.SetID(id)
+		err = applyIfMatch(context, &entry)
+		if err != nil {
+			return respondStringBadRequest(context, "Invalid If-Match header")
+		}
+
 		err = entryCollection.Delete(&entry)
 		if err != nil {
 			if err.Error() == (collection.EntryDoesNotExistError{}).Error() {
 				return respondNotFound(context)
 			}
 
+			if conflict, ok := err.(collection.RevisionConflictError); ok {
+				return respondPreconditionFailed(context, conflict.ActualRevision)
+			}
+
 			return respondInternalServerError(context)
 		}
 
@@ -125,6 +659,92 @@ func NewService(useTLS bool, behindProxy bool, bodyLimit string) (service *serve
 	return
 }
 
+func readEntry(context echo.Context) (entry collection.UntypedEntry, err error) {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		return
+	}
+
+	entry = collection.UntypedEntry{}
+	err = json.Unmarshal(body, &entry)
+	return
+}
+
+// applyIfMatch sets the revision from the If-Match header on the entry so that
+// the write fails unless the stored entry still has that revision.
+func applyIfMatch(context echo.Context, entry *collection.UntypedEntry) (err error) {
+	ifMatch := context.Request().Header.Get("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return
+	}
+
+	revision, err := collection.ParseETag(ifMatch)
+	if err != nil {
+		return
+	}
+
+	entry.SetRevision(revision)
+	return
+}
+
+// applyExpiry sets the expiry time from the X-Expires-At header, an RFC 3339
+// time, or the ttl query parameter, in seconds or as a duration like 15m.
+func applyExpiry(context echo.Context, entry *collection.UntypedEntry) (valid bool) {
+	if header := context.Request().Header.Get("X-Expires-At"); header != "" {
+		expiresAt, err := time.Parse(time.RFC3339, header)
+		if err != nil {
+			return
+		}
+
+		entry.SetExpiresAt(expiresAt)
+		return true
+	}
+
+	ttl := context.QueryParam("ttl")
+	if ttl == "" {
+		return true
+	}
+
+	duration, err := time.ParseDuration(ttl)
+	if seconds, parseError := strconv.ParseUint(ttl, 10, 32); parseError == nil {
+		duration, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || duration <= 0 {
+		return
+	}
+
+	entry.SetExpiresAt(time.Now().Add(duration))
+	return true
+}
+
+func setETag(context echo.Context, revision uint64) {
+	if revision != 0 {
+		context.Response().Header().Set("ETag", collection.FormatETag(revision))
+	}
+}
+
+func setNextPageHeaders(context echo.Context, nextCursor string) {
+	nextURL := *context.Request().URL
+	query := nextURL.Query()
+	query.Del("offset")
+	query.Set("cursor", nextCursor)
+	nextURL.RawQuery = query.Encode()
+
+	context.Response().Header().Set(nextCursorHeader, nextCursor)
+	context.Response().Header().Set("Link", "<"+nextURL.RequestURI()+">; rel=\"next\"")
+}
+
+func respondWritten(context echo.Context, status int, entry collection.UntypedEntry) error {
+	setETag(context, entry.GetRevision())
+	return context.JSON(status, struct {
+		ID       uuid.UUID
+		Revision uint64 `json:"_revision"`
+	}{
+		entry.GetID(),
+		entry.GetRevision(),
+	})
+}
+
 func respondStringBadRequest(context echo.Context, message string) error {
 	return context.JSONBlob(http.StatusBadRequest, []byte("{\"message\":\""+message+"\"}"))
 }
@@ -137,6 +757,29 @@ func respondNotFound(context echo.Context) error {
 	return context.JSONBlob(http.StatusNotFound, []byte("{\"message\":\"Not Found\"}"))
 }
 
+func respondConflict(context echo.Context) error {
+	return context.JSONBlob(http.StatusConflict, []byte("{\"message\":\"Conflict\"}"))
+}
+
+func respondPreconditionFailed(context echo.Context, actualRevision uint64) error {
+	setETag(context, actualRevision)
+	return context.JSONBlob(http.StatusPreconditionFailed, []byte("{\"message\":\"Precondition Failed\"}"))
+}
+
+// respondUnprocessableEntity lists the parts of an entry that do not match
+// the schema of the collection.
+func respondUnprocessableEntity(context echo.Context, validationError collection.ValidationError) error {
+	return context.JSON(http.StatusUnprocessableEntity, validationResponse{
+		Message:    "Unprocessable Entity",
+		ID:         validationError.ID,
+		Violations: validationError.Violations,
+	})
+}
+
+func respondNotImplemented(context echo.Context) error {
+	return context.JSONBlob(http.StatusNotImplemented, []byte("{\"message\":\"Not Implemented\"}"))
+}
+
 func respondInternalServerError(context echo.Context) error {
 	return context.JSONBlob(http.StatusInternalServerError, []byte("{\"message\":\"Internal Server Error\"}"))
 }
@@ -0,0 +1,86 @@
+package remote
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mojlighetsministeriet/storage/collection"
+)
+
+// DefaultSweepInterval is how often the service removes expired entries, they
+// are hidden from reads as soon as they expire.
+const DefaultSweepInterval = time.Minute
+
+// Sweeper removes the expired entries of every collection of a backend at an
+// interval until it is stopped.
+type Sweeper struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// StartSweeper starts removing the expired entries of the backend, the
+// interval must be positive.
+func StartSweeper(backend collection.Backend, interval time.Duration) (sweeper *Sweeper) {
+	sweeper = &Sweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go sweeper.run(backend, interval)
+	return
+}
+
+func (sweeper *Sweeper) run(backend collection.Backend, interval time.Duration) {
+	defer close(sweeper.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sweeper.stop:
+			return
+		case <-ticker.C:
+			removeExpired(backend)
+		}
+	}
+}
+
+// Stop stops the sweeper and waits for a sweep that is running to finish.
+func (sweeper *Sweeper) Stop() {
+	sweeper.stopOnce.Do(func() {
+		close(sweeper.stop)
+	})
+
+	<-sweeper.done
+}
+
+// removeExpired removes the expired entries of every collection that supports
+// it.
+func removeExpired(backend collection.Backend) {
+	info, err := backend.Info()
+	if err != nil {
+		log.Println("Failed to list collections to remove expired entries from:", err)
+		return
+	}
+
+	for _, collectionInfo := range info {
+		entryCollection, err := backend.Open(collectionInfo.Name)
+		if err != nil {
+			log.Println("Failed to open collection", collectionInfo.Name, "to remove expired entries:", err)
+			continue
+		}
+
+		expirer, ok := entryCollection.(collection.Expirer)
+		if !ok {
+			continue
+		}
+
+		_, err = expirer.RemoveExpired()
+		if err != nil {
+			log.Println("Failed to remove expired entries from collection", collectionInfo.Name, ":", err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package sessionstore
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
@@ -12,6 +13,7 @@ import (
 
 type StoredSession struct {
 	collection.BaseEntry
+	collection.Expiry
 	Data string
 }
 
@@ -21,6 +23,12 @@ func NewStore(url string, domain string, keyPairs ...[]byte) (store *Store, err
 		return
 	}
 
+	store = NewStoreWithCollection(collection, domain, keyPairs...)
+
+	return
+}
+
+func NewStoreWithCollection(sessionCollection collection.Collection, domain string, keyPairs ...[]byte) (store *Store) {
 	store = &Store{
 		Codecs: securecookie.CodecsFromPairs(keyPairs...),
 		Options: &sessions.Options{
@@ -28,7 +36,7 @@ func NewStore(url string, domain string, keyPairs ...[]byte) (store *Store, err
 			MaxAge: 86400 * 30,
 			Domain: domain,
 		},
-		Collection: collection,
+		Collection: sessionCollection,
 	}
 
 	store.MaxAge(store.Options.MaxAge)
@@ -39,7 +47,7 @@ func NewStore(url string, domain string, keyPairs ...[]byte) (store *Store, err
 type Store struct {
 	Codecs     []securecookie.Codec
 	Options    *sessions.Options
-	Collection *remote.RemoteCollection
+	Collection collection.Collection
 }
 
 func (store *Store) MaxAge(age int) {
@@ -122,6 +130,9 @@ func (store *Store) save(session *sessions.Session) (err error) {
 
 	storedSession := StoredSession{Data: encoded}
 	storedSession.SetID(id)
+	if session.Options.MaxAge > 0 {
+		storedSession.ExpireAfter(time.Duration(session.Options.MaxAge) * time.Second)
+	}
 	err = store.Collection.Persist(&storedSession)
 
 	return